@@ -0,0 +1,330 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emcfarlane/jukebox/core"
+)
+
+// Behaviour that earns a ban, counted over abuseWindow
+const (
+	abuseWindow   = time.Minute
+	abuseFlips    = 8   // Vote direction changes on one song, by a session
+	abuseConnects = 30  // Websocket connects, by IP
+	abuseCommands = 240 // Websocket messages, by session
+)
+
+// Ban lengths, each strike within abuseStrikes bans for longer
+var abuseBans = []time.Duration{time.Minute, 10 * time.Minute, time.Hour, 24 * time.Hour}
+
+const abuseStrikes = 24 * time.Hour
+
+// A temporary ban, Target is "ip:..." or "session:...". Times in ms.
+type Ban struct {
+	ID      string
+	Target  string
+	Reason  string
+	Level   int // Strikes, including this one
+	Time    int
+	Expires int
+	Lifted  int `json:",omitempty"` // When an admin lifted it early
+}
+
+func (b Ban) Active() bool {
+	return b.Lifted == 0 && int64(b.Expires) > makeTimestamp()
+}
+
+// Time left, for the admin console
+func (b Ban) Left() time.Duration {
+	return time.Duration(int64(b.Expires)-makeTimestamp()) * time.Millisecond / time.Second * time.Second
+}
+
+type abuseCount struct {
+	start time.Time
+	n     int
+}
+
+// Counts for spotting abuse, and the bans in force
+type abuse struct {
+	lock   *sync.Mutex
+	counts map[string]*abuseCount // By what's counted and who
+	votes  map[string]int         // Last vote direction, by session and song
+	bans   map[string]*Ban        // Active, by target
+	swept  time.Time
+}
+
+func newAbuse() *abuse {
+	return &abuse{
+		lock:   &sync.Mutex{},
+		counts: make(map[string]*abuseCount),
+		votes:  make(map[string]int),
+		bans:   make(map[string]*Ban),
+	}
+}
+
+// Count one, true once over limit this window. lock must be held.
+func (a *abuse) hit(key string, limit int) bool {
+	now := time.Now()
+	if now.Sub(a.swept) > abuseWindow {
+		for k, c := range a.counts {
+			if now.Sub(c.start) > abuseWindow {
+				delete(a.counts, k)
+			}
+		}
+		a.votes = make(map[string]int)
+		a.swept = now
+	}
+	c, ok := a.counts[key]
+	if !ok || now.Sub(c.start) > abuseWindow {
+		c = &abuseCount{start: now}
+		a.counts[key] = c
+	}
+	c.n++
+	return c.n > limit
+}
+
+// The first active ban on any of the targets, nil if none
+func (a *abuse) banned(targets ...string) *Ban {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	for _, t := range targets {
+		if b, ok := a.bans[t]; ok {
+			if b.Active() {
+				return b
+			}
+			delete(a.bans, t)
+		}
+	}
+	return nil
+}
+
+// Set once the -tunnel this process started is up, before serving.
+// Only then is X-Forwarded-For on a local connection the tunnel's.
+var trustForwarded bool
+
+// Address of the client, behind our tunnel the one it forwarded. ""
+// if it's only known to be local, so a tunnel isn't banned for its
+// guests.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !ip.IsLoopback() {
+		return host
+	}
+	if !trustForwarded {
+		return ""
+	}
+	// The tunnel appends the address it saw, any before it are the
+	// client's to make up
+	fwd := r.Header.Values("X-Forwarded-For")
+	if len(fwd) == 0 {
+		return ""
+	}
+	hops := strings.Split(fwd[len(fwd)-1], ",")
+	if ip := net.ParseIP(strings.TrimSpace(hops[len(hops)-1])); ip != nil {
+		return ip.String()
+	}
+	return ""
+}
+
+func (u *User) targets() []string {
+	t := []string{"session:" + u.session.ID}
+	if u.ip != "" {
+		t = append(t, "ip:"+u.ip)
+	}
+	return t
+}
+
+// Load bans in force, at start up and when another instance bans
+func (s *Server) bansLoad() error {
+	bans, err := s.store.Bans(int(makeTimestamp() - int64(abuseBans[len(abuseBans)-1]/time.Millisecond)))
+	if err != nil {
+		return err
+	}
+	s.abuse.lock.Lock()
+	defer s.abuse.lock.Unlock()
+	s.abuse.bans = make(map[string]*Ban)
+	for i := range bans {
+		if b := &bans[i]; b.Active() {
+			if _, ok := s.abuse.bans[b.Target]; !ok {
+				s.abuse.bans[b.Target] = b // Newest first
+			}
+		}
+	}
+	return nil
+}
+
+// Ban a target, for longer for each recent strike, and drop its sockets
+func (s *Server) strike(target, reason string) *Ban {
+	now := makeTimestamp()
+	level := 1
+	bans, err := s.store.Bans(int(now - int64(abuseStrikes/time.Millisecond)))
+	if err != nil {
+		log.Println("strike: ", err)
+	}
+	for _, b := range bans {
+		if b.Target == target {
+			level++
+		}
+	}
+	id, err := randomID()
+	if err != nil {
+		log.Println("strike: ", err)
+	}
+	d := abuseBans[min(level, len(abuseBans))-1]
+	b := &Ban{
+		ID:      id,
+		Target:  target,
+		Reason:  reason,
+		Level:   level,
+		Time:    int(now),
+		Expires: int(now + int64(d/time.Millisecond)),
+	}
+	if err := s.store.SaveBan(b); err != nil {
+		log.Println("strike: ", err)
+	}
+	s.abuse.lock.Lock()
+	s.abuse.bans[target] = b
+	s.abuse.lock.Unlock()
+	log.Println("Abuse: Banned ", target, " for ", d, ", ", reason)
+	s.audit(core.EventBan, fmt.Sprintf("%s for %s, %s", target, d, reason))
+
+	s.publish(&Message{Command: "bans"})
+	s.kick(target)
+	return b
+}
+
+// Close the sockets of a banned target
+func (s *Server) kick(target string) {
+	s.sockLock.Lock()
+	defer s.sockLock.Unlock()
+	for _, u := range s.sockUsers {
+		for _, t := range u.targets() {
+			if t == target {
+				u.conn.Close()
+			}
+		}
+	}
+}
+
+// Count a websocket connect, the ban if it's refused. Admins, like
+// bench with a token, aren't counted.
+func (s *Server) abuseConnect(ip, session string, admin bool) *Ban {
+	targets := []string{"session:" + session}
+	if ip != "" {
+		targets = append(targets, "ip:"+ip)
+	}
+	if b := s.abuse.banned(targets...); b != nil {
+		return b
+	}
+	if ip == "" || admin {
+		return nil
+	}
+	s.abuse.lock.Lock()
+	over := s.abuse.hit("connect ip:"+ip, abuseConnects)
+	s.abuse.lock.Unlock()
+	if over {
+		return s.strike("ip:"+ip, "reconnecting too fast")
+	}
+	return nil
+}
+
+// Count a websocket message, a reason to refuse it if the sender is
+// banned or is now
+func (s *Server) abuseCommand(u *User, msg Message) string {
+	if s.abuse.banned(u.targets()...) != nil {
+		return "banned"
+	}
+	target := "session:" + u.session.ID
+	s.abuse.lock.Lock()
+	reason := ""
+	if s.abuse.hit("command "+target, abuseCommands) {
+		reason = "too many commands"
+	}
+	// Flipping a vote back and forth, each vote in a merge counts
+	votes := []Message{msg}
+	if msg.Command == "merge" {
+		votes = msg.Votes
+	}
+	for _, v := range votes {
+		delta := map[string]int{"plus": 1, "minus": -1}[v.Command]
+		if delta == 0 || reason != "" {
+			continue
+		}
+		key := target + " " + v.Song.Name
+		if last := s.abuse.votes[key]; last != 0 && last != delta && s.abuse.hit("flip "+key, abuseFlips) {
+			reason = "flipping votes"
+		}
+		s.abuse.votes[key] = delta
+	}
+	s.abuse.lock.Unlock()
+	if reason == "" {
+		return ""
+	}
+	s.strike(target, reason)
+	return "banned"
+}
+
+// Bans handle, admins GET the last day's bans and DELETE
+// /api/v1/bans/{id} to lift one
+func (s *Server) bansAPI(w http.ResponseWriter, r *http.Request) error {
+	if !s.isAdmin(r) {
+		http.Error(w, "admin only", http.StatusForbidden)
+		return nil
+	}
+	bans, err := s.store.Bans(int(makeTimestamp() - int64(abuseStrikes/time.Millisecond)))
+	if err != nil {
+		return err
+	}
+
+	switch r.Method {
+	case "GET":
+		if bans == nil {
+			bans = []Ban{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		return json.NewEncoder(w).Encode(bans)
+	case "DELETE":
+		id := strings.TrimPrefix(r.URL.Path, "/api/v1/bans/")
+		for _, b := range bans {
+			if b.ID != id {
+				continue
+			}
+			if b.Active() {
+				b.Lifted = int(makeTimestamp())
+				if err := s.store.SaveBan(&b); err != nil {
+					return err
+				}
+				log.Println("Abuse: Lifted ban on ", b.Target)
+				s.audit(core.EventLift, b.Target)
+			}
+			if err := s.bansLoad(); err != nil {
+				return err
+			}
+			s.publish(&Message{Command: "bans"})
+			return nil
+		}
+		http.NotFound(w, r)
+		return nil
+	}
+	http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	return nil
+}
+
+// Refuse a banned websocket with when to come back
+func banError(w http.ResponseWriter, b *Ban) {
+	left := (int64(b.Expires) - makeTimestamp() + 999) / 1000
+	w.Header().Set("Retry-After", strconv.FormatInt(max(left, 1), 10))
+	http.Error(w, "banned: "+b.Reason, http.StatusTooManyRequests)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+func (s *Server) adminToken(token string) bool {
+	return *adminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(*adminToken)) == 1
+}
+
+// Whether a request is from an admin, by bearer token or an admin session
+func (s *Server) isAdmin(r *http.Request) bool {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return s.adminToken(strings.TrimPrefix(auth, "Bearer "))
+	}
+	if !sameSite(r) {
+		return false
+	}
+	sess, err := s.cookieSession(r)
+	if err != nil || sess == nil {
+		return false
+	}
+	return s.can(sess, "admin")
+}
+
+// Whether a request that changes something came from one of our own
+// pages, so other sites can't use an admin's cookie. Requests from
+// outside a browser send neither header.
+func sameSite(r *http.Request) bool {
+	switch r.Method {
+	case "GET", "HEAD", "OPTIONS":
+		return true
+	}
+	if site := r.Header.Get("Sec-Fetch-Site"); site != "" {
+		return site == "same-origin" || site == "none"
+	}
+	if origin := r.Header.Get("Origin"); origin != "" {
+		u, err := url.Parse(origin)
+		return err == nil && u.Host == r.Host
+	}
+	return true
+}
+
+// Login handle, marks the session as an admin if the token matches
+func (s *Server) loginAPI(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return nil
+	}
+	if !s.adminToken(r.FormValue("token")) {
+		http.Error(w, "bad token", http.StatusForbidden)
+		return nil
+	}
+	sess, err := s.session(r, w.Header())
+	if err != nil {
+		return err
+	}
+	sess.Admin = true
+	if err := s.store.SaveSession(sess); err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(sess)
+}
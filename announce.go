@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Largest uploaded clip
+const maxClip = 10 << 20
+
+// Audio played between songs
+type Announcement struct {
+	ID   string
+	Text string `json:",omitempty"`
+	URL  string
+
+	data        []byte
+	contentType string
+}
+
+// Announcement audio between instances, so any can serve it
+type announceSync struct {
+	Data        []byte
+	ContentType string
+}
+
+// Speak text with the -tts command. The text goes on stdin, so it can't
+// be taken for a flag.
+func speak(ctx context.Context, text string) ([]byte, error) {
+	args := strings.Fields(*tts)
+	if len(args) == 0 {
+		return nil, errors.New("text to speech disabled")
+	}
+	var out bytes.Buffer
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stdin = strings.NewReader(text)
+	cmd.Stdout = &out
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// Queue an announcement for after the current song
+func (s *Server) announce(a *Announcement) error {
+	id, err := randomID() // Unique across instances
+	if err != nil {
+		return err
+	}
+	s.songLock.Lock()
+	defer s.songLock.Unlock()
+	a.ID = id
+	a.URL = "/announce/" + a.ID
+	s.announceQueue = append(s.announceQueue, a)
+	s.announceMap[a.ID] = a
+	log.Println("Announcement queued: ", a.ID)
+	return nil
+}
+
+// Play the next queued announcement, songLock must be held
+func (s *Server) announcePlay() bool {
+	if len(s.announceQueue) == 0 {
+		return false
+	}
+	a := s.announceQueue[0]
+	s.announceQueue = s.announceQueue[1:]
+
+	// Done with the last one
+	if last := s.songPlaying.Announce; last != nil {
+		delete(s.announceMap, last.ID)
+	}
+
+	msg := &Message{
+		Command:  "play",
+		Song:     Song{Name: "announce:" + a.ID},
+		Time:     int(makeTimestamp()),
+		Epoch:    s.songPlaying.Epoch + 1,
+		Announce: a,
+	}
+	if fm, err := readFormat(bytes.NewReader(a.data)); err == nil {
+		msg.Duration = fm.Duration
+	}
+	log.Println("Announcement: ", a.ID)
+	s.songPlaying = msg
+	s.schedule()
+	s.sockWriteLoop(msg)
+	s.emit(msg)
+	go s.nowPlayingWrite(msg)
+
+	// Other instances' clients fetch the clip from them
+	pub := *msg
+	data, err := json.Marshal(&announceSync{Data: a.data, ContentType: a.contentType})
+	if err != nil {
+		log.Println("announce: ", err)
+		return true
+	}
+	pub.Data = data
+	s.publish(&pub)
+	return true
+}
+
+// Keep the clip of an announcement playing on another instance, so
+// clients here can fetch it. songLock must be held.
+func (s *Server) announceReceive(msg *Message) {
+	var v announceSync
+	err := json.Unmarshal(msg.Data, &v)
+	msg.Data = nil // Not for clients
+	if err != nil {
+		log.Println("announce: ", err)
+		return
+	}
+	if last := s.songPlaying.Announce; last != nil {
+		delete(s.announceMap, last.ID)
+	}
+	a := msg.Announce
+	a.data, a.contentType = v.Data, v.ContentType
+	s.announceMap[a.ID] = a
+}
+
+// Announcement handle, admins POST a clip or JSON {"Text": ...} to speak
+func (s *Server) announceAPI(w http.ResponseWriter, r *http.Request) error {
+	if !s.isAdmin(r) {
+		http.Error(w, "admin only", http.StatusForbidden)
+		return nil
+	}
+
+	switch r.Method {
+	case "GET":
+		s.songLock.Lock()
+		queue := append([]*Announcement{}, s.announceQueue...)
+		s.songLock.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		return json.NewEncoder(w).Encode(queue)
+	case "POST":
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return nil
+	}
+
+	a := &Announcement{}
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		if err := json.NewDecoder(r.Body).Decode(a); err != nil || a.Text == "" {
+			http.Error(w, "expected text", http.StatusBadRequest)
+			return nil
+		}
+		data, err := speak(r.Context(), a.Text)
+		if err != nil {
+			return err
+		}
+		a.data, a.contentType = data, "audio/wav"
+	} else {
+		data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxClip))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return nil
+		}
+		if len(data) == 0 {
+			http.Error(w, "empty clip", http.StatusBadRequest)
+			return nil
+		}
+		a.data, a.contentType = data, r.Header.Get("Content-Type")
+		a.Text = r.FormValue("text")
+	}
+
+	if err := s.announce(a); err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(a)
+}
+
+// Announcement audio
+func (s *Server) announceAudio(w http.ResponseWriter, r *http.Request) error {
+	id := strings.TrimPrefix(r.URL.Path, "/announce/")
+	s.songLock.Lock()
+	a := s.announceMap[id]
+	s.songLock.Unlock()
+	if a == nil {
+		http.NotFound(w, r)
+		return nil
+	}
+	if a.contentType != "" {
+		w.Header().Set("Content-Type", a.contentType)
+	}
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(a.data))
+	return nil
+}
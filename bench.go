@@ -0,0 +1,358 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emcfarlane/jukebox/client"
+)
+
+// Votes not broadcast back within this long are counted as lost
+const benchTimeout = 10 * time.Second
+
+// Server memory and load, for bench
+type ServerStats struct {
+	Goroutines int
+	Clients    int
+	HeapAlloc  uint64 // Bytes
+	HeapInuse  uint64
+	Sys        uint64
+	NumGC      uint32
+}
+
+// Stats handle, admin only as it's cheap but not free
+func (s *Server) statsAPI(w http.ResponseWriter, r *http.Request) error {
+	if !s.isAdmin(r) {
+		http.Error(w, "admin only", http.StatusForbidden)
+		return nil
+	}
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	s.sockLock.Lock()
+	clients := len(s.sockUsers)
+	s.sockLock.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(&ServerStats{
+		Goroutines: runtime.NumGoroutine(),
+		Clients:    clients,
+		HeapAlloc:  m.HeapAlloc,
+		HeapInuse:  m.HeapInuse,
+		Sys:        m.Sys,
+		NumGC:      m.NumGC,
+	})
+}
+
+// A vote waiting to be broadcast back, by song. Only one per song is
+// in flight so every update for it can be timed against it.
+type benchVote struct {
+	sent time.Time
+	seen int
+}
+
+type bench struct {
+	clients int
+
+	lock      *sync.Mutex
+	pending   map[string]*benchVote
+	latencies []time.Duration // Vote to each client's update
+	searches  []time.Duration
+	votes     int
+	rejected  int // Acked with an error, e.g. rate limited
+	lost      int // Clients that never saw a vote's update
+	errors    int
+}
+
+// Bench command, load tests a running server with simulated clients:
+//
+//	jukebox bench [-clients 100] [-duration 30s] [-token admin] http://host:8000
+//
+// Each client keeps a websocket open, votes for songs picked with a
+// popularity skew and searches now and then. Reports how long votes
+// take to be broadcast to every client, search latency and, with an
+// admin token, the server's memory before and after.
+func benchCommand(args []string) error {
+	fs := flag.NewFlagSet("bench", flag.ContinueOnError)
+	clients := fs.Int("clients", 100, "Simulated websocket clients")
+	duration := fs.Duration("duration", 30*time.Second, "How long to generate traffic for")
+	votes := fs.Float64("votes", 10, "Votes per client per minute, keep under the server's -vote-rate")
+	searches := fs.Float64("searches", 2, "Searches per client per minute")
+	token := fs.String("token", "", "Admin token, to report the server's memory. Without one the server bans over 30 clients from one address.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	addr := fs.Arg(0)
+	if addr == "" {
+		addr = "http://localhost:8000"
+	}
+	if *clients < 1 {
+		return errors.New("bench: need at least one client")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *duration)
+	defer cancel()
+
+	stats, err := benchStats(addr, *token)
+	if err != nil {
+		return err
+	}
+	before, err := stats()
+	if err != nil {
+		return err
+	}
+
+	// Connect everyone before any traffic
+	conns := make([]*client.Client, *clients)
+	for i := range conns {
+		c, err := client.New(addr)
+		if err != nil {
+			return err
+		}
+		if *token != "" {
+			c.SetToken(*token)
+		}
+		defer c.Close()
+		if err := c.Connect(ctx); err != nil {
+			return fmt.Errorf("bench: client %d: %v", i, err)
+		}
+		conns[i] = c
+	}
+	songs, err := conns[0].Songs(ctx)
+	if err != nil {
+		return err
+	}
+	if len(songs) == 0 {
+		return errors.New("bench: the server has no songs")
+	}
+	sort.Slice(songs, func(i, j int) bool { return songs[i].Score > songs[j].Score })
+	fmt.Printf("Connected %d clients, %d songs, running for %s\n", *clients, len(songs), *duration)
+
+	b := &bench{
+		clients: *clients,
+		lock:    &sync.Mutex{},
+		pending: make(map[string]*benchVote),
+	}
+	start := time.Now()
+
+	// Receivers keep going a second longer for the last broadcasts
+	drain, stop := context.WithTimeout(context.Background(), *duration+time.Second)
+	defer stop()
+	var wg, received sync.WaitGroup
+	for i, c := range conns {
+		msgs, unsubscribe := c.Subscribe()
+		defer unsubscribe()
+		received.Add(1)
+		go func() {
+			defer received.Done()
+			b.receive(drain, msgs)
+		}()
+		wg.Add(1)
+		go func(c *client.Client, seed int64) {
+			defer wg.Done()
+			b.traffic(ctx, c, songs, rand.New(rand.NewSource(seed)), *votes, *searches)
+		}(c, start.UnixNano()+int64(i))
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+	received.Wait()
+
+	after, err := stats()
+	if err != nil {
+		return err
+	}
+	b.report(elapsed, before, after)
+	return nil
+}
+
+// Vote and search at random intervals averaging the given rates
+func (b *bench) traffic(ctx context.Context, c *client.Client, songs []client.Song, rng *rand.Rand, votes, searches float64) {
+	wait := func(perMinute float64) <-chan time.Time {
+		if perMinute <= 0 {
+			return nil
+		}
+		return time.After(time.Duration(rng.ExpFloat64() * float64(time.Minute) / perMinute))
+	}
+	vote, search := wait(votes), wait(searches)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-vote:
+			vote = wait(votes)
+			// Most votes are for the popular end of the list, and up
+			i := int(rng.ExpFloat64()*float64(len(songs))/8) % len(songs)
+			name := songs[i].Name
+			if !b.send(name) {
+				continue
+			}
+			if err := c.Vote(name, rng.Float64() < 0.8); err != nil {
+				b.fail()
+			}
+		case <-search:
+			search = wait(searches)
+			q := benchQuery(songs[rng.Intn(len(songs))].Name, rng)
+			t := time.Now()
+			_, err := c.Search(ctx, q, 20)
+			b.lock.Lock()
+			if err != nil {
+				if ctx.Err() == nil {
+					b.errors++
+				}
+			} else {
+				b.searches = append(b.searches, time.Since(t))
+			}
+			b.lock.Unlock()
+		}
+	}
+}
+
+// A word or the start of one from a song name, as someone would type
+func benchQuery(name string, rng *rand.Rand) string {
+	words := strings.FieldsFunc(name, func(r rune) bool {
+		return r == ' ' || r == '-' || r == '_' || r == '.' || r == '/'
+	})
+	if len(words) == 0 {
+		return name
+	}
+	w := []rune(words[rng.Intn(len(words))])
+	if len(w) > 3 {
+		w = w[:3+rng.Intn(len(w)-2)]
+	}
+	return string(w)
+}
+
+// Start timing a vote, false if one for the song is still in flight
+func (b *bench) send(name string) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	now := time.Now()
+	if v, ok := b.pending[name]; ok {
+		if now.Sub(v.sent) < benchTimeout {
+			return false
+		}
+		b.lost += b.clients - v.seen
+	}
+	b.pending[name] = &benchVote{sent: now}
+	b.votes++
+	return true
+}
+
+func (b *bench) fail() {
+	b.lock.Lock()
+	b.errors++
+	b.lock.Unlock()
+}
+
+// Time updates for votes in flight as one client sees them
+func (b *bench) receive(ctx context.Context, msgs <-chan client.Message) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case msg, ok := <-msgs:
+			if !ok {
+				return
+			}
+			now := time.Now()
+			b.lock.Lock()
+			switch msg.Command {
+			case "update":
+				if v, ok := b.pending[msg.Song.Name]; ok {
+					b.latencies = append(b.latencies, now.Sub(v.sent))
+					if v.seen++; v.seen == b.clients {
+						delete(b.pending, msg.Song.Name)
+					}
+				}
+			case "ack":
+				if msg.Error != "" {
+					b.rejected++
+				}
+			}
+			b.lock.Unlock()
+		}
+	}
+}
+
+func (b *bench) report(elapsed time.Duration, before, after *ServerStats) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for _, v := range b.pending {
+		b.lost += b.clients - v.seen
+	}
+
+	fmt.Printf("\n%d votes in %s, %.1f/s, %d rejected, %d errors\n",
+		b.votes, elapsed.Round(time.Millisecond), float64(b.votes)/elapsed.Seconds(), b.rejected, b.errors)
+	fmt.Printf("Broadcast latency, %d updates, %d lost:\n", len(b.latencies), b.lost)
+	printPercentiles(b.latencies)
+	fmt.Printf("Search latency, %d searches:\n", len(b.searches))
+	printPercentiles(b.searches)
+
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	fmt.Printf("Bench memory: %d MB heap, %d MB sys\n", m.HeapAlloc>>20, m.Sys>>20)
+	if before != nil && after != nil {
+		fmt.Printf("Server memory: %d MB heap before, %d MB after, %d MB sys, %d GCs\n",
+			before.HeapAlloc>>20, after.HeapAlloc>>20, after.Sys>>20, after.NumGC-before.NumGC)
+		fmt.Printf("Server load: %d goroutines before, %d after, %d clients\n",
+			before.Goroutines, after.Goroutines, after.Clients)
+	}
+}
+
+func printPercentiles(d []time.Duration) {
+	if len(d) == 0 {
+		fmt.Println("\tnone")
+		return
+	}
+	sort.Slice(d, func(i, j int) bool { return d[i] < d[j] })
+	at := func(p float64) time.Duration {
+		return d[int(p*float64(len(d)-1))].Round(10 * time.Microsecond)
+	}
+	fmt.Printf("\tp50 %s  p90 %s  p99 %s  max %s\n", at(0.5), at(0.9), at(0.99), d[len(d)-1].Round(10*time.Microsecond))
+}
+
+// Server stats as an admin, nil stats without a token
+func benchStats(addr, token string) (func() (*ServerStats, error), error) {
+	if token == "" {
+		return func() (*ServerStats, error) { return nil, nil }, nil
+	}
+	if !strings.Contains(addr, "://") {
+		addr = "http://" + addr
+	}
+	base := strings.TrimSuffix(addr, "/")
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		return nil, err
+	}
+	c := &http.Client{Jar: jar, Timeout: 10 * time.Second}
+	resp, err := c.Post(base+"/api/v1/login?token="+url.QueryEscape(token), "", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("bench: login: %s", resp.Status)
+	}
+	return func() (*ServerStats, error) {
+		resp, err := c.Get(base + "/api/v1/stats")
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("bench: stats: %s", resp.Status)
+		}
+		v := &ServerStats{}
+		return v, json.NewDecoder(resp.Body).Decode(v)
+	}, nil
+}
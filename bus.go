@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/emcfarlane/jukebox/core"
+	"github.com/redis/go-redis/v9" // Redis client
+)
+
+// Shares votes, plays and hints between instances behind a load balancer.
+// One instance is elected leader and picks the next song.
+type Bus interface {
+	Publish(msg *Message) error
+	Leader() bool
+	Close() error
+}
+
+// Bus message, tagged with the sending instance
+type envelope struct {
+	Origin string
+	Msg    *Message
+}
+
+const (
+	leaderTTL   = 10 * time.Second
+	leaderRenew = 3 * time.Second
+)
+
+// Renew the lease only if we still hold it
+var renewScript = redis.NewScript(`
+if redis.call("get", KEYS[1]) == ARGV[1] then
+	return redis.call("pexpire", KEYS[1], ARGV[2])
+end
+return 0`)
+
+type redisBus struct {
+	client  *redis.Client
+	pubsub  *redis.PubSub
+	id      string
+	channel string
+	leader  int32
+	cancel  context.CancelFunc
+}
+
+func newRedisBus(url, channel string, receive func(*Message)) (*redisBus, error) {
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, err
+	}
+	id, err := randomID()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	b := &redisBus{
+		client:  redis.NewClient(opts),
+		id:      id,
+		channel: channel,
+		cancel:  cancel,
+	}
+	if err := b.client.Ping(ctx).Err(); err != nil {
+		cancel()
+		return nil, err
+	}
+
+	b.pubsub = b.client.Subscribe(ctx, channel)
+	if _, err := b.pubsub.Receive(ctx); err != nil {
+		cancel()
+		return nil, err
+	}
+	go b.readLoop(b.pubsub.Channel(), receive)
+	go b.elect(ctx, receive)
+	return b, nil
+}
+
+func (b *redisBus) readLoop(ch <-chan *redis.Message, receive func(*Message)) {
+	for m := range ch {
+		var e envelope
+		if err := json.Unmarshal([]byte(m.Payload), &e); err != nil {
+			log.Println("bus: ", err)
+			continue
+		}
+		if e.Origin == b.id || e.Msg == nil {
+			continue
+		}
+		receive(e.Msg)
+	}
+}
+
+// Hold or take the leader lease, receiving a "leader" message when
+// it's won or lost
+func (b *redisBus) elect(ctx context.Context, receive func(*Message)) {
+	key := b.channel + ":leader"
+	ttl := int64(leaderTTL / time.Millisecond)
+	for {
+		var leader bool
+		if atomic.LoadInt32(&b.leader) == 1 {
+			n, err := renewScript.Run(ctx, b.client, []string{key}, b.id, ttl).Int()
+			leader = err == nil && n == 1
+		} else {
+			ok, err := b.client.SetNX(ctx, key, b.id, leaderTTL).Result()
+			leader = err == nil && ok
+		}
+
+		was := atomic.SwapInt32(&b.leader, boolInt(leader))
+		if was != boolInt(leader) {
+			log.Println("bus: Leader ", leader)
+			receive(&Message{Command: "leader"})
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(leaderRenew):
+		}
+	}
+}
+
+func boolInt(v bool) int32 {
+	if v {
+		return 1
+	}
+	return 0
+}
+
+func (b *redisBus) Publish(msg *Message) error {
+	data, err := json.Marshal(&envelope{Origin: b.id, Msg: msg})
+	if err != nil {
+		return err
+	}
+	return b.client.Publish(context.Background(), b.channel, data).Err()
+}
+
+func (b *redisBus) Leader() bool {
+	return atomic.LoadInt32(&b.leader) == 1
+}
+
+func (b *redisBus) Close() error {
+	b.cancel()
+	if atomic.LoadInt32(&b.leader) == 1 {
+		b.client.Del(context.Background(), b.channel+":leader")
+	}
+	b.pubsub.Close()
+	return b.client.Close()
+}
+
+// Tell other instances about a change
+func (s *Server) publish(msg *Message) {
+	if s.bus == nil {
+		return
+	}
+	if err := s.bus.Publish(msg); err != nil {
+		log.Println("publish: ", err)
+	}
+}
+
+// Whether this instance picks the next song
+func (s *Server) leader() bool {
+	return s.bus == nil || s.bus.Leader()
+}
+
+// Apply a change from another instance
+func (s *Server) receive(msg *Message) {
+	switch msg.Command {
+	case "plus":
+		s.songUpdate(msg.Song, msg.Weight, false)
+	case "minus":
+		s.songUpdate(msg.Song, -msg.Weight, false)
+	case "next":
+		if s.leader() {
+			s.next(msg.Song, msg.Epoch)
+		}
+	case "play":
+		s.songLock.Lock()
+		if msg.Announce == nil {
+			s.pool.Play(msg.Song.Name, msg.Time)
+			s.libraryChanged()
+		} else {
+			s.announceReceive(msg)
+		}
+		s.songPlaying = msg
+		s.sockWriteLoop(msg)
+		s.songLock.Unlock()
+		go s.nowPlayingWrite(msg)
+	case "hints":
+		s.hintsSet(msg.Song)
+	case "family":
+		if msg.Family != nil {
+			s.songLock.Lock()
+			s.family = *msg.Family
+			s.libraryChanged()
+			s.sockWriteLoop(msg)
+			s.songLock.Unlock()
+		}
+	case "sleep":
+		if msg.Sleep != nil {
+			s.songLock.Lock()
+			s.sleepSet(*msg.Sleep)
+			s.songLock.Unlock()
+		}
+	case "weights":
+		if err := s.weightsLoad(); err != nil {
+			log.Println("receive: ", err)
+		}
+	case "leader":
+		// Only the leader moves on when a song ends, the new one
+		// takes over the playing song's timer
+		s.songLock.Lock()
+		if s.leader() {
+			s.schedule()
+		} else if s.advance != nil {
+			s.advance.Stop()
+			s.advance = nil
+		}
+		s.songLock.Unlock()
+	case "karaoke":
+		s.karaokeReceive(msg.Data)
+	case "applied":
+		s.commands.first(msg.ID, time.Now())
+	case "bans":
+		if err := s.bansLoad(); err != nil {
+			log.Println("receive: ", err)
+		}
+	case "sync":
+		if s.leader() {
+			s.publish(s.state())
+		}
+	case "state":
+		s.songLock.Lock()
+		for _, song := range msg.Songs {
+			s.pool.SetScore(song.Name, song.Score)
+			s.pool.SetTally(song.Name, core.Tally{Up: song.Up, Down: song.Down})
+		}
+		s.libraryChanged()
+		if msg.Song.Name != "" {
+			s.songPlaying = &Message{Command: "play", Song: msg.Song, Time: msg.Time, Epoch: msg.Epoch, Duration: msg.Duration}
+		}
+		s.songLock.Unlock()
+	default:
+		log.Println("receive: Command unknown, ", msg.Command)
+	}
+}
+
+// Scores and the playing song, for instances joining the bus
+func (s *Server) state() *Message {
+	s.songLock.Lock()
+	defer s.songLock.Unlock()
+	msg := &Message{
+		Command: "state",
+		Song:    s.songPlaying.Song,
+		Time:    s.songPlaying.Time,
+		Epoch:   s.songPlaying.Epoch,
+		Version: s.libraryVersion(),
+
+		Duration: s.songPlaying.Duration, // So a new leader can time it
+	}
+	p := s.presence()
+	msg.Presence = &p
+	for _, song := range s.pool.All() {
+		msg.Songs = append(msg.Songs, Song{Name: song.Name, Score: song.Score, Up: song.Up, Down: song.Down})
+	}
+	return msg
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// On disk cache of generated files, keyed by content hash and parameters.
+// Least recently used files are removed once over the size limit.
+type Cache struct {
+	dir string
+	max int64
+
+	lock    *sync.Mutex
+	lru     *list.List // Of *cacheEntry, most recent first
+	entries map[string]*list.Element
+	hashes  map[string]fileHash
+	calls   map[string]*cacheCall // Fills in progress, by key
+	size    int64
+
+	hits, misses, evictions int64
+}
+
+type cacheEntry struct {
+	key  string
+	size int64
+}
+
+// A fill others missing the same key wait on
+type cacheCall struct {
+	done      chan struct{}
+	err       error
+	abandoned bool // The filler went away, so a waiter fills instead
+}
+
+type fileHash struct {
+	size    int64
+	modTime time.Time
+	hash    string
+}
+
+// Cache stats
+type CacheStats struct {
+	Entries   int
+	Size      int64
+	MaxSize   int64
+	Hits      int64
+	Misses    int64
+	Evictions int64
+}
+
+func newCache(dir string, max int64) (*Cache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	c := &Cache{
+		dir:     dir,
+		max:     max,
+		lock:    &sync.Mutex{},
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+		hashes:  make(map[string]fileHash),
+		calls:   make(map[string]*cacheCall),
+	}
+
+	// Pick up files from a previous run, most recent first
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].ModTime().Before(files[j].ModTime())
+	})
+	for _, f := range files {
+		if f.IsDir() || strings.HasPrefix(f.Name(), ".") {
+			continue
+		}
+		c.add(f.Name(), f.Size())
+	}
+	c.evict()
+	return c, nil
+}
+
+// Cache key for a file's content and the parameters used to generate from it
+func (c *Cache) Key(path string, params ...string) (string, error) {
+	hash, err := c.hash(path)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	io.WriteString(h, hash)
+	for _, p := range params {
+		io.WriteString(h, "\x00"+p)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Content hash of a file, remembered until it changes
+func (c *Cache) hash(path string) (string, error) {
+	fh, err := c.stamp(path)
+	return fh.hash, err
+}
+
+// Content hash of a file, with the size and time it was hashed at
+func (c *Cache) stamp(path string) (fileHash, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fileHash{}, err
+	}
+	c.lock.Lock()
+	fh, ok := c.hashes[path]
+	c.lock.Unlock()
+	if ok && fh.size == info.Size() && fh.modTime.Equal(info.ModTime()) {
+		return fh, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return fileHash{}, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return fileHash{}, err
+	}
+	fh = fileHash{size: info.Size(), modTime: info.ModTime(), hash: hex.EncodeToString(h.Sum(nil))}
+
+	c.lock.Lock()
+	c.hashes[path] = fh
+	c.lock.Unlock()
+	return fh, nil
+}
+
+// Remember a hash from the index, so a file unchanged since the last
+// run isn't read again
+func (c *Cache) remember(path string, st Stamp) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if _, ok := c.hashes[path]; !ok {
+		c.hashes[path] = fileHash{size: st.Size, modTime: time.Unix(0, st.ModTime), hash: st.Track}
+	}
+}
+
+// Open a cached file, generating it with fill on a miss. Misses for a
+// key being filled wait for that fill rather than start their own. Files
+// are opened under the lock, so an eviction can't remove them first.
+func (c *Cache) Open(ctx context.Context, key string, fill func(w io.Writer) error) (*os.File, error) {
+	for {
+		c.lock.Lock()
+		if e, ok := c.entries[key]; ok {
+			c.hits++
+			c.lru.MoveToFront(e)
+			f, err := c.open(key)
+			c.lock.Unlock()
+			return f, err
+		}
+		call, ok := c.calls[key]
+		if !ok {
+			break // Still locked, fill it
+		}
+		c.lock.Unlock()
+
+		select {
+		case <-call.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if call.err != nil && !call.abandoned {
+			return nil, call.err
+		}
+	}
+
+	call := &cacheCall{done: make(chan struct{})}
+	c.calls[key] = call
+	c.misses++
+	c.lock.Unlock()
+
+	f, err := c.put(key, fill)
+	call.err, call.abandoned = err, ctx.Err() != nil
+	c.lock.Lock()
+	delete(c.calls, key)
+	c.lock.Unlock()
+	close(call.done)
+	return f, err
+}
+
+// Open a cached file, marking it used. Lock must be held.
+func (c *Cache) open(key string) (*os.File, error) {
+	path := filepath.Join(c.dir, key)
+	now := time.Now()
+	os.Chtimes(path, now, now)
+	return os.Open(path)
+}
+
+// Generate a file into the cache and open it
+func (c *Cache) put(key string, fill func(w io.Writer) error) (*os.File, error) {
+	f, err := ioutil.TempFile(c.dir, ".tmp")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f.Name())
+
+	if err := fill(f); err != nil {
+		f.Close()
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+
+	if err := os.Rename(f.Name(), filepath.Join(c.dir, key)); err != nil {
+		return nil, err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.add(key, info.Size())
+	out, err := c.open(key)
+	c.evict()
+	return out, err
+}
+
+func (c *Cache) add(key string, size int64) {
+	if e, ok := c.entries[key]; ok {
+		c.size -= e.Value.(*cacheEntry).size
+		c.lru.Remove(e)
+	}
+	c.entries[key] = c.lru.PushFront(&cacheEntry{key: key, size: size})
+	c.size += size
+}
+
+// Remove least recently used files until under the size limit
+func (c *Cache) evict() {
+	for c.size > c.max && c.lru.Len() > 1 {
+		e := c.lru.Back()
+		entry := e.Value.(*cacheEntry)
+		if err := os.Remove(filepath.Join(c.dir, entry.key)); err != nil && !os.IsNotExist(err) {
+			log.Println("cache: ", err)
+		}
+		c.lru.Remove(e)
+		delete(c.entries, entry.key)
+		c.size -= entry.size
+		c.evictions++
+	}
+}
+
+func (c *Cache) Stats() CacheStats {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return CacheStats{
+		Entries:   c.lru.Len(),
+		Size:      c.size,
+		MaxSize:   c.max,
+		Hits:      c.hits,
+		Misses:    c.misses,
+		Evictions: c.evictions,
+	}
+}
+
+// Cache stats handle
+func (s *Server) cacheAPI(w http.ResponseWriter, r *http.Request) error {
+	stats := s.cache.Stats()
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(&stats)
+}
@@ -0,0 +1,405 @@
+// Package client is a Go client for the jukebox websocket and REST API.
+//
+// The client keeps its session cookie, reconnects with backoff when the
+// connection drops, queues votes while disconnected and merges them on
+// reconnect, then resumes by asking the server for its current state.
+package client
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+var ErrClosed = errors.New("client: closed")
+
+var errNotModified = errors.New("client: not modified")
+
+type Hints struct {
+	Gain  float64
+	Start float64
+	Fade  float64
+}
+
+type Song struct {
+	Name  string
+	Score float64
+	Hints *Hints `json:",omitempty"`
+
+	// Weight of up and down votes since it last played
+	Up   float64 `json:",omitempty"`
+	Down float64 `json:",omitempty"`
+}
+
+type Rejection struct {
+	Vote   Message
+	Reason string
+}
+
+// Connected clients and those playing audio
+type Presence struct {
+	Connected int
+	Listening int
+}
+
+// Skip votes for the playing song
+type Skips struct {
+	Votes  int
+	Needed int
+}
+
+// Message sent over the websocket
+type Message struct {
+	Command string
+	Song    Song
+	Time    int
+	Epoch   int `json:",omitempty"` // Of the playing song
+	Version int `json:",omitempty"` // Library version, on state and version
+
+	Duration int `json:",omitempty"` // Of the playing song, ms
+
+	ID    string `json:",omitempty"` // Command ID, echoed in the server's ack
+	Error string `json:",omitempty"`
+
+	Votes    []Message   `json:",omitempty"`
+	Rejected []Rejection `json:",omitempty"`
+	Name     string      `json:",omitempty"`
+	Songs    []Song      `json:",omitempty"`
+	Presence *Presence   `json:",omitempty"`
+	Skips    *Skips      `json:",omitempty"`
+}
+
+const (
+	minBackoff = time.Second
+	maxBackoff = 30 * time.Second
+)
+
+type Client struct {
+	base   *url.URL
+	http   *http.Client
+	dialer *websocket.Dialer
+	header http.Header // Sent with every request
+
+	lock    sync.Mutex
+	conn    *websocket.Conn
+	playing Message
+	pending []Message // Votes cast while disconnected
+	unacked map[string]Message
+	subs    map[chan Message]bool
+	closed  bool
+	done    chan struct{}
+
+	// Last listing, revalidated by its ETag
+	songs    []Song
+	songsTag string
+}
+
+// New client for a server address such as "http://10.0.0.2:8000"
+func New(addr string) (*Client, error) {
+	if !strings.Contains(addr, "://") {
+		addr = "http://" + addr
+	}
+	base, err := url.Parse(addr)
+	if err != nil {
+		return nil, err
+	}
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{
+		base:    base,
+		http:    &http.Client{Jar: jar, Timeout: 30 * time.Second},
+		dialer:  &websocket.Dialer{Jar: jar, HandshakeTimeout: 10 * time.Second},
+		header:  http.Header{},
+		subs:    make(map[chan Message]bool),
+		unacked: make(map[string]Message),
+		done:    make(chan struct{}),
+	}, nil
+}
+
+func (c *Client) sockURL() string {
+	u := *c.base
+	u.Scheme = "ws"
+	if c.base.Scheme == "https" {
+		u.Scheme = "wss"
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/sock"
+	return u.String()
+}
+
+// Act as an admin with the server's admin token, which also exempts
+// the client from limits on how fast one address can connect. Call
+// before Connect.
+func (c *Client) SetToken(token string) {
+	c.header.Set("Authorization", "Bearer "+token)
+}
+
+// Connect to the server, the connection is kept open until Close
+func (c *Client) Connect(ctx context.Context) error {
+	conn, _, err := c.dialer.DialContext(ctx, c.sockURL(), c.header)
+	if err != nil {
+		return err
+	}
+	if err := c.resume(conn); err != nil {
+		conn.Close()
+		return err
+	}
+	go c.readLoop(conn)
+	return nil
+}
+
+// Merge queued and unacked votes and ask for the current state. The
+// server drops any it already applied by their IDs.
+func (c *Client) resume(conn *websocket.Conn) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.closed {
+		return ErrClosed
+	}
+	votes := c.pending
+	for _, msg := range c.unacked {
+		votes = append(votes, msg)
+	}
+	if len(votes) > 0 {
+		if err := conn.WriteJSON(&Message{Command: "merge", Votes: votes}); err != nil {
+			return err
+		}
+		c.pending = nil
+		c.unacked = make(map[string]Message)
+	}
+	if err := conn.WriteJSON(&Message{Command: "state"}); err != nil {
+		return err
+	}
+	c.conn = conn
+	return nil
+}
+
+func (c *Client) readLoop(conn *websocket.Conn) {
+	for {
+		var msg Message
+		if err := conn.ReadJSON(&msg); err != nil {
+			conn.Close()
+			c.lock.Lock()
+			c.conn = nil
+			c.lock.Unlock()
+			c.reconnect()
+			return
+		}
+
+		c.lock.Lock()
+		switch msg.Command {
+		case "ack":
+			delete(c.unacked, msg.ID)
+		case "play":
+			c.playing = msg
+		case "state":
+			if msg.Song.Name != "" {
+				c.playing = Message{Command: "play", Song: msg.Song, Time: msg.Time, Epoch: msg.Epoch, Duration: msg.Duration}
+			}
+		}
+		for ch := range c.subs {
+			select {
+			case ch <- msg:
+			default: // Slow subscriber, drop
+			}
+		}
+		c.lock.Unlock()
+	}
+}
+
+// Redial with backoff until connected or closed
+func (c *Client) reconnect() {
+	backoff := minBackoff
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-time.After(backoff):
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		err := c.Connect(ctx)
+		cancel()
+		if err == nil || err == ErrClosed {
+			return
+		}
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// Subscribe to messages from the server, call cancel when done
+func (c *Client) Subscribe() (msgs <-chan Message, cancel func()) {
+	ch := make(chan Message, 64)
+	c.lock.Lock()
+	c.subs[ch] = true
+	c.lock.Unlock()
+	return ch, func() {
+		c.lock.Lock()
+		if c.subs[ch] {
+			delete(c.subs, ch)
+			close(ch)
+		}
+		c.lock.Unlock()
+	}
+}
+
+func (c *Client) send(msg *Message) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.closed {
+		return ErrClosed
+	}
+	if c.conn == nil {
+		return errors.New("client: not connected")
+	}
+	return c.conn.WriteJSON(msg)
+}
+
+func commandID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Vote a song up or down, queued until reconnected if offline. Votes
+// are resent on reconnect until the server acks them.
+func (c *Client) Vote(song string, up bool) error {
+	msg := Message{
+		Command: "minus",
+		ID:      commandID(),
+		Song:    Song{Name: song},
+		Time:    int(time.Now().UnixNano() / int64(time.Millisecond)),
+	}
+	if up {
+		msg.Command = "plus"
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.closed {
+		return ErrClosed
+	}
+	if c.conn == nil {
+		c.pending = append(c.pending, msg)
+		return nil
+	}
+	c.unacked[msg.ID] = msg
+	return c.conn.WriteJSON(&msg)
+}
+
+// Vote to skip the playing song, it changes once enough listeners agree
+func (c *Client) Skip() error {
+	c.lock.Lock()
+	name := c.playing.Song.Name
+	c.lock.Unlock()
+	if name == "" {
+		return errors.New("client: nothing playing")
+	}
+	return c.send(&Message{Command: "skip", ID: commandID(), Song: Song{Name: name}})
+}
+
+// Tell the server the client is playing a song, repeat every 15s while
+// it plays. An empty name means playback stopped.
+func (c *Client) Listening(song string) error {
+	return c.send(&Message{Command: "listening", Song: Song{Name: song}})
+}
+
+// Last play message seen
+func (c *Client) Playing() Message {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.playing
+}
+
+func (c *Client) get(ctx context.Context, path string, query url.Values, v interface{}) error {
+	_, err := c.getTagged(ctx, path, query, "", v)
+	return err
+}
+
+// Get with If-None-Match, returns the response's ETag or errNotModified
+// if etag still matches
+func (c *Client) getTagged(ctx context.Context, path string, query url.Values, etag string, v interface{}) (string, error) {
+	u := *c.base
+	u.Path = strings.TrimSuffix(u.Path, "/") + path
+	u.RawQuery = query.Encode()
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	for k, v := range c.header {
+		req.Header[k] = v
+	}
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	resp, err := c.http.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified {
+		return etag, errNotModified
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("client: %s: %s", path, resp.Status)
+	}
+	return resp.Header.Get("ETag"), json.NewDecoder(resp.Body).Decode(v)
+}
+
+// Search the library
+func (c *Client) Search(ctx context.Context, q string, limit int) ([]Song, error) {
+	var songs []Song
+	query := url.Values{"q": {q}, "limit": {fmt.Sprint(limit)}}
+	err := c.get(ctx, "/api/v1/search", query, &songs)
+	return songs, err
+}
+
+// All songs with their scores, an unchanged listing isn't sent again
+func (c *Client) Songs(ctx context.Context) ([]Song, error) {
+	c.lock.Lock()
+	etag, cached := c.songsTag, c.songs
+	c.lock.Unlock()
+
+	var songs []Song
+	etag, err := c.getTagged(ctx, "/api/v1/songs", nil, etag, &songs)
+	if err == errNotModified {
+		return append([]Song{}, cached...), nil
+	} else if err != nil {
+		return nil, err
+	}
+	c.lock.Lock()
+	c.songs, c.songsTag = songs, etag
+	c.lock.Unlock()
+	return append([]Song{}, songs...), nil
+}
+
+func (c *Client) Close() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	close(c.done)
+	for ch := range c.subs {
+		delete(c.subs, ch)
+		close(ch)
+	}
+	if c.conn != nil {
+		return c.conn.Close()
+	}
+	return nil
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"time"
+
+	"github.com/emcfarlane/jukebox/core"
+)
+
+// Features that can be switched off at runtime, all on by default
+var features = map[string]bool{"skip": true, "live": true, "karaoke": true, "push": true}
+
+var themeColor = regexp.MustCompile(`^#[0-9a-fA-F]{3}([0-9a-fA-F]{3})?$`)
+
+// Settings that can change without a restart. Read from -config, a
+// JSON file, over the flags at start up and again on SIGHUP or a POST
+// to /api/v1/config.
+type Config struct {
+	Scoring   string          `json:",omitempty"` // net, wilson or veto
+	Veto      float64         `json:",omitempty"`
+	VoteRate  int             `json:",omitempty"` // Votes per user per minute, 0 for no limit
+	RateConn  int             `json:",omitempty"` // Audio KB/s, 0 for no cap
+	RateTotal int             `json:",omitempty"`
+	Quiet     *Quiet          `json:",omitempty"`
+	Theme     *Theme          `json:",omitempty"`
+	Features  map[string]bool `json:",omitempty"` // Switched off with false
+}
+
+// Quiet hours, local times like "22:00". Playback is capped at Volume,
+// 0 to 1, from Start until End. The server sets Active for clients.
+type Quiet struct {
+	Start  string
+	End    string
+	Volume float64
+	Active bool `json:",omitempty"`
+}
+
+// Colors for the player, as #rgb or #rrggbb
+type Theme struct {
+	Accent     string `json:",omitempty"`
+	Background string `json:",omitempty"`
+	Text       string `json:",omitempty"`
+}
+
+// Minutes since midnight of a "15:04" time
+func quietMinutes(v string) (int, error) {
+	t, err := time.Parse("15:04", v)
+	if err != nil {
+		return 0, fmt.Errorf("quiet: %q is not a time like 22:00", v)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// Whether quiet hours are on at t, and when that next changes
+func (q *Quiet) at(t time.Time) (bool, time.Time) {
+	start, _ := quietMinutes(q.Start)
+	end, _ := quietMinutes(q.End)
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	now := t.Hour()*60 + t.Minute()
+
+	var on bool
+	if start <= end {
+		on = now >= start && now < end
+	} else {
+		on = now >= start || now < end // Over midnight
+	}
+	next := end
+	if !on {
+		next = start
+	}
+	change := midnight.Add(time.Duration(next) * time.Minute)
+	if !change.After(t) {
+		change = change.AddDate(0, 0, 1)
+	}
+	return on, change
+}
+
+// The flags, with -config read over them
+func configLoad() (Config, error) {
+	c := Config{
+		Scoring:   *scoreMode,
+		Veto:      *vetoDown,
+		VoteRate:  *voteRate,
+		RateConn:  *rateConn,
+		RateTotal: *rateTotal,
+	}
+	if *configPath != "" {
+		b, err := os.ReadFile(*configPath)
+		if err != nil {
+			return c, err
+		}
+		if err := json.Unmarshal(b, &c); err != nil {
+			return c, fmt.Errorf("%s: %v", *configPath, err)
+		}
+	}
+	return c, c.check()
+}
+
+func (c *Config) check() error {
+	if _, err := core.ParseScoring(c.Scoring, c.Veto); err != nil {
+		return err
+	}
+	if c.VoteRate < 0 || c.RateConn < 0 || c.RateTotal < 0 {
+		return fmt.Errorf("config: rates can't be negative")
+	}
+	if q := c.Quiet; q != nil {
+		if _, err := quietMinutes(q.Start); err != nil {
+			return err
+		}
+		if _, err := quietMinutes(q.End); err != nil {
+			return err
+		}
+		if q.Volume < 0 || q.Volume > 1 {
+			return fmt.Errorf("quiet: volume %g is not from 0 to 1", q.Volume)
+		}
+	}
+	if t := c.Theme; t != nil {
+		for _, color := range []string{t.Accent, t.Background, t.Text} {
+			if color != "" && !themeColor.MatchString(color) {
+				return fmt.Errorf("theme: %q is not a color like #34A9da", color)
+			}
+		}
+	}
+	for name := range c.Features {
+		if !features[name] {
+			return fmt.Errorf("config: unknown feature %q", name)
+		}
+	}
+	return nil
+}
+
+// Use a config, sockets and playback carry on as they are
+func (s *Server) configApply(c Config) {
+	scoring, _ := core.ParseScoring(c.Scoring, c.Veto)
+
+	s.configLock.Lock()
+	s.config = c
+	s.quietSchedule()
+	s.configLock.Unlock()
+	s.bandwidth.set(c.RateTotal)
+
+	s.songLock.Lock()
+	if s.pool.Scoring != scoring {
+		s.pool.Scoring = scoring
+		s.libraryChanged() // Reranked
+	}
+	s.songLock.Unlock()
+}
+
+// The config in use
+func (s *Server) settings() Config {
+	s.configLock.Lock()
+	defer s.configLock.Unlock()
+	return s.config
+}
+
+// Whether a feature is on
+func (s *Server) enabled(feature string) bool {
+	on, ok := s.settings().Features[feature]
+	return on || !ok
+}
+
+// What clients need of the config, nil if it's all defaults
+func (s *Server) clientConfig() *Config {
+	c := s.settings()
+	if c.Quiet == nil && c.Theme == nil && len(c.Features) == 0 {
+		return nil
+	}
+	v := &Config{Theme: c.Theme, Features: c.Features}
+	if c.Quiet != nil {
+		q := *c.Quiet
+		q.Active, _ = q.at(time.Now())
+		v.Quiet = &q
+	}
+	return v
+}
+
+// Wake when quiet hours next start or end, configLock must be held
+func (s *Server) quietSchedule() {
+	if s.quietTimer != nil {
+		s.quietTimer.Stop()
+		s.quietTimer = nil
+	}
+	if q := s.config.Quiet; q != nil {
+		_, change := q.at(time.Now())
+		s.quietTimer = time.AfterFunc(time.Until(change), s.quietChange)
+	}
+}
+
+func (s *Server) quietChange() {
+	s.configLock.Lock()
+	s.quietSchedule()
+	s.configLock.Unlock()
+	s.configSend()
+}
+
+// Tell clients the config changed, or quiet hours started or ended
+func (s *Server) configSend() {
+	c := s.clientConfig()
+	if c == nil {
+		c = &Config{} // Back to defaults
+	}
+	s.sockWriteLoop(&Message{Command: "config", Config: c})
+}
+
+// Read -config again, a bad one is logged and the old one kept
+func (s *Server) reload() (Config, error) {
+	c, err := configLoad()
+	if err != nil {
+		log.Println("Config: Not reloaded, ", err)
+		return s.settings(), err
+	}
+	s.configApply(c)
+	s.configSend()
+	log.Println("Config: Reloaded ", *configPath)
+	return c, nil
+}
+
+// Config handle, admins GET the config in use and POST to reload it
+func (s *Server) configAPI(w http.ResponseWriter, r *http.Request) error {
+	if !s.isAdmin(r) {
+		http.Error(w, "admin only", http.StatusForbidden)
+		return nil
+	}
+	c := s.settings()
+	switch r.Method {
+	case "GET":
+	case "POST":
+		var err error
+		if c, err = s.reload(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return nil
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return nil
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(&c)
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// How often sockets are pinged to time their round trip
+const pingPeriod = 30 * time.Second
+
+// A websocket connection, for admins. Times in ms.
+type Connection struct {
+	ID        int
+	Session   string
+	Name      string `json:",omitempty"`
+	Addr      string // Remote address
+	IP        string `json:",omitempty"` // Forwarded one behind a tunnel
+	Room      string
+	Connected int
+	Active    int     // Last message or pong
+	RTT       float64 // Last ping's round trip, 0 until there is one
+	Sent      int64   // Messages
+	Received  int64
+	Listening bool
+	Live      bool
+}
+
+// Write a message to a user, sockLock must be held
+func (u *User) writeJSON(v interface{}) error {
+	u.sent.Add(1)
+	return websocket.WriteJSON(u.conn, v)
+}
+
+// Note a message or pong from a user
+func (u *User) touch() {
+	u.active.Store(makeTimestamp())
+}
+
+// Ping a user until its socket closes, pongs time the round trip
+func (s *Server) sockPing(u *User) {
+	u.conn.SetPongHandler(func(data string) error {
+		if sent, err := strconv.ParseInt(data, 10, 64); err == nil {
+			u.rtt.Store(time.Now().UnixNano() - sent)
+		}
+		u.touch()
+		return nil
+	})
+	t := time.NewTicker(pingPeriod)
+	defer t.Stop()
+	for {
+		now := time.Now()
+		if err := u.conn.WriteControl(websocket.PingMessage, []byte(strconv.FormatInt(now.UnixNano(), 10)), now.Add(10*time.Second)); err != nil {
+			return // Closed
+		}
+		select {
+		case <-t.C:
+		case <-s.ctx.Done():
+			return
+		}
+	}
+}
+
+func (s *Server) connections() []Connection {
+	s.sockLock.Lock()
+	defer s.sockLock.Unlock()
+	now := time.Now()
+	conns := []Connection{}
+	for _, u := range s.sockUsers {
+		c := Connection{
+			ID:        u.id,
+			Addr:      u.addr,
+			IP:        u.ip,
+			Room:      *roomName,
+			Connected: int(u.connected.UnixMilli()),
+			Active:    int(u.active.Load()),
+			RTT:       float64(u.rtt.Load()) / float64(time.Millisecond),
+			Sent:      u.sent.Load(),
+			Received:  u.received.Load(),
+			Listening: now.Sub(u.heard) < listenTimeout,
+			Live:      u == s.liveHost,
+		}
+		if u.session != nil {
+			c.Session, c.Name = u.session.ID, u.session.Name
+		}
+		conns = append(conns, c)
+	}
+	return conns
+}
+
+// Connections handle, admins GET every websocket and DELETE
+// /api/v1/connections/{id} to disconnect one
+func (s *Server) connectionsAPI(w http.ResponseWriter, r *http.Request) error {
+	if !s.isAdmin(r) {
+		http.Error(w, "admin only", http.StatusForbidden)
+		return nil
+	}
+	switch r.Method {
+	case "GET":
+		w.Header().Set("Content-Type", "application/json")
+		return json.NewEncoder(w).Encode(s.connections())
+	case "DELETE":
+		id, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/api/v1/connections/"))
+		if err != nil {
+			http.NotFound(w, r)
+			return nil
+		}
+		s.sockLock.Lock()
+		defer s.sockLock.Unlock()
+		for _, u := range s.sockUsers {
+			if u.id != id {
+				continue
+			}
+			log.Println("Connections: Disconnecting ", id)
+			u.conn.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "disconnected by an admin"), time.Now().Add(time.Second))
+			u.conn.Close() // The read loop cleans up
+			return nil
+		}
+		http.NotFound(w, r)
+		return nil
+	}
+	http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	return nil
+}
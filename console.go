@@ -0,0 +1,117 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"time"
+)
+
+// Connected client, for the admin console
+type AdminClient struct {
+	ID        int
+	Name      string
+	Scope     string
+	Listening bool
+	Live      bool
+}
+
+// Admin console page
+type AdminPage struct {
+	LoggedIn    bool
+	Playing     string
+	Public      string
+	Scan        ScanStatus
+	Cache       CacheStats
+	Family      bool
+	Sleep       Sleep
+	Weights     Weights
+	Presence    Presence
+	Clients     []AdminClient
+	Quarantined []Quarantined
+	Bans        []Ban
+	Songs       []Song
+	Logs        []string
+}
+
+func (s *Server) clients() []AdminClient {
+	s.sockLock.Lock()
+	defer s.sockLock.Unlock()
+	now := time.Now()
+	clients := []AdminClient{}
+	for _, u := range s.sockUsers {
+		c := AdminClient{
+			ID:        u.id,
+			Listening: now.Sub(u.heard) < listenTimeout,
+			Live:      u == s.liveHost,
+		}
+		if u.session != nil {
+			c.Name, c.Scope = u.session.Name, u.session.Scope
+			if u.session.Admin {
+				c.Scope = "admin"
+			}
+		}
+		clients = append(clients, c)
+	}
+	return clients
+}
+
+// Admin console, a login form until the session is an admin
+func (s *Server) console(w http.ResponseWriter, r *http.Request) error {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	if !s.isAdmin(r) {
+		return s.tmpl.ExecuteTemplate(w, "admin.html", &AdminPage{})
+	}
+
+	page := &AdminPage{
+		LoggedIn: true,
+		Public:   s.public,
+		Scan:     s.scanStatus(),
+		Cache:    s.cache.Stats(),
+		Presence: s.presence(),
+		Clients:  s.clients(),
+		Logs:     recentLogs.Tail(200),
+	}
+	s.weightLock.Lock()
+	page.Weights = s.weights
+	s.weightLock.Unlock()
+
+	s.songLock.Lock()
+	if s.songPlaying != nil {
+		page.Playing = s.songPlaying.Song.Name
+	}
+	page.Family = s.family
+	page.Sleep = s.sleep
+	for _, song := range s.pool.All() {
+		page.Songs = append(page.Songs, Song{Name: song.Name, Score: song.Score, Track: s.songTrack[song.Name]})
+	}
+	s.songLock.Unlock()
+	sort.Slice(page.Songs, func(i, j int) bool { return s.collate.Compare(page.Songs[i].Name, page.Songs[j].Name) < 0 })
+
+	var err error
+	if page.Quarantined, err = s.store.Quarantined(); err != nil {
+		return err
+	}
+	if page.Bans, err = s.store.Bans(int(makeTimestamp() - int64(abuseStrikes/time.Millisecond))); err != nil {
+		return err
+	}
+	return s.tmpl.ExecuteTemplate(w, "admin.html", page)
+}
+
+// Rescan handle, looks for new and removed files
+func (s *Server) scanStartAPI(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return nil
+	}
+	if !s.isAdmin(r) {
+		http.Error(w, "admin only", http.StatusForbidden)
+		return nil
+	}
+	if !s.rescan() {
+		http.Error(w, "already scanning", http.StatusConflict)
+		return nil
+	}
+	w.WriteHeader(http.StatusAccepted)
+	return nil
+}
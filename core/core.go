@@ -0,0 +1,247 @@
+// Package core is the jukebox's voting, queue and selection logic. It
+// has no I/O so it can be compiled to WASM for an offline simulator and
+// fuzzed on its own.
+package core
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+// How far ahead of the server a client's clock may run, ms
+const MaxClockSkew = 60 * 1000
+
+type Song struct {
+	Name  string
+	Score float64
+	Up    float64 `json:",omitempty"` // Weight of up votes since the last play
+	Down  float64 `json:",omitempty"`
+}
+
+// Up and down votes for a song since it last played, by weight
+type Tally struct {
+	Up   float64
+	Down float64
+}
+
+// How songs are ranked for playing next
+const (
+	ScoreNet    = "net"    // Up less down
+	ScoreWilson = "wilson" // Lower bound of the share of up votes, so a few votes count less than many
+	ScoreVeto   = "veto"   // Net, but songs with Veto down votes go last
+)
+
+// Ranking, the zero value is net
+type Scoring struct {
+	Mode string
+	Veto float64 // Down votes that veto a song
+}
+
+// Scoring from the -scoring and -veto flags
+func ParseScoring(mode string, veto float64) (Scoring, error) {
+	switch mode {
+	case "", ScoreNet, ScoreWilson:
+	case ScoreVeto:
+		if veto <= 0 {
+			return Scoring{}, fmt.Errorf("scoring: veto needs a threshold above 0")
+		}
+	default:
+		return Scoring{}, fmt.Errorf("scoring: unknown mode %q, want net, wilson or veto", mode)
+	}
+	return Scoring{Mode: mode, Veto: veto}, nil
+}
+
+// Pool of songs to vote on, with their scores. Not safe for concurrent
+// use.
+type Pool struct {
+	scores map[string]float64
+	tally  map[string]Tally
+	played map[string]int // Start time of each song's last play, ms
+
+	// Songs that can't be listed, voted for or played, may be nil
+	Hidden func(name string) bool
+
+	Scoring Scoring
+}
+
+func NewPool() *Pool {
+	return &Pool{
+		scores: make(map[string]float64),
+		tally:  make(map[string]Tally),
+		played: make(map[string]int),
+	}
+}
+
+// Add a song if it isn't in the pool
+func (p *Pool) Add(name string, score float64) bool {
+	if _, ok := p.scores[name]; ok {
+		return false
+	}
+	p.scores[name] = score
+	return true
+}
+
+func (p *Pool) Remove(name string) {
+	delete(p.scores, name)
+	delete(p.tally, name)
+}
+
+func (p *Pool) Has(name string) bool {
+	_, ok := p.scores[name]
+	return ok
+}
+
+func (p *Pool) Len() int {
+	return len(p.scores)
+}
+
+func (p *Pool) Score(name string) float64 {
+	return p.scores[name]
+}
+
+// Set a song's score, only if it's in the pool
+func (p *Pool) SetScore(name string, score float64) {
+	if _, ok := p.scores[name]; ok {
+		p.scores[name] = score
+	}
+}
+
+func (p *Pool) Tally(name string) Tally {
+	return p.tally[name]
+}
+
+// Set a song's tally, only if it's in the pool
+func (p *Pool) SetTally(name string, t Tally) {
+	if _, ok := p.scores[name]; ok {
+		p.tally[name] = t
+	}
+}
+
+// Whether a song is in the pool and not hidden
+func (p *Pool) Visible(name string) bool {
+	_, ok := p.scores[name]
+	return ok && (p.Hidden == nil || !p.Hidden(name))
+}
+
+// Add weight to a song's score, negative for down votes. Songs not in
+// the pool are added. Scores are rounded so weights don't build up
+// float error.
+func (p *Pool) Vote(name string, weight float64) float64 {
+	score := math.Round((p.scores[name]+weight)*100) / 100
+	p.scores[name] = score
+	t := p.tally[name]
+	if weight > 0 {
+		t.Up = math.Round((t.Up+weight)*100) / 100
+	} else {
+		t.Down = math.Round((t.Down-weight)*100) / 100
+	}
+	p.tally[name] = t
+	return score
+}
+
+// A song's rank under the pool's scoring, higher plays first
+func (p *Pool) Rank(name string) float64 {
+	t := p.tally[name]
+	switch p.Scoring.Mode {
+	case ScoreWilson:
+		return wilson(t.Up, t.Up+t.Down)
+	case ScoreVeto:
+		if p.Scoring.Veto > 0 && t.Down >= p.Scoring.Veto {
+			return math.Inf(-1)
+		}
+	}
+	return p.scores[name]
+}
+
+// Lower bound of the 95% Wilson score interval for up of n votes
+func wilson(up, n float64) float64 {
+	if n <= 0 {
+		return 0
+	}
+	const z = 1.96
+	phat := up / n
+	return (phat + z*z/(2*n) - z*math.Sqrt((phat*(1-phat)+z*z/(4*n))/n)) / (1 + z*z/n)
+}
+
+// Whether a ranks before b, ties go to the higher net score
+func (p *Pool) before(a, b string) bool {
+	ra, rb := p.Rank(a), p.Rank(b)
+	if ra != rb {
+		return ra > rb
+	}
+	return p.scores[a] > p.scores[b]
+}
+
+func (p *Pool) song(name string) Song {
+	t := p.tally[name]
+	return Song{Name: name, Score: p.scores[name], Up: t.Up, Down: t.Down}
+}
+
+// Visible songs, best first
+func (p *Pool) Songs() []Song {
+	songs := []Song{}
+	for name := range p.scores {
+		if p.Hidden == nil || !p.Hidden(name) {
+			songs = append(songs, p.song(name))
+		}
+	}
+	sort.SliceStable(songs, func(i, j int) bool { return p.before(songs[i].Name, songs[j].Name) })
+	return songs
+}
+
+// Every song, hidden or not, in no order
+func (p *Pool) All() []Song {
+	songs := make([]Song, 0, len(p.scores))
+	for name := range p.scores {
+		songs = append(songs, p.song(name))
+	}
+	return songs
+}
+
+// The song to play next, the top ranked visible one. Ties are broken
+// by map order, so at random.
+func (p *Pool) Next() (string, bool) {
+	var top string
+	found := false
+	for name := range p.scores {
+		if p.Hidden != nil && p.Hidden(name) {
+			continue
+		}
+		if !found || !p.before(top, name) {
+			top, found = name, true
+		}
+	}
+	return top, found
+}
+
+// Start playing a song at time t, its score and tally go back to zero
+func (p *Pool) Play(name string, t int) {
+	p.scores[name] = 0
+	delete(p.tally, name)
+	p.played[name] = t
+}
+
+// Start time of a song's last play, 0 if never played
+func (p *Pool) Played(name string) int {
+	return p.played[name]
+}
+
+// Check a vote cast at time cast is still valid at now, returns the
+// reason if not
+func (p *Pool) Check(name string, cast, now int) string {
+	if cast > now+MaxClockSkew {
+		return "timestamp in the future"
+	}
+	if !p.Has(name) {
+		return "unknown song"
+	}
+	if !p.Visible(name) {
+		return "explicit"
+	}
+	// Song has been played since the vote was cast
+	if cast < p.played[name] {
+		return "round ended"
+	}
+	return ""
+}
@@ -0,0 +1,144 @@
+package core
+
+import (
+	"math"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestRank(t *testing.T) {
+	// Up and down weights, so modes disagree
+	votes := map[string]Tally{
+		"a": {Up: 5},
+		"b": {Up: 10, Down: 4},
+		"c": {Up: 1},
+		"d": {Down: 2},
+	}
+	tests := []struct {
+		name    string
+		scoring Scoring
+		want    []string
+	}{
+		{"net", Scoring{}, []string{"b", "a", "c", "d"}},
+		{"wilson", Scoring{Mode: ScoreWilson}, []string{"a", "b", "c", "d"}},
+		{"veto", Scoring{Mode: ScoreVeto, Veto: 3}, []string{"a", "c", "d", "b"}},
+		{"vetoes by net", Scoring{Mode: ScoreVeto, Veto: 2}, []string{"a", "c", "b", "d"}},
+	}
+	for _, tt := range tests {
+		p := NewPool()
+		p.Scoring = tt.scoring
+		for name, v := range votes {
+			p.Add(name, 0)
+			if v.Up > 0 {
+				p.Vote(name, v.Up)
+			}
+			if v.Down > 0 {
+				p.Vote(name, -v.Down)
+			}
+		}
+		var got []string
+		for _, song := range p.Songs() {
+			got = append(got, song.Name)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got order %v, want %v", tt.name, got, tt.want)
+		}
+		if next, _ := p.Next(); next != tt.want[0] {
+			t.Errorf("%s: got next %q, want %q", tt.name, next, tt.want[0])
+		}
+	}
+}
+
+func TestWilson(t *testing.T) {
+	if got := wilson(0, 0); got != 0 {
+		t.Errorf("no votes: got %v, want 0", got)
+	}
+	// The same share of up votes counts for more the more votes there are
+	for _, n := range []float64{1, 2, 5, 10, 100} {
+		few, many := wilson(n, n), wilson(2*n, 2*n)
+		if few >= many || many > 1 {
+			t.Errorf("%v up: got %v, %v for twice as many", n, few, many)
+		}
+	}
+	if got := wilson(5, 10); math.Abs(got-0.2366) > 0.0001 {
+		t.Errorf("5 of 10: got %v, want 0.2366", got)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	p := NewPool()
+	p.Add("song", 0)
+	p.Add("hidden", 0)
+	p.Hidden = func(name string) bool { return name == "hidden" }
+	p.Play("song", 1000)
+
+	tests := []struct {
+		name string
+		song string
+		cast int
+		want string
+	}{
+		{"valid", "song", 2000, ""},
+		{"clock skew", "song", 2000 + MaxClockSkew, ""},
+		{"future", "song", 2001 + MaxClockSkew, "timestamp in the future"},
+		{"unknown", "other", 2000, "unknown song"},
+		{"hidden", "hidden", 2000, "explicit"},
+		{"before the play", "song", 999, "round ended"},
+	}
+	for _, tt := range tests {
+		if got := p.Check(tt.song, tt.cast, 2000); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestApply(t *testing.T) {
+	events := []Event{
+		{Type: EventAdd, Song: "a", Weight: 1},
+		{Type: EventAdd, Song: "b"},
+		{Type: EventAdd, Song: "c"},
+		{Type: EventVote, Song: "b", Weight: 2.5},
+		{Type: EventVote, Song: "a", Weight: -1},
+		{Type: EventVote, Song: "c", Weight: 0.1},
+		{Type: EventVote, Song: "c", Weight: 0.2},
+		{Type: EventSkip, Song: "b", Time: 5},
+		{Type: EventPlay, Song: "b", Time: 10},
+		{Type: EventBan, Time: 11, Note: "session:x"},
+		{Type: "newer", Song: "a", Weight: 100},
+		{Type: EventVote, Song: "b", Weight: 1},
+		{Type: EventAdd, Song: "a", Weight: 5}, // Already there
+		{Type: EventRemove, Song: "c"},
+	}
+
+	// What the server does as the changes happen
+	want := NewPool()
+	want.Add("a", 1)
+	want.Add("b", 0)
+	want.Add("c", 0)
+	want.Vote("b", 2.5)
+	want.Vote("a", -1)
+	want.Vote("c", 0.1)
+	want.Vote("c", 0.2)
+	want.Play("b", 10)
+	want.Vote("b", 1)
+	want.Remove("c")
+
+	got := NewPool()
+	for _, e := range events {
+		got.Apply(e)
+	}
+	byName := func(songs []Song) []Song {
+		sort.Slice(songs, func(i, j int) bool { return songs[i].Name < songs[j].Name })
+		return songs
+	}
+	if g, w := byName(got.All()), byName(want.All()); !reflect.DeepEqual(g, w) {
+		t.Errorf("replay: got %+v, want %+v", g, w)
+	}
+	if got.Played("b") != 10 || got.Played("a") != 0 {
+		t.Errorf("replay: got played %d and %d, want 10 and 0", got.Played("b"), got.Played("a"))
+	}
+	if got.Tally("b") != (Tally{Up: 1}) {
+		t.Errorf("replay: got tally %+v after a play, want only the later vote", got.Tally("b"))
+	}
+}
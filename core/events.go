@@ -0,0 +1,38 @@
+package core
+
+// Event types
+const (
+	EventAdd    = "add" // Weight is the song's starting score
+	EventRemove = "remove"
+	EventVote   = "vote" // Weight is added to the score
+	EventPlay   = "play"
+	EventSkip   = "skip" // Only recorded, the play that follows changes the pool
+	EventBan    = "ban"  // Only recorded, for the audit trail. Note is who and why.
+	EventLift   = "lift" // Only recorded, an admin lifted a ban. Note is who.
+)
+
+// A change to the pool. Applying a pool's events in order rebuilds it.
+// Seq is set by the log, times are in ms.
+type Event struct {
+	Seq    int64 `json:",omitempty"`
+	Type   string
+	Time   int
+	Song   string
+	Weight float64 `json:",omitempty"`
+	Note   string  `json:",omitempty"`
+}
+
+// Apply an event, unknown types are skipped so older builds can replay
+// newer logs
+func (p *Pool) Apply(e Event) {
+	switch e.Type {
+	case EventAdd:
+		p.Add(e.Song, e.Weight)
+	case EventRemove:
+		p.Remove(e.Song)
+	case EventVote:
+		p.Vote(e.Song, e.Weight)
+	case EventPlay:
+		p.Play(e.Song, e.Time)
+	}
+}
@@ -0,0 +1,248 @@
+package core
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// Base letters of U+00C0 to U+024F, '.' where there's none or it's in
+// foldLigatures
+const foldLatin = "" +
+	"aaaaaa.ceeeeiiiidnooooo.ouuuuy..aaaaaa.ceeeeiiiidnooooo.ouuuuy.y" +
+	"aaaaaaccccccccddddeeeeeeeeeegggggggghhhhiiiiiiiiii..jjkk.lllllll" +
+	"lllnnnnnnnnnoooooo..rrrrrrssssssssttttttuuuuuuuuuuuuwwyyyzzzzzzs" +
+	"bb.....ccdd......ffg...ikkl..nn.oo..pp.....ttttuu.vyyzz........." +
+	".............aaiioouuuuuuuuuu.aaaa..ggggkkoooo..j...gg..nnaa..oo" +
+	"aaaaeeeeiiiioooorrrruuuusstt..hh.d....aaeeooooooooyylntj...cclts" +
+	"z..bu.eejj..rryy"
+
+// Base letters of U+1E00 to U+1EFF, mostly Vietnamese
+const foldLatinExtra = "" +
+	"aabbbbbbccddddddddddeeeeeeeeeeffgghhhhhhhhhhiiiikkkkkkllllllllmm" +
+	"mmmmnnnnnnnnoooooooopppprrrrrrrrssssssssssttttttttuuuuuuuuuuvvvv" +
+	"wwwwwwwwwwxxxxyyzzzzzzhtwy.s....aaaaaaaaaaaaaaaaaaaaaaaaeeeeeeee" +
+	"eeeeeeeeiiiioooooooooooooooooooooooouuuuuuuuuuuuuuyyyyyyyy......"
+
+var foldLigatures = map[rune]string{
+	'Æ': "ae", 'æ': "ae", 'Ǣ': "ae", 'ǣ': "ae", 'Ǽ': "ae", 'ǽ': "ae",
+	'Œ': "oe", 'œ': "oe", 'ß': "ss", 'Þ': "th", 'þ': "th",
+	'Ĳ': "ij", 'ĳ': "ij", 'Ǆ': "dz", 'ǅ': "dz", 'ǆ': "dz", 'Ǳ': "dz", 'ǲ': "dz", 'ǳ': "dz",
+	'Ǉ': "lj", 'ǈ': "lj", 'ǉ': "lj", 'Ǌ': "nj", 'ǋ': "nj", 'ǌ': "nj",
+}
+
+// Greek with tonos or dialytika, after lower casing
+var foldGreek = map[rune]rune{
+	'ά': 'α', 'έ': 'ε', 'ή': 'η', 'ί': 'ι', 'ϊ': 'ι', 'ΐ': 'ι',
+	'ό': 'ο', 'ύ': 'υ', 'ϋ': 'υ', 'ΰ': 'υ', 'ώ': 'ω', 'ς': 'σ',
+}
+
+// Combining diacritics, other marks are part of how their script is
+// spelt
+var combining = &unicode.RangeTable{
+	R16: []unicode.Range16{
+		{Lo: 0x0300, Hi: 0x036F, Stride: 1},
+		{Lo: 0x1AB0, Hi: 0x1AFF, Stride: 1},
+		{Lo: 0x1DC0, Hi: 0x1DFF, Stride: 1},
+		{Lo: 0x20D0, Hi: 0x20FF, Stride: 1},
+		{Lo: 0xFE20, Hi: 0xFE2F, Stride: 1},
+	},
+}
+
+// Kana that take a voicing mark, as macOS file names split them off
+const (
+	kanaDakuten    = "かきくけこさしすせそたちつてとはひふへほカキクケコサシスセソタチツテトハヒフヘホ"
+	kanaHandakuten = "はひふへほハヒフヘホ"
+)
+
+// Fold text for matching: lower case, no diacritics, full width forms
+// as ASCII and decomposed kana and Hangul put back together, so
+// "Beyoncé", "BEYONCE" and a macOS "Beyoncé" are all "beyonce".
+func Fold(s string) string {
+	out := make([]rune, 0, len(s))
+	for _, r := range s {
+		if n := len(out); n > 0 {
+			if c, ok := compose(out[n-1], r); ok {
+				out[n-1] = c
+				continue
+			}
+		}
+		if unicode.In(r, combining) {
+			continue
+		}
+		if r >= 0xFF01 && r <= 0xFF5E {
+			r -= 0xFEE0 // Full width ASCII
+		}
+		if lig, ok := foldLigatures[r]; ok {
+			out = append(out, []rune(lig)...)
+			continue
+		}
+		switch {
+		case r >= 0xC0 && r < 0xC0+rune(len(foldLatin)) && foldLatin[r-0xC0] != '.':
+			r = rune(foldLatin[r-0xC0])
+		case r >= 0x1E00 && r < 0x1E00+rune(len(foldLatinExtra)) && foldLatinExtra[r-0x1E00] != '.':
+			r = rune(foldLatinExtra[r-0x1E00])
+		default:
+			r = unicode.ToLower(r)
+			if g, ok := foldGreek[r]; ok {
+				r = g
+			}
+		}
+		out = append(out, r)
+	}
+	return string(out)
+}
+
+// Compose a kana voicing mark or Hangul jamo with the rune before it
+func compose(prev, r rune) (rune, bool) {
+	switch {
+	case r == 0x3099: // Dakuten
+		if prev == 'う' {
+			return 'ゔ', true
+		}
+		if prev == 'ウ' {
+			return 'ヴ', true
+		}
+		if strings.ContainsRune(kanaDakuten, prev) {
+			return prev + 1, true
+		}
+	case r == 0x309A: // Handakuten
+		if strings.ContainsRune(kanaHandakuten, prev) {
+			return prev + 2, true
+		}
+	case prev >= 0x1100 && prev <= 0x1112 && r >= 0x1161 && r <= 0x1175:
+		// Leading consonant and vowel
+		return 0xAC00 + ((prev-0x1100)*21+(r-0x1161))*28, true
+	case prev >= 0xAC00 && prev <= 0xD7A3 && (prev-0xAC00)%28 == 0 && r >= 0x11A8 && r <= 0x11C2:
+		// Trailing consonant
+		return prev + (r - 0x11A7), true
+	}
+	return 0, false
+}
+
+// Scripts written without spaces between words
+func isCJK(r rune) bool {
+	return unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul)
+}
+
+// Folded text for a search index. Runs of CJK become overlapping pairs
+// of characters and their last one alone, so any part of a run can be
+// found as a phrase of pairs.
+func SearchText(s string) string {
+	var words []string
+	for _, term := range searchWords(s, true) {
+		words = append(words, term...)
+	}
+	return strings.Join(words, " ")
+}
+
+// Folded query terms, each a phrase of words to match in order
+func SearchTerms(q string) [][]string {
+	return searchWords(q, false)
+}
+
+func searchWords(s string, index bool) [][]string {
+	var terms [][]string
+	for _, word := range strings.Fields(Fold(s)) {
+		for _, run := range cjkRuns(word) {
+			r := []rune(run)
+			if len(r) < 2 || !isCJK(r[0]) {
+				terms = append(terms, []string{run})
+				continue
+			}
+			var pairs []string
+			for i := 0; i+1 < len(r); i++ {
+				pairs = append(pairs, string(r[i:i+2]))
+			}
+			if index {
+				pairs = append(pairs, string(r[len(r)-1]))
+			}
+			terms = append(terms, pairs)
+		}
+	}
+	return terms
+}
+
+// Split a word where it goes into or out of CJK
+func cjkRuns(word string) []string {
+	var runs []string
+	start, cjk := 0, false
+	for i, r := range word {
+		c := isCJK(r)
+		if c != cjk && i > start {
+			runs = append(runs, word[start:i])
+			start = i
+		}
+		cjk = c
+	}
+	return append(runs, word[start:])
+}
+
+// Letters some languages sort after z, as their own letters rather than
+// accented ones. {, | and } sort just after z.
+var collateTailor = map[string]map[rune]string{
+	"sv": {'å': "z{", 'ä': "z|", 'æ': "z|", 'ö': "z}", 'ø': "z}"},
+	"fi": {'å': "z{", 'ä': "z|", 'ö': "z}"},
+	"da": {'æ': "z{", 'ø': "z|", 'å': "z}"},
+	"nb": {'æ': "z{", 'ø': "z|", 'å': "z}"},
+	"nn": {'æ': "z{", 'ø': "z|", 'å': "z}"},
+	"no": {'æ': "z{", 'ø': "z|", 'å': "z}"},
+	"es": {'ñ': "n{"},
+}
+
+// Sorts names ignoring case and accents, with a language's own letters
+// where they differ. Other scripts sort by code point, which is the
+// dictionary order for kana and Hangul.
+type Collator struct {
+	tailor map[rune]string
+}
+
+// Collator for a language tag like "sv" or "sv-SE", "" for none
+func NewCollator(locale string) *Collator {
+	lang := strings.ToLower(locale)
+	if i := strings.IndexAny(lang, "-_"); i >= 0 {
+		lang = lang[:i]
+	}
+	return &Collator{tailor: collateTailor[lang]}
+}
+
+// Sort key of a name, names with equal keys differ only by case or
+// accents
+func (c *Collator) Key(s string) string {
+	if c.tailor == nil {
+		return Fold(s)
+	}
+	var b strings.Builder
+	for _, r := range strings.ToLower(s) {
+		if t, ok := c.tailor[r]; ok {
+			b.WriteString(t)
+		} else {
+			b.WriteRune(r)
+		}
+	}
+	return Fold(b.String())
+}
+
+// Compare names, -1 if a sorts first. Ties between keys go by code
+// point, so the order is the same every time.
+func (c *Collator) Compare(a, b string) int {
+	if n := strings.Compare(c.Key(a), c.Key(b)); n != 0 {
+		return n
+	}
+	return strings.Compare(a, b)
+}
+
+// Sort names in place
+func (c *Collator) Sort(names []string) {
+	keys := make(map[string]string, len(names))
+	for _, name := range names {
+		keys[name] = c.Key(name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		a, b := names[i], names[j]
+		if keys[a] != keys[b] {
+			return keys[a] < keys[b]
+		}
+		return a < b
+	})
+}
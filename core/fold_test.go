@@ -0,0 +1,77 @@
+package core
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFold(t *testing.T) {
+	// Each class folds to one string, different from the other classes
+	classes := [][]string{
+		{"beyonce", "Beyoncé", "BEYONCÉ", "Beyonce\u0301", "Ｂｅｙｏｎｃｅ"},
+		{"aeon", "Æon", "æon"},
+		{"strasse", "Straße", "STRASSE"},
+		{"sigur ros", "Sigur Rós"},
+		{"viet", "Việt", "VIỆT", "Vie\u0323\u0302t"},
+		{"αλφα", "Άλφα", "ΑΛΦΑ"},
+		{"ガ", "\u30AB\u3099"},
+		{"パ", "\u30CF\u309A"},
+		{"한", "\u1112\u1161\u11AB"},
+		{"か"},
+		{"ア"},
+	}
+	seen := make(map[string]int)
+	for i, class := range classes {
+		want := Fold(class[0])
+		for _, s := range class[1:] {
+			if got := Fold(s); got != want {
+				t.Errorf("Fold(%q) = %q, want %q", s, got, want)
+			}
+		}
+		if j, ok := seen[want]; ok {
+			t.Errorf("%q and %q fold the same", class[0], classes[j][0])
+		}
+		seen[want] = i
+	}
+}
+
+func TestSearchText(t *testing.T) {
+	tests := []struct {
+		text  string
+		index string
+		terms [][]string
+	}{
+		{"Beyoncé Halo", "beyonce halo", [][]string{{"beyonce"}, {"halo"}}},
+		{"東京", "東京 京", [][]string{{"東京"}}},
+		{"東京事変", "東京 京事 事変 変", [][]string{{"東京", "京事", "事変"}}},
+		{"abc東京", "abc 東京 京", [][]string{{"abc"}, {"東京"}}},
+		{"東", "東", [][]string{{"東"}}},
+	}
+	for _, tt := range tests {
+		if got := SearchText(tt.text); got != tt.index {
+			t.Errorf("SearchText(%q) = %q, want %q", tt.text, got, tt.index)
+		}
+		if got := SearchTerms(tt.text); !reflect.DeepEqual(got, tt.terms) {
+			t.Errorf("SearchTerms(%q) = %q, want %q", tt.text, got, tt.terms)
+		}
+	}
+}
+
+func TestCollator(t *testing.T) {
+	names := []string{"Öl", "zebra", "Ärlig", "apa", "Apa"}
+	tests := []struct {
+		locale string
+		want   []string
+	}{
+		{"", []string{"Apa", "apa", "Ärlig", "Öl", "zebra"}},
+		{"sv-SE", []string{"Apa", "apa", "zebra", "Ärlig", "Öl"}},
+		{"de", []string{"Apa", "apa", "Ärlig", "Öl", "zebra"}},
+	}
+	for _, tt := range tests {
+		got := append([]string{}, names...)
+		NewCollator(tt.locale).Sort(got)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q: got %v, want %v", tt.locale, got, tt.want)
+		}
+	}
+}
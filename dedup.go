@@ -0,0 +1,78 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// How long a command ID is remembered
+const dedupWindow = 10 * time.Minute
+
+// Command IDs seen recently, so retried messages are only applied once
+type dedup struct {
+	lock  *sync.Mutex
+	seen  map[string]time.Time
+	order []string // Oldest first
+}
+
+func newDedup() *dedup {
+	return &dedup{
+		lock: &sync.Mutex{},
+		seen: make(map[string]time.Time),
+	}
+}
+
+// Whether a key is new in the window, marking it seen
+func (d *dedup) first(key string, now time.Time) bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	// Forget old keys
+	for len(d.order) > 0 && now.Sub(d.seen[d.order[0]]) > dedupWindow {
+		delete(d.seen, d.order[0])
+		d.order = d.order[1:]
+	}
+
+	if _, ok := d.seen[key]; ok {
+		return false
+	}
+	d.seen[key] = now
+	d.order = append(d.order, key)
+	return true
+}
+
+// Forget a key, so it's new again
+func (d *dedup) forget(key string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	delete(d.seen, key) // Left in order until it's old
+}
+
+// Whether a user's command is new, commands without an ID always are.
+// It's held as seen while it's handled.
+func (s *Server) fresh(u *User, id string) bool {
+	return id == "" || s.commands.first(u.session.ID+"/"+id, time.Now())
+}
+
+// Let a command that wasn't applied be retried
+func (s *Server) refused(u *User, id string) {
+	if id != "" {
+		s.commands.forget(u.session.ID + "/" + id)
+	}
+}
+
+// Tell other instances a command was applied, so a retry that reaches
+// one of them after a reconnect isn't applied again
+func (s *Server) applied(u *User, id string) {
+	if id != "" {
+		s.publish(&Message{Command: "applied", ID: u.session.ID + "/" + id})
+	}
+}
+
+// Acknowledge a command, reason is why it wasn't applied
+func (s *Server) ack(u *User, id, reason string) {
+	if id == "" {
+		return
+	}
+	s.sockWriteUser(u, &Message{Command: "ack", ID: id, Error: reason})
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+
+	"github.com/emcfarlane/jukebox/core"
+)
+
+// Log a change to the pool, songLock must be held so the log is in the
+// order changes were applied. Changes from other instances are logged
+// by them.
+func (s *Server) record(typ, song string, weight float64, time int) {
+	e := core.Event{Type: typ, Time: time, Song: song, Weight: weight}
+	if err := s.store.AppendEvent(*roomName, e); err != nil {
+		log.Println("record: ", err)
+	}
+}
+
+// Log a ban or its lift for the audit trail, replays skip them
+func (s *Server) audit(typ, note string) {
+	e := core.Event{Type: typ, Time: int(makeTimestamp()), Note: note}
+	if err := s.store.AppendEvent(*roomName, e); err != nil {
+		log.Println("audit: ", err)
+	}
+}
+
+// Rebuild the pool from the room's event log, before the library scan
+func (s *Server) replay() error {
+	s.songLock.Lock()
+	defer s.songLock.Unlock()
+	n := 0
+	err := s.store.Events(*roomName, 0, func(e core.Event) error {
+		s.pool.Apply(e)
+		n++
+		return nil
+	})
+	log.Println("Replayed: ", n, " events, ", s.pool.Len(), " songs")
+	return err
+}
+
+// Remove songs whose files have gone, songLock must be held
+func (s *Server) songPrune(names []string) {
+	found := make(map[string]bool, len(names))
+	for _, name := range names {
+		found[name] = true
+	}
+	for _, song := range s.pool.All() {
+		if !found[song.Name] {
+			log.Println("Removed: ", song.Name)
+			s.pool.Remove(song.Name)
+			s.record(core.EventRemove, song.Name, 0, int(makeTimestamp()))
+			s.libraryChanged()
+		}
+	}
+}
+
+// Event log handle, JSON lines after ?after= for this room or ?room=
+func (s *Server) eventsAPI(w http.ResponseWriter, r *http.Request) error {
+	if !s.isAdmin(r) {
+		http.Error(w, "admin only", http.StatusForbidden)
+		return nil
+	}
+	room := *roomName
+	if v := r.FormValue("room"); v != "" {
+		room = v
+	}
+	after, _ := strconv.ParseInt(r.FormValue("after"), 10, 64)
+
+	// Buffered so the store isn't held by a slow client
+	var events []core.Event
+	err := s.store.Events(room, after, func(e core.Event) error {
+		events = append(events, e)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	enc := json.NewEncoder(w)
+	for _, e := range events {
+		if err := enc.Encode(&e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Replay command, rebuilds a pool from an event log to reproduce a bug:
+//
+//	jukebox replay [-v] [-until seq] events.jsonl
+//
+// The log is read from the file, stdin for "-", or -db if none is given.
+func replayCommand(args []string) error {
+	fs := flag.NewFlagSet("replay", flag.ContinueOnError)
+	verbose := fs.Bool("v", false, "Print the pool after every event")
+	until := fs.Int64("until", 0, "Stop after this sequence number, 0 for the whole log")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	pool := core.NewPool()
+	apply := func(e core.Event) error {
+		if *until > 0 && e.Seq > *until {
+			return io.EOF
+		}
+		pool.Apply(e)
+		if *verbose {
+			fmt.Printf("%d %s %d %q %g\n", e.Seq, e.Type, e.Time, e.Song, e.Weight)
+			printPool(pool, "\t")
+		}
+		return nil
+	}
+
+	var err error
+	switch name := fs.Arg(0); name {
+	case "":
+		var store Store
+		if store, err = openStore(*dbPath); err != nil {
+			return err
+		}
+		defer store.Close()
+		err = store.Events(*roomName, 0, apply)
+	default:
+		f := os.Stdin
+		if name != "-" {
+			if f, err = os.Open(name); err != nil {
+				return err
+			}
+			defer f.Close()
+		}
+		sc := bufio.NewScanner(f)
+		sc.Buffer(nil, 1<<20)
+		for err == nil && sc.Scan() {
+			var e core.Event
+			if err = json.Unmarshal(sc.Bytes(), &e); err == nil {
+				err = apply(e)
+			}
+		}
+		if err == nil {
+			err = sc.Err()
+		}
+	}
+	if err != nil && err != io.EOF {
+		return err
+	}
+	printPool(pool, "")
+	return nil
+}
+
+// Print songs by score then name, so output is the same every run
+func printPool(pool *core.Pool, indent string) {
+	songs := pool.All()
+	sort.Slice(songs, func(i, j int) bool {
+		if songs[i].Score != songs[j].Score {
+			return songs[i].Score > songs[j].Score
+		}
+		return songs[i].Name < songs[j].Name
+	})
+	for _, song := range songs {
+		fmt.Printf("%s%g\t+%g -%g\t%s\tplayed %d\n", indent, song.Score, song.Up, song.Down, song.Name, pool.Played(song.Name))
+	}
+}
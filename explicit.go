@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// Titles marked as explicit, e.g. "Song (Explicit)" or "Song - Explicit Version"
+var explicitTitle = regexp.MustCompile(`(?i)[\(\[]\s*explicit\b|\bexplicit (version|edit)\b`)
+
+// Flag explicit songs from their tags, falling back to the title
+func explicitTags(tags map[string]string, title string) bool {
+	// iTunes content advisory, 1 and 4 are explicit, 2 is clean
+	switch tags["itunesadvisory"] {
+	case "1", "4":
+		return true
+	case "2":
+		return false
+	}
+	return explicitTitle.MatchString(title)
+}
+
+var lookupClient = &http.Client{Timeout: 5 * time.Second}
+
+// Ask the explicit lookup service about a song, expects {"explicit": bool}
+func explicitLookup(ctx context.Context, m Meta) (bool, error) {
+	if m.Artist == "" {
+		return false, nil
+	}
+	q := url.Values{"artist": {m.Artist}, "title": {m.Title}}
+	req, err := http.NewRequest("GET", *explicitURL+"?"+q.Encode(), nil)
+	if err != nil {
+		return false, err
+	}
+	resp, err := lookupClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("explicit lookup: %s", resp.Status)
+	}
+	var v struct {
+		Explicit bool `json:"explicit"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&v); err != nil {
+		return false, err
+	}
+	return v.Explicit, nil
+}
+
+func (s *Server) explicitLoad() error {
+	names, err := s.store.Explicit()
+	if err != nil {
+		return err
+	}
+	family, err := s.store.Setting("family_mode")
+	if err != nil {
+		return err
+	}
+
+	s.songLock.Lock()
+	defer s.songLock.Unlock()
+	for _, name := range names {
+		s.songExplicit[name] = true
+	}
+	s.family, _ = strconv.ParseBool(family)
+	return nil
+}
+
+// Whether a song is out of the pool, karaoke tracks are only sung and
+// explicit ones are hidden by family mode. songLock must be held.
+func (s *Server) hidden(name string) bool {
+	return s.songKaraoke[name] || s.family && s.songExplicit[name]
+}
+
+// Switch family mode and tell clients
+func (s *Server) familySet(on bool) error {
+	if err := s.store.SetSetting("family_mode", strconv.FormatBool(on)); err != nil {
+		return err
+	}
+	s.songLock.Lock()
+	defer s.songLock.Unlock()
+	s.family = on
+	s.libraryChanged()
+	log.Println("Family mode: ", on)
+	msg := &Message{Command: "family", Family: &on}
+	s.sockWriteLoop(msg)
+	s.emit(msg)
+	return nil
+}
+
+type Family struct {
+	Enabled bool
+}
+
+// Family mode handle, anyone can read it but only admins can switch it
+func (s *Server) familyAPI(w http.ResponseWriter, r *http.Request) error {
+	switch r.Method {
+	case "GET":
+	case "POST", "PUT":
+		if !s.isAdmin(r) {
+			http.Error(w, "admin only", http.StatusForbidden)
+			return nil
+		}
+		var v Family
+		if err := json.NewDecoder(r.Body).Decode(&v); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return nil
+		}
+		if err := s.familySet(v.Enabled); err != nil {
+			return err
+		}
+		s.publish(&Message{Command: "family", Family: &v.Enabled})
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return nil
+	}
+
+	s.songLock.Lock()
+	v := Family{Enabled: s.family}
+	s.songLock.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(&v)
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	feedEntries  = 50 // Plays in the feed
+	feedUpcoming = 10 // Queued songs with ?upcoming=1
+)
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Links   []atomLink  `xml:"link"`
+	Author  atomAuthor  `xml:"author"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Rel  string `xml:"rel,attr,omitempty"`
+	Href string `xml:"href,attr"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+}
+
+type atomCategory struct {
+	Term string `xml:"term,attr"`
+}
+
+type atomEntry struct {
+	ID       string        `xml:"id"`
+	Title    string        `xml:"title"`
+	Updated  string        `xml:"updated"`
+	Category *atomCategory `xml:"category,omitempty"`
+	Links    []atomLink    `xml:"link,omitempty"`
+	Summary  string        `xml:"summary,omitempty"`
+}
+
+func atomTime(ms int) time.Time {
+	return time.Unix(0, int64(ms)*int64(time.Millisecond)).UTC()
+}
+
+// Display title for a song, from its tags if scanned
+func (s *Server) songTitle(name string) (title, album string) {
+	m, err := s.store.Meta(name)
+	if err != nil || m == nil {
+		return name, ""
+	}
+	title = m.Title
+	if m.Artist != "" {
+		title = m.Artist + " - " + m.Title
+	}
+	return title, m.Album
+}
+
+// Played feed handle, this room unless ?room= is given, empty for all.
+// ?upcoming=1 adds the top of the queue.
+func (s *Server) playedFeed(w http.ResponseWriter, r *http.Request) error {
+	room := *roomName
+	if v, ok := r.URL.Query()["room"]; ok {
+		room = v[0]
+	}
+	upcoming := r.FormValue("upcoming") != ""
+	plays, err := s.store.History(room, feedEntries)
+	if err != nil {
+		return err
+	}
+
+	base := s.baseURL()
+	feedID := "urn:jukebox:played:" + url.PathEscape(room)
+	title := "Jukebox: played"
+	if room != "" {
+		title += " in " + room
+	}
+	feed := atomFeed{
+		ID:     feedID,
+		Title:  title,
+		Author: atomAuthor{Name: "Jukebox"},
+		Links: []atomLink{
+			{Rel: "self", Href: base + r.URL.RequestURI()},
+			{Rel: "alternate", Href: base + "/"},
+		},
+	}
+
+	// Conditional requests are on the latest play and the queue
+	modified := time.Unix(0, 0).UTC()
+	if len(plays) > 0 {
+		modified = atomTime(plays[0].Time)
+	}
+	etag := strconv.Itoa(len(plays))
+	if len(plays) > 0 {
+		etag += "-" + strconv.Itoa(plays[0].Time)
+	}
+
+	if upcoming {
+		s.songLock.Lock()
+		songs := s.pool.Songs()
+		s.songLock.Unlock()
+		if len(songs) > feedUpcoming {
+			songs = songs[:feedUpcoming]
+		}
+		for i, song := range songs {
+			title, album := s.songTitle(song.Name)
+			feed.Entries = append(feed.Entries, atomEntry{
+				ID:       fmt.Sprintf("%s:upcoming:%d", feedID, i+1),
+				Title:    title,
+				Updated:  modified.Format(time.RFC3339),
+				Category: &atomCategory{Term: "upcoming"},
+				Summary:  strings.TrimPrefix(album+", score "+strconv.FormatFloat(song.Score, 'g', -1, 64), ", "),
+			})
+			etag += fmt.Sprintf("/%s:%g", song.Name, song.Score)
+		}
+	}
+
+	for _, p := range plays {
+		title, album := s.songTitle(p.Song)
+		e := atomEntry{
+			ID:       fmt.Sprintf("urn:jukebox:play:%s:%d", url.PathEscape(p.Room), p.Time),
+			Title:    title,
+			Updated:  atomTime(p.Time).Format(time.RFC3339),
+			Category: &atomCategory{Term: "played"},
+			Summary:  album,
+		}
+		if p.Track != "" {
+			e.Links = []atomLink{{Rel: "related", Href: base + "/api/v1/tracks/" + p.Track}}
+		}
+		feed.Entries = append(feed.Entries, e)
+	}
+	feed.Updated = modified.Format(time.RFC3339)
+
+	b := new(bytes.Buffer)
+	b.WriteString(xml.Header)
+	if err := xml.NewEncoder(b).Encode(&feed); err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+	w.Header().Set("Cache-Control", "public, max-age=60")
+	sum := sha256.Sum256([]byte(etag))
+	w.Header().Set("ETag", fmt.Sprintf("W/%q", hex.EncodeToString(sum[:8])))
+	if upcoming {
+		// The queue changes without a play, only the ETag follows it
+		modified = time.Time{}
+	}
+	http.ServeContent(w, r, "", modified, bytes.NewReader(b.Bytes()))
+	return nil
+}
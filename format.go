@@ -0,0 +1,489 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var errUnknownFormat = errors.New("unknown audio format")
+
+const (
+	frameSearch = 64 << 10 // How far into a file to look for the first MP3 frame
+	maxMoov     = 32 << 20 // Largest MP4 index read
+)
+
+// Containers by extension, for files whose content can't be read
+var audioExts = map[string]string{
+	".mp3":  "mp3",
+	".ogg":  "ogg",
+	".oga":  "ogg",
+	".opus": "ogg",
+	".wav":  "wav",
+	".flac": "flac",
+	".m4a":  "mp4",
+	".aif":  "aiff",
+	".aiff": "aiff",
+	".aifc": "aiff",
+}
+
+var containerTypes = map[string]string{
+	"mp3":  "audio/mpeg",
+	"ogg":  "audio/ogg",
+	"wav":  "audio/wav",
+	"flac": "audio/flac",
+	"mp4":  "audio/mp4",
+	"aiff": "audio/aiff",
+}
+
+// Codecs browsers play, others are transcoded
+var browserCodecs = map[string]bool{
+	"mp3":    true,
+	"vorbis": true,
+	"opus":   true,
+	"flac":   true,
+	"aac":    true,
+	"pcm":    true,
+}
+
+// MP4 sample entries and their codecs
+var mp4Codecs = map[string]string{
+	"mp4a": "aac",
+	"alac": "alac",
+	"Opus": "opus",
+	"fLaC": "flac",
+}
+
+// MPEG layer III bitrates in kbit/s, MPEG-1 then MPEG-2 and 2.5
+var mp3Bitrates = [2][15]int{
+	{0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320},
+	{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160},
+}
+
+var mp3Rates = [3]int{44100, 48000, 32000}
+
+// Audio format, read from headers without decoding
+type Format struct {
+	Container  string // mp3, ogg, wav, flac, mp4 or aiff
+	Codec      string // mp3, vorbis, opus, flac, aac, alac or pcm
+	Bitrate    int    // kbit/s, averaged over the file
+	SampleRate int    // Hz
+	Channels   int
+	Duration   int // ms, 0 if unknown
+}
+
+// Whether browsers can play the format as it is
+func (fm *Format) playable() bool {
+	return browserCodecs[fm.Codec] && fm.Container != "aiff"
+}
+
+// Format of a file by its content, whatever its extension
+func readFormat(f io.ReadSeeker) (Format, error) {
+	size, err := f.Seek(0, 2)
+	if err != nil {
+		return Format{}, err
+	}
+	if _, err := f.Seek(0, 0); err != nil {
+		return Format{}, err
+	}
+	head := make([]byte, 12)
+	if _, err := io.ReadFull(f, head); err != nil {
+		return Format{}, errUnknownFormat
+	}
+	if _, err := f.Seek(0, 0); err != nil {
+		return Format{}, err
+	}
+
+	var fm Format
+	switch {
+	case bytes.HasPrefix(head, []byte("RIFF")) && bytes.Equal(head[8:], []byte("WAVE")):
+		fm, err = wavFormat(f)
+	case bytes.HasPrefix(head, []byte("FORM")) && (bytes.Equal(head[8:], []byte("AIFF")) || bytes.Equal(head[8:], []byte("AIFC"))):
+		fm, err = aiffFormat(f)
+	case bytes.HasPrefix(head, []byte("OggS")):
+		fm, err = oggFormat(f)
+	case bytes.HasPrefix(head, []byte("fLaC")):
+		fm, err = flacFormat(f)
+	case bytes.Equal(head[4:8], []byte("ftyp")):
+		fm, err = mp4Format(f, size)
+	default:
+		fm, err = mp3Format(f, size)
+	}
+	if err != nil {
+		return fm, err
+	}
+	if fm.Bitrate == 0 && fm.Duration > 0 {
+		fm.Bitrate = int(size * 8 / int64(fm.Duration))
+	}
+	return fm, nil
+}
+
+// Format of a song, from the extension if the content can't be read
+func fileFormat(name string) Format {
+	f, err := os.Open(musicPath(name))
+	if err != nil {
+		return Format{}
+	}
+	defer f.Close()
+	fm, err := readFormat(f)
+	if err != nil {
+		return Format{Container: audioExts[strings.ToLower(filepath.Ext(name))]}
+	}
+	return fm
+}
+
+// Whether a file without an audio extension is audio. MP3 must start
+// with a tag or a frame, a frame sync is easy to find in other files.
+func sniffAudio(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	head := make([]byte, 3)
+	if _, err := io.ReadFull(f, head); err != nil {
+		return false
+	}
+	fm, err := readFormat(f)
+	if err != nil {
+		return false
+	}
+	return fm.Container != "mp3" || string(head) == "ID3" || head[0] == 0xff && head[1]&0xe0 == 0xe0
+}
+
+func wavFormat(f io.Reader) (Format, error) {
+	fm := Format{Container: "wav", Codec: "pcm"}
+	if _, err := io.CopyN(ioutil.Discard, f, 12); err != nil {
+		return fm, err
+	}
+	byteRate := 0
+	h := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(f, h); err != nil {
+			return fm, nil
+		}
+		n := int64(binary.LittleEndian.Uint32(h[4:]))
+		switch string(h[:4]) {
+		case "fmt ":
+			if n < 16 || n > 1<<10 {
+				return fm, errUnknownFormat
+			}
+			b := make([]byte, n)
+			if _, err := io.ReadFull(f, b); err != nil {
+				return fm, err
+			}
+			if binary.LittleEndian.Uint16(b) == 0x55 {
+				fm.Codec = "mp3"
+			}
+			fm.Channels = int(binary.LittleEndian.Uint16(b[2:]))
+			fm.SampleRate = int(binary.LittleEndian.Uint32(b[4:]))
+			byteRate = int(binary.LittleEndian.Uint32(b[8:]))
+			fm.Bitrate = byteRate * 8 / 1000
+			n = 0
+		case "data":
+			if byteRate > 0 {
+				fm.Duration = int(n * 1000 / int64(byteRate))
+			}
+			return fm, nil
+		}
+		// Chunks are padded to an even size
+		if _, err := io.CopyN(ioutil.Discard, f, n+n%2); err != nil {
+			return fm, nil
+		}
+	}
+}
+
+func aiffFormat(f io.Reader) (Format, error) {
+	fm := Format{Container: "aiff", Codec: "pcm"}
+	head := make([]byte, 12)
+	if _, err := io.ReadFull(f, head); err != nil {
+		return fm, err
+	}
+	h := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(f, h); err != nil {
+			return fm, nil
+		}
+		n := int64(binary.BigEndian.Uint32(h[4:]))
+		if string(h[:4]) != "COMM" {
+			if _, err := io.CopyN(ioutil.Discard, f, n+n%2); err != nil {
+				return fm, nil
+			}
+			continue
+		}
+		if n < 18 || n > 1<<10 {
+			return fm, errUnknownFormat
+		}
+		b := make([]byte, n)
+		if _, err := io.ReadFull(f, b); err != nil {
+			return fm, err
+		}
+		fm.Channels = int(binary.BigEndian.Uint16(b))
+		frames := int64(binary.BigEndian.Uint32(b[2:]))
+		bits := int(binary.BigEndian.Uint16(b[6:]))
+
+		// Rate is an 80 bit float
+		exp := int(binary.BigEndian.Uint16(b[8:]) & 0x7fff)
+		fm.SampleRate = int(math.Ldexp(float64(binary.BigEndian.Uint64(b[10:])), exp-16383-63))
+
+		if string(head[8:]) == "AIFC" && n >= 22 {
+			if c := string(b[18:22]); c != "NONE" && c != "sowt" && c != "fl32" && c != "fl64" {
+				fm.Codec = strings.TrimSpace(strings.ToLower(c))
+			}
+		}
+		if fm.SampleRate > 0 {
+			fm.Duration = int(frames * 1000 / int64(fm.SampleRate))
+			fm.Bitrate = fm.SampleRate * bits * fm.Channels / 1000
+		}
+		return fm, nil
+	}
+}
+
+// Samples in the last page over the rate from the first
+func oggFormat(f io.ReadSeeker) (Format, error) {
+	fm := Format{Container: "ogg"}
+	b := make([]byte, 512)
+	n, err := io.ReadFull(f, b)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return fm, err
+	}
+	b = b[:n]
+
+	skip := int64(0)
+	if i := bytes.Index(b, []byte("\x01vorbis")); i >= 0 && len(b) >= i+16 {
+		fm.Codec = "vorbis"
+		fm.Channels = int(b[i+11])
+		fm.SampleRate = int(binary.LittleEndian.Uint32(b[i+12:]))
+	} else if i := bytes.Index(b, []byte("OpusHead")); i >= 0 && len(b) >= i+12 {
+		// Opus always decodes at 48kHz
+		fm.Codec = "opus"
+		fm.Channels = int(b[i+9])
+		fm.SampleRate, skip = 48000, int64(binary.LittleEndian.Uint16(b[i+10:]))
+	} else if i := bytes.Index(b, []byte("\x7fFLAC")); i >= 0 {
+		fm.Codec = "flac"
+		if len(b) >= i+17+18 {
+			fm.SampleRate, fm.Channels, _ = flacInfo(b[i+17:])
+		}
+	}
+	if fm.SampleRate == 0 {
+		return fm, nil
+	}
+
+	size, err := f.Seek(0, 2)
+	if err != nil {
+		return fm, err
+	}
+	tail := int64(frameSearch)
+	if tail > size {
+		tail = size
+	}
+	if _, err := f.Seek(-tail, 2); err != nil {
+		return fm, err
+	}
+	b = make([]byte, tail)
+	if _, err := io.ReadFull(f, b); err != nil {
+		return fm, err
+	}
+	i := bytes.LastIndex(b, []byte("OggS"))
+	if i < 0 || len(b) < i+14 {
+		return fm, nil
+	}
+	if granule := int64(binary.LittleEndian.Uint64(b[i+6:])) - skip; granule > 0 {
+		fm.Duration = int(granule * 1000 / int64(fm.SampleRate))
+	}
+	return fm, nil
+}
+
+// Rate, channels and total samples from a FLAC STREAMINFO block
+func flacInfo(b []byte) (rate, channels int, samples int64) {
+	rate = int(b[10])<<12 | int(b[11])<<4 | int(b[12])>>4
+	channels = int(b[12]>>1&7) + 1
+	samples = int64(b[13]&0x0f)<<32 | int64(binary.BigEndian.Uint32(b[14:]))
+	return rate, channels, samples
+}
+
+func flacFormat(f io.Reader) (Format, error) {
+	fm := Format{Container: "flac", Codec: "flac"}
+	b := make([]byte, 4+4+34)
+	if _, err := io.ReadFull(f, b); err != nil {
+		return fm, err
+	}
+	if b[4]&0x7f != 0 {
+		return fm, nil // STREAMINFO must come first
+	}
+	rate, channels, samples := flacInfo(b[8:])
+	fm.SampleRate, fm.Channels = rate, channels
+	if rate > 0 {
+		fm.Duration = int(samples * 1000 / int64(rate))
+	}
+	return fm, nil
+}
+
+// Codec and length from the moov box, which may be at either end
+func mp4Format(f io.ReadSeeker, size int64) (Format, error) {
+	fm := Format{Container: "mp4"}
+	var moov []byte
+	h := make([]byte, 16)
+	for pos := int64(0); pos+8 <= size; {
+		if _, err := f.Seek(pos, 0); err != nil {
+			return fm, err
+		}
+		if _, err := io.ReadFull(f, h[:8]); err != nil {
+			return fm, err
+		}
+		n, head := int64(binary.BigEndian.Uint32(h)), int64(8)
+		switch n {
+		case 0:
+			n = size - pos
+		case 1:
+			if _, err := io.ReadFull(f, h[8:]); err != nil {
+				return fm, err
+			}
+			n, head = int64(binary.BigEndian.Uint64(h[8:])), 16
+		}
+		if n < head {
+			break
+		}
+		if string(h[4:8]) == "moov" {
+			if n-head > maxMoov {
+				return fm, nil
+			}
+			moov = make([]byte, n-head)
+			if _, err := io.ReadFull(f, moov); err != nil {
+				return fm, err
+			}
+			break
+		}
+		pos += n
+	}
+	if moov == nil {
+		return fm, nil
+	}
+
+	if i := bytes.Index(moov, []byte("mvhd")); i >= 0 && len(moov) >= i+36 {
+		var scale, length int64
+		if moov[i+4] == 1 {
+			scale = int64(binary.BigEndian.Uint32(moov[i+24:]))
+			length = int64(binary.BigEndian.Uint64(moov[i+28:]))
+		} else {
+			scale = int64(binary.BigEndian.Uint32(moov[i+16:]))
+			length = int64(binary.BigEndian.Uint32(moov[i+20:]))
+		}
+		if scale > 0 {
+			fm.Duration = int(length * 1000 / scale)
+		}
+	}
+
+	// First audio sample entry in a sample description
+	i := bytes.Index(moov, []byte("stsd"))
+	if i < 0 {
+		return fm, nil
+	}
+	entry := -1
+	for typ, codec := range mp4Codecs {
+		if j := bytes.Index(moov[i:], []byte(typ)); j >= 0 && (entry < 0 || j < entry) {
+			entry, fm.Codec = j, codec
+		}
+	}
+	if e := i + entry + 4; entry >= 0 && len(moov) >= e+28 {
+		fm.Channels = int(binary.BigEndian.Uint16(moov[e+16:]))
+		fm.SampleRate = int(binary.BigEndian.Uint32(moov[e+24:]) >> 16)
+	}
+	return fm, nil
+}
+
+// Frame count from a Xing or VBRI header, or the bitrate of the first
+// frame for constant bitrate files
+func mp3Format(f io.ReadSeeker, size int64) (Format, error) {
+	fm := Format{Container: "mp3", Codec: "mp3"}
+
+	// Audio starts after any ID3v2 tag
+	var start int64
+	h := make([]byte, 10)
+	if _, err := io.ReadFull(f, h); err != nil {
+		return fm, errUnknownFormat
+	}
+	if bytes.HasPrefix(h, []byte("ID3")) {
+		start = int64(syncsafe(h[6:10])) + 10
+		if h[5]&0x10 != 0 {
+			start += 10 // Footer
+		}
+	}
+	if _, err := f.Seek(start, 0); err != nil {
+		return fm, err
+	}
+	b := make([]byte, frameSearch)
+	n, err := io.ReadFull(f, b)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return fm, err
+	}
+	b = b[:n]
+
+	for i := 0; i+4 <= len(b); i++ {
+		if b[i] != 0xff || b[i+1]&0xe0 != 0xe0 {
+			continue
+		}
+		version := b[i+1] >> 3 & 3 // 3 is MPEG-1, 2 MPEG-2, 0 MPEG-2.5
+		layer := b[i+1] >> 1 & 3   // 1 is layer III
+		bitrate := int(b[i+2] >> 4)
+		rate := int(b[i+2] >> 2 & 3)
+		if version == 1 || layer != 1 || bitrate == 0 || bitrate == 15 || rate == 3 {
+			continue
+		}
+
+		mpeg1 := version == 3
+		table, samples, side := 1, 576, 17
+		if mpeg1 {
+			table, samples, side = 0, 1152, 32
+		}
+		fm.Channels = 2
+		if b[i+3]>>6 == 3 {
+			fm.Channels, side = 1, side/2+1
+		}
+		fm.SampleRate = mp3Rates[rate]
+		switch version {
+		case 2:
+			fm.SampleRate /= 2
+		case 0:
+			fm.SampleRate /= 4
+		}
+
+		audio := size - start - int64(i)
+		if size >= 128 {
+			tag := make([]byte, 3)
+			if _, err := f.Seek(-128, 2); err == nil {
+				if _, err := io.ReadFull(f, tag); err == nil && string(tag) == "TAG" {
+					audio -= 128
+				}
+			}
+		}
+
+		var frames int64
+		frame := b[i:]
+		if x := 4 + side; len(frame) >= x+12 && (bytes.HasPrefix(frame[x:], []byte("Xing")) || bytes.HasPrefix(frame[x:], []byte("Info"))) {
+			if binary.BigEndian.Uint32(frame[x+4:])&1 != 0 {
+				frames = int64(binary.BigEndian.Uint32(frame[x+8:]))
+			}
+		} else if len(frame) >= 36+18 && bytes.HasPrefix(frame[36:], []byte("VBRI")) {
+			frames = int64(binary.BigEndian.Uint32(frame[36+14:]))
+		}
+		if frames > 0 {
+			fm.Duration = int(frames * int64(samples) * 1000 / int64(fm.SampleRate))
+			if fm.Duration > 0 {
+				fm.Bitrate = int(audio * 8 / int64(fm.Duration))
+			}
+			return fm, nil
+		}
+
+		fm.Bitrate = mp3Bitrates[table][bitrate]
+		fm.Duration = int(audio * 8 / int64(fm.Bitrate))
+		return fm, nil
+	}
+	return fm, errUnknownFormat
+}
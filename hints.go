@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"log"
+)
+
+// Playback hints for a song, applied by clients
+type Hints struct {
+	Gain  float64 // Gain offset in dB
+	Start float64 // Seconds of intro to skip
+	Fade  float64 // Fade out from this many seconds, 0 plays to the end
+}
+
+func (h *Hints) valid() error {
+	if h.Gain < -60 || h.Gain > 20 {
+		return fmt.Errorf("gain %v out of range", h.Gain)
+	}
+	if h.Start < 0 || h.Fade < 0 {
+		return fmt.Errorf("negative start or fade")
+	}
+	if h.Fade != 0 && h.Fade <= h.Start {
+		return fmt.Errorf("fade before start")
+	}
+	return nil
+}
+
+func (s *Server) hintsLoad() error {
+	hints, err := s.store.Hints()
+	if err != nil {
+		return err
+	}
+
+	s.songLock.Lock()
+	defer s.songLock.Unlock()
+	s.songHints = hints
+	return nil
+}
+
+// Store a song's hints and tell clients
+func (s *Server) hints(song Song) {
+	h := song.Hints
+	if h == nil {
+		h = &Hints{}
+	}
+	if err := h.valid(); err != nil {
+		log.Println("hints: ", err)
+		return
+	}
+
+	s.songLock.Lock()
+	ok := s.pool.Has(song.Name)
+	s.songLock.Unlock()
+	if !ok {
+		log.Println("hints: Unknown song ", song.Name)
+		return
+	}
+	if err := s.store.SetHints(song.Name, h); err != nil {
+		log.Println("hints: ", err)
+		return
+	}
+	song.Hints = h
+	s.hintsSet(song)
+	s.publish(&Message{Command: "hints", Song: song})
+}
+
+// Use a song's stored hints
+func (s *Server) hintsSet(song Song) {
+	s.songLock.Lock()
+	defer s.songLock.Unlock()
+	s.songHints[song.Name] = song.Hints
+	if s.songPlaying.Song.Name == song.Name && s.songPlaying.Announce == nil {
+		s.songPlaying.Song.Hints = song.Hints
+		s.schedule()
+	}
+
+	song.Score = s.pool.Score(song.Name)
+	s.sockWriteLoop(&Message{
+		Command: "hints",
+		Song:    song,
+	})
+}
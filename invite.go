@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Invite scopes, each allows everything the ones before it do
+var scopes = map[string]int{
+	"vote":    1, // Vote, rename and follow playback
+	"request": 2, // Also trim songs, go live and edit playlists
+	"admin":   3,
+}
+
+// What a websocket command needs
+var commandScope = map[string]string{
+	"hints":  "request",
+	"live":   "request",
+	"unlive": "request",
+	"signal": "request",
+	"sleep":  "request",
+}
+
+type Invite struct {
+	Scope   string
+	TTL     int    `json:",omitempty"` // Seconds, request only
+	Token   string `json:",omitempty"`
+	URL     string `json:",omitempty"`
+	Expires time.Time
+}
+
+// Signed "scope:expiry" token
+func (s *Server) inviteToken(scope string, expires time.Time) string {
+	return sign(s.inviteKey, scope+":"+strconv.FormatInt(expires.Unix(), 10))
+}
+
+func (s *Server) inviteCheck(token string) (string, time.Time, bool) {
+	payload, ok := unsign(s.inviteKey, token)
+	if !ok {
+		return "", time.Time{}, false
+	}
+	parts := strings.SplitN(payload, ":", 2)
+	if len(parts) != 2 || scopes[parts[0]] == 0 {
+		return "", time.Time{}, false
+	}
+	n, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return "", time.Time{}, false
+	}
+	expires := time.Unix(n, 0)
+	return parts[0], expires, expires.After(time.Now())
+}
+
+// Whether a session may do something needing scope. Without -invite-only
+// everyone can vote and request.
+func (s *Server) can(sess *Session, scope string) bool {
+	if sess != nil && sess.Admin {
+		return true
+	}
+	if !*inviteOnly && scopes[scope] < scopes["admin"] {
+		return true
+	}
+	if sess == nil || sess.ScopeExpires.Before(time.Now()) {
+		return false
+	}
+	return scopes[sess.Scope] >= scopes[scope]
+}
+
+// Wrap a handle so it needs an invite scope
+func (s *Server) guest(scope string, f func(w http.ResponseWriter, r *http.Request) error) func(w http.ResponseWriter, r *http.Request) error {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		if !sameSite(r) {
+			http.Error(w, "cross site request", http.StatusForbidden)
+			return nil
+		}
+		if !*inviteOnly && scopes[scope] < scopes["admin"] {
+			return f(w, r)
+		}
+		sess, err := s.cookieSession(r)
+		if err != nil {
+			return err
+		}
+		if !s.can(sess, scope) && !s.isAdmin(r) {
+			http.Error(w, "invite required", http.StatusForbidden)
+			return nil
+		}
+		return f(w, r)
+	}
+}
+
+// Invite handle, admins POST {"Scope": ..., "TTL": ...} for a link
+func (s *Server) invitesAPI(w http.ResponseWriter, r *http.Request) error {
+	if !s.isAdmin(r) {
+		http.Error(w, "admin only", http.StatusForbidden)
+		return nil
+	}
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return nil
+	}
+	var inv Invite
+	if err := json.NewDecoder(r.Body).Decode(&inv); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil
+	}
+	if scopes[inv.Scope] == 0 {
+		http.Error(w, "unknown scope", http.StatusBadRequest)
+		return nil
+	}
+	if inv.TTL <= 0 {
+		inv.TTL = 24 * 60 * 60
+	}
+
+	inv.Expires = time.Now().Add(time.Duration(inv.TTL) * time.Second).Truncate(time.Second)
+	inv.Token = s.inviteToken(inv.Scope, inv.Expires)
+	inv.URL = s.baseURL() + "/invite?token=" + url.QueryEscape(inv.Token)
+	inv.TTL = 0
+	log.Println("Invite: ", inv.Scope, inv.Expires)
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(&inv)
+}
+
+// Invite link handle, grants the session the invite's scope until it expires
+func (s *Server) invite(w http.ResponseWriter, r *http.Request) error {
+	scope, expires, ok := s.inviteCheck(r.FormValue("token"))
+	if !ok {
+		http.Error(w, "invite invalid or expired", http.StatusForbidden)
+		return nil
+	}
+	sess, err := s.session(r, w.Header())
+	if err != nil {
+		return err
+	}
+	// Keep a better invite that hasn't expired
+	if sess.ScopeExpires.Before(time.Now()) || scopes[scope] >= scopes[sess.Scope] {
+		sess.Scope, sess.ScopeExpires = scope, expires
+	}
+	if err := s.store.SaveSession(sess); err != nil {
+		return err
+	}
+	http.Redirect(w, r, "/", http.StatusFound)
+	return nil
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Longest singer name shown on the display
+const maxSingerName = 40
+
+// Titles of backing tracks, e.g. "Song (Karaoke Version)" or
+// "Song (In the Style of Artist)"
+var karaokeTitle = regexp.MustCompile(`(?i)\bkaraoke\b|[\(\[]\s*(in the style of|originally performed by)\b`)
+
+// Flag karaoke versions from their genre, title or file name
+func karaokeTags(tags map[string]string, title, name string) bool {
+	if strings.EqualFold(strings.TrimSpace(tags["genre"]), "karaoke") {
+		return true
+	}
+	return karaokeTitle.MatchString(title) || karaokeTitle.MatchString(name)
+}
+
+// A sign-up to sing a karaoke track. Turns is how many songs they'd
+// sung when they signed up, times in ms.
+type Singer struct {
+	ID    string
+	Name  string
+	Song  string
+	Time  int
+	Turns int
+
+	session string
+}
+
+// Karaoke mode and the singer queue, Songs are the tracks that can be
+// signed up for
+type Karaoke struct {
+	Enabled bool
+	Singing *Singer `json:",omitempty"`
+	Queue   []*Singer
+	Songs   []string `json:",omitempty"`
+}
+
+func (s *Server) karaokeLoad() error {
+	on, err := s.store.Setting("karaoke_mode")
+	if err != nil {
+		return err
+	}
+	s.songLock.Lock()
+	defer s.songLock.Unlock()
+	s.karaoke, _ = strconv.ParseBool(on)
+	return nil
+}
+
+// Karaoke state for clients, songLock must be held
+func (s *Server) karaokeState() *Karaoke {
+	return &Karaoke{
+		Enabled: s.karaoke,
+		Singing: s.songPlaying.Singer,
+		Queue:   append([]*Singer{}, s.singers...),
+	}
+}
+
+// Tell clients the queue changed, songLock must be held
+func (s *Server) karaokeSend() {
+	msg := &Message{Command: "karaoke", Karaoke: s.karaokeState()}
+	s.sockWriteLoop(msg)
+	s.emit(msg)
+}
+
+// Karaoke state between instances, with the sessions clients aren't
+// shown
+type karaokeSync struct {
+	Enabled bool
+	Singers []singerSync
+	Turns   map[string]int
+}
+
+type singerSync struct {
+	Singer
+	Session string
+}
+
+// Tell clients and other instances the queue or mode changed here, so
+// the leader calls singers who signed up anywhere. songLock must be
+// held.
+func (s *Server) karaokeChanged() {
+	s.karaokeSend()
+	v := karaokeSync{Enabled: s.karaoke, Turns: s.singerTurns}
+	for _, q := range s.singers {
+		v.Singers = append(v.Singers, singerSync{Singer: *q, Session: q.session})
+	}
+	data, err := json.Marshal(&v)
+	if err != nil {
+		log.Println("karaoke: ", err)
+		return
+	}
+	s.publish(&Message{Command: "karaoke", Data: data})
+}
+
+// Use the karaoke state from another instance
+func (s *Server) karaokeReceive(data []byte) {
+	var v karaokeSync
+	if err := json.Unmarshal(data, &v); err != nil {
+		log.Println("karaoke: ", err)
+		return
+	}
+	s.songLock.Lock()
+	defer s.songLock.Unlock()
+	s.karaoke = v.Enabled
+	s.singerTurns = v.Turns
+	if s.singerTurns == nil {
+		s.singerTurns = make(map[string]int)
+	}
+	s.singers = nil
+	for _, q := range v.Singers {
+		singer := q.Singer
+		singer.session = q.Session
+		s.singers = append(s.singers, &singer)
+	}
+	s.karaokeSend()
+}
+
+// Keep the queue fair: everyone sings once before anyone sings again,
+// then first come first served. songLock must be held.
+func (s *Server) karaokeSort() {
+	sort.SliceStable(s.singers, func(i, j int) bool {
+		a, b := s.singers[i], s.singers[j]
+		if a.Turns != b.Turns {
+			return a.Turns < b.Turns
+		}
+		return a.Time < b.Time
+	})
+}
+
+// Take the next singer whose song is still in the library, nil if
+// there's none or karaoke mode is off. songLock must be held.
+func (s *Server) karaokeNext() (string, *Singer) {
+	if !s.karaoke {
+		return "", nil
+	}
+	for len(s.singers) > 0 {
+		singer := s.singers[0]
+		s.singers = s.singers[1:]
+		name := s.canonical(singer.Song)
+		if !s.pool.Has(name) {
+			log.Println("Karaoke: Song gone, skipping ", singer.Name)
+			continue
+		}
+		s.singerTurns[singer.session]++
+		log.Println("Karaoke: ", singer.Name, name)
+		return name, singer
+	}
+	return "", nil
+}
+
+// Switch karaoke mode, turned on is a new night so turns start again
+func (s *Server) karaokeSet(on bool) error {
+	if err := s.store.SetSetting("karaoke_mode", strconv.FormatBool(on)); err != nil {
+		return err
+	}
+	s.songLock.Lock()
+	defer s.songLock.Unlock()
+	if on && !s.karaoke {
+		s.singerTurns = make(map[string]int)
+	}
+	s.karaoke = on
+	log.Println("Karaoke mode: ", on)
+	s.karaokeChanged()
+	return nil
+}
+
+// Karaoke handle, anyone can read the queue but only admins can switch
+// the mode
+func (s *Server) karaokeAPI(w http.ResponseWriter, r *http.Request) error {
+	switch r.Method {
+	case "GET":
+	case "POST", "PUT":
+		if !s.isAdmin(r) {
+			http.Error(w, "admin only", http.StatusForbidden)
+			return nil
+		}
+		var v Karaoke
+		if err := json.NewDecoder(r.Body).Decode(&v); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return nil
+		}
+		if err := s.karaokeSet(v.Enabled); err != nil {
+			return err
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return nil
+	}
+
+	s.songLock.Lock()
+	v := s.karaokeState()
+	if v.Enabled {
+		for name, ok := range s.songKaraoke {
+			if ok && s.pool.Has(name) {
+				v.Songs = append(v.Songs, name)
+			}
+		}
+	}
+	s.songLock.Unlock()
+	s.collate.Sort(v.Songs)
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(v)
+}
+
+// Why a session can't sign up for a song, "" if it can. songLock must
+// be held.
+func (s *Server) signUpRefused(session, song string, on bool) (string, int) {
+	switch {
+	case !on:
+		return "karaoke sign-up is switched off", http.StatusForbidden
+	case !s.karaoke:
+		return "karaoke mode is off", http.StatusConflict
+	case !s.songKaraoke[song] || !s.pool.Has(song):
+		return "not a karaoke track", http.StatusBadRequest
+	}
+	for _, q := range s.singers {
+		if q.session == session {
+			return "already signed up", http.StatusConflict
+		}
+		if q.Song == song {
+			return "song already signed up for", http.StatusConflict
+		}
+	}
+	return "", 0
+}
+
+// Singer handle, POST {"Name": ..., "Song": ...} to sign up and DELETE
+// /api/v1/karaoke/singers/{id} to drop out. One sign-up per session at a
+// time, and admins can drop anyone.
+func (s *Server) singersAPI(w http.ResponseWriter, r *http.Request) error {
+	sess, err := s.session(r, w.Header())
+	if err != nil {
+		return err
+	}
+
+	switch r.Method {
+	case "POST":
+		var v Singer
+		if err := json.NewDecoder(r.Body).Decode(&v); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return nil
+		}
+		v.Name = strings.TrimSpace(v.Name)
+		if v.Name == "" {
+			v.Name = sess.Name
+		}
+		if v.Name == "" || utf8.RuneCountInString(v.Name) > maxSingerName {
+			http.Error(w, "name required, up to "+strconv.Itoa(maxSingerName)+" characters", http.StatusBadRequest)
+			return nil
+		}
+
+		id, err := randomID() // Unique across instances
+		if err != nil {
+			return err
+		}
+		on := s.enabled("karaoke")
+
+		s.songLock.Lock()
+		v.Song = s.canonical(v.Song)
+		if reason, status := s.signUpRefused(sess.ID, v.Song, on); reason != "" {
+			s.songLock.Unlock()
+			http.Error(w, reason, status)
+			return nil
+		}
+		singer := &Singer{
+			ID:      id[:12],
+			Name:    v.Name,
+			Song:    v.Song,
+			Time:    int(makeTimestamp()),
+			Turns:   s.singerTurns[sess.ID],
+			session: sess.ID,
+		}
+		s.singers = append(s.singers, singer)
+		s.karaokeSort()
+		log.Println("Karaoke: Signed up ", singer.Name)
+		s.karaokeChanged()
+		v = *singer
+		s.songLock.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		return json.NewEncoder(w).Encode(&v)
+	case "DELETE":
+		id := strings.TrimPrefix(r.URL.Path, "/api/v1/karaoke/singers/")
+		admin := s.isAdmin(r)
+		s.songLock.Lock()
+		for i, q := range s.singers {
+			if q.ID != id {
+				continue
+			}
+			if q.session != sess.ID && !admin {
+				s.songLock.Unlock()
+				http.Error(w, "not your sign-up", http.StatusForbidden)
+				return nil
+			}
+			s.singers = append(s.singers[:i], s.singers[i+1:]...)
+			s.karaokeChanged()
+			s.songLock.Unlock()
+			return nil
+		}
+		s.songLock.Unlock()
+		http.NotFound(w, r)
+		return nil
+	}
+	http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	return nil
+}
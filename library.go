@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Library directory, -music until one is set from the browser
+var (
+	libraryLock = &sync.Mutex{}
+	libraryDir  = "Music"
+)
+
+func musicDir() string {
+	libraryLock.Lock()
+	defer libraryLock.Unlock()
+	return libraryDir
+}
+
+// Path of a song in the library
+func musicPath(name string) string {
+	return filepath.Join(musicDir(), name)
+}
+
+func setMusicDir(dir string) {
+	libraryLock.Lock()
+	defer libraryLock.Unlock()
+	libraryDir = dir
+}
+
+// Use the library directory saved from the browser, if there is one
+func (s *Server) libraryLoad() error {
+	dir, err := s.store.Setting("library_path")
+	if err != nil {
+		return err
+	}
+	if dir == "" {
+		dir = *musicFlag
+	}
+	setMusicDir(dir)
+	return nil
+}
+
+// Start a scan in the background, false if one is already going
+func (s *Server) rescan() bool {
+	if !s.scanClaim() {
+		return false
+	}
+	s.scanRun()
+	return true
+}
+
+// Claim the next scan, false if one is already going. It's held until
+// scanRun starts it or scanRelease gives it up.
+func (s *Server) scanClaim() bool {
+	s.scanLock.Lock()
+	defer s.scanLock.Unlock()
+	if s.scan.Scanning {
+		return false
+	}
+	s.scan.Scanning = true
+	return true
+}
+
+func (s *Server) scanRelease() {
+	s.scanLock.Lock()
+	s.scan.Scanning = false
+	s.scanLock.Unlock()
+}
+
+// Run a claimed scan in the background
+func (s *Server) scanRun() {
+	go func() {
+		if err := s.songGen(); err != nil {
+			log.Println(err)
+		}
+	}()
+}
+
+type LibraryConfig struct {
+	Path string // Directory on the server
+}
+
+// Library handle, GET the scan status and admins POST {"Path": ...} to
+// scan another directory
+func (s *Server) libraryAPI(w http.ResponseWriter, r *http.Request) error {
+	switch r.Method {
+	case "GET":
+	case "POST", "PUT":
+		if !s.isAdmin(r) {
+			http.Error(w, "admin only", http.StatusForbidden)
+			return nil
+		}
+		var v LibraryConfig
+		if err := json.NewDecoder(r.Body).Decode(&v); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return nil
+		}
+		if v.Path == "" {
+			http.Error(w, "path required", http.StatusBadRequest)
+			return nil
+		}
+		dir := filepath.Clean(v.Path)
+		if fi, err := os.Stat(dir); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return nil
+		} else if !fi.IsDir() {
+			http.Error(w, dir+" is not a directory", http.StatusBadRequest)
+			return nil
+		}
+		// The directory only changes once a scan of it can start
+		if !s.scanClaim() {
+			http.Error(w, "already scanning, try again when it's done", http.StatusConflict)
+			return nil
+		}
+		if err := s.store.SetSetting("library_path", dir); err != nil {
+			s.scanRelease()
+			return err
+		}
+		setMusicDir(dir)
+		log.Println("Library: ", dir)
+		s.scanRun()
+		w.WriteHeader(http.StatusAccepted)
+		return nil
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return nil
+	}
+
+	status := s.scanStatus()
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(&status)
+}
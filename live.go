@@ -0,0 +1,92 @@
+package main
+
+import "log"
+
+// Live audio is sent peer to peer over WebRTC, the server only relays the
+// signalling messages between the host and each listener.
+
+// Start broadcasting live audio from a user, holding the queue
+func (s *Server) liveStart(u *User) {
+	if !*liveInput {
+		log.Println("liveStart: Live input disabled")
+		return
+	}
+
+	s.sockLock.Lock()
+	if s.liveHost != nil && s.liveHost != u {
+		s.sockLock.Unlock()
+		log.Println("liveStart: Already live")
+		return
+	}
+	s.liveHost = u
+	s.sockLock.Unlock()
+
+	// Hold the queue, the playing song resumes when the set ends
+	s.songLock.Lock()
+	if s.liveAt == 0 {
+		s.liveAt = int(makeTimestamp())
+		s.schedule()
+	}
+	s.songLock.Unlock()
+
+	log.Println("Live: ", u.id)
+	s.sockWriteLoop(&Message{Command: "live", From: u.id})
+}
+
+// Stop a live broadcast, resuming the queue
+func (s *Server) liveEnd(u *User) {
+	s.sockLock.Lock()
+	if s.liveHost != u {
+		s.sockLock.Unlock()
+		return
+	}
+	s.liveHost = nil
+	s.sockLock.Unlock()
+
+	log.Println("Live ended: ", u.id)
+	s.sockWriteLoop(&Message{Command: "unlive", From: u.id})
+
+	// Resume the held song from where it stopped, or from its start if
+	// it began during the set
+	s.songLock.Lock()
+	defer s.songLock.Unlock()
+	if s.liveAt == 0 {
+		return
+	}
+	held := s.liveAt
+	if s.songPlaying.Time > held {
+		held = s.songPlaying.Time
+	}
+	msg := *s.songPlaying
+	msg.Time += int(makeTimestamp()) - held
+	s.songPlaying = &msg
+	s.liveAt = 0
+	s.schedule()
+	if msg.Song.Name != "" {
+		s.sockWriteLoop(&msg)
+	}
+}
+
+// Relay a WebRTC offer, answer or ICE candidate to another user
+func (s *Server) signal(u *User, msg Message) {
+	s.sockLock.Lock()
+	var to *User
+	for _, v := range s.sockUsers {
+		if v.id == msg.To {
+			to = v
+			break
+		}
+	}
+	s.sockLock.Unlock()
+
+	if to == nil {
+		log.Println("signal: Unknown user ", msg.To)
+		return
+	}
+	s.sockWriteUser(to, &Message{
+		Command: "signal",
+		From:    u.id,
+		To:      to.id,
+		Data:    msg.Data,
+	})
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Log lines kept for the admin console
+const logLines = 500
+
+// Recent log lines, written to alongside stderr
+type logRing struct {
+	lock  *sync.Mutex
+	lines []string
+	next  int
+	full  bool
+}
+
+var recentLogs = &logRing{lock: &sync.Mutex{}, lines: make([]string, logLines)}
+
+func (l *logRing) Write(p []byte) (int, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		l.lines[l.next] = line
+		l.next = (l.next + 1) % len(l.lines)
+		l.full = l.full || l.next == 0
+	}
+	return len(p), nil
+}
+
+// Last n lines, oldest first
+func (l *logRing) Tail(n int) []string {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	var lines []string
+	if l.full {
+		lines = append(lines, l.lines[l.next:]...)
+	}
+	lines = append(lines, l.lines[:l.next]...)
+	if n > 0 && len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return lines
+}
+
+// Log tail handle
+func (s *Server) logsAPI(w http.ResponseWriter, r *http.Request) error {
+	if !s.isAdmin(r) {
+		http.Error(w, "admin only", http.StatusForbidden)
+		return nil
+	}
+	n, err := strconv.Atoi(r.FormValue("lines"))
+	if err != nil || n <= 0 {
+		n = 100
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(recentLogs.Tail(n))
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"unicode/utf8"
+)
+
+// Largest playlist file accepted
+const maxPlaylistFile = 1 << 20
+
+// Entry read from an M3U or cue file
+type playlistEntry struct {
+	Line   int
+	Path   string
+	Title  string
+	Artist string
+}
+
+func (e playlistEntry) String() string {
+	if e.Title != "" {
+		if e.Artist != "" {
+			return e.Artist + " - " + e.Title
+		}
+		return e.Title
+	}
+	return e.Path
+}
+
+// Result of importing a playlist file
+type PlaylistImport struct {
+	Name      string
+	Songs     []string
+	Unmatched []Unmatched
+}
+
+// Entry that isn't in the library
+type Unmatched struct {
+	Line int
+	Text string
+}
+
+// Playlist files from other players are often Latin-1
+func playlistText(b []byte) string {
+	b = []byte(strings.TrimPrefix(string(b), "\ufeff"))
+	if utf8.Valid(b) {
+		return string(b)
+	}
+	r := make([]rune, len(b))
+	for i, c := range b {
+		r[i] = rune(c)
+	}
+	return string(r)
+}
+
+// Entries of an M3U, with artist and title from #EXTINF lines
+func parseM3U(text string) []playlistEntry {
+	var entries []playlistEntry
+	var info playlistEntry
+	sc := bufio.NewScanner(strings.NewReader(text))
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		switch {
+		case line == "":
+		case strings.HasPrefix(line, "#EXTINF:"):
+			info = playlistEntry{}
+			if i := strings.Index(line, ","); i >= 0 {
+				parts := strings.SplitN(line[i+1:], " - ", 2)
+				if len(parts) == 2 {
+					info.Artist, info.Title = strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+				} else {
+					info.Title = strings.TrimSpace(parts[0])
+				}
+			}
+		case strings.HasPrefix(line, "#"):
+		default:
+			info.Line, info.Path = n, line
+			entries = append(entries, info)
+			info = playlistEntry{}
+		}
+	}
+	return entries
+}
+
+// Tracks of a cue sheet, each with the file it's in
+func parseCue(text string) []playlistEntry {
+	var entries []playlistEntry
+	var file, performer string
+	sc := bufio.NewScanner(strings.NewReader(text))
+	for n := 1; sc.Scan(); n++ {
+		fields := strings.SplitN(strings.TrimSpace(sc.Text()), " ", 2)
+		if len(fields) < 2 {
+			continue
+		}
+		arg := cueArg(fields[1])
+		switch strings.ToUpper(fields[0]) {
+		case "FILE":
+			// FILE "name" WAVE, the type follows the name
+			file = arg
+			if i := strings.LastIndex(fields[1], " "); i > 0 && !strings.HasPrefix(fields[1], "\"") {
+				file = fields[1][:i]
+			}
+		case "TRACK":
+			entries = append(entries, playlistEntry{Line: n, Path: file, Artist: performer})
+		case "TITLE":
+			if len(entries) > 0 {
+				entries[len(entries)-1].Title = arg
+			}
+		case "PERFORMER":
+			if len(entries) > 0 {
+				entries[len(entries)-1].Artist = arg
+			} else {
+				performer = arg // Album artist
+			}
+		}
+	}
+	return entries
+}
+
+// Quoted cue argument
+func cueArg(s string) string {
+	if strings.HasPrefix(s, "\"") {
+		if i := strings.Index(s[1:], "\""); i >= 0 {
+			return s[1 : i+1]
+		}
+	}
+	return s
+}
+
+// Matches entries to library songs by path, then by file name, then by
+// searching for the artist and title
+type resolver struct {
+	s     *Server
+	paths map[string]string // Lower case path to pool name
+	bases map[string]string // Lower case file name, "" if ambiguous
+	used  map[string]bool   // Cue files already added
+}
+
+func (s *Server) newResolver() *resolver {
+	r := &resolver{
+		s:     s,
+		paths: make(map[string]string),
+		bases: make(map[string]string),
+		used:  make(map[string]bool),
+	}
+	s.songLock.Lock()
+	defer s.songLock.Unlock()
+	add := func(name string) {
+		pool := s.canonical(name)
+		key := strings.ToLower(name)
+		r.paths[key] = pool
+		base := path.Base(key)
+		if other, ok := r.bases[base]; ok && other != pool {
+			r.bases[base] = ""
+		} else {
+			r.bases[base] = pool
+		}
+	}
+	for name := range s.songTrack {
+		add(name)
+	}
+	for _, song := range s.pool.All() {
+		add(song.Name)
+	}
+	return r
+}
+
+func (r *resolver) byPath(p string) string {
+	if u, err := url.Parse(p); err == nil && u.Scheme != "" && len(u.Scheme) > 1 {
+		p = u.Path
+		p = strings.TrimPrefix(p, "/audio")
+	}
+	p = strings.ToLower(strings.Replace(p, "\\", "/", -1))
+	// Longest suffix of the path that's a library name
+	for q := strings.TrimPrefix(p, "/"); q != ""; {
+		if name, ok := r.paths[q]; ok {
+			return name
+		}
+		i := strings.Index(q, "/")
+		if i < 0 {
+			break
+		}
+		q = q[i+1:]
+	}
+	return r.bases[path.Base(p)]
+}
+
+func (r *resolver) bySearch(e playlistEntry) string {
+	if e.Title == "" {
+		return ""
+	}
+	names, err := r.s.store.Search(strings.TrimSpace(e.Artist+" "+e.Title), 1)
+	if err != nil || len(names) == 0 {
+		return ""
+	}
+	key := strings.ToLower(names[0])
+	return r.paths[key]
+}
+
+func (r *resolver) resolve(e playlistEntry, cue bool) string {
+	if cue {
+		// Cue tracks are often parts of one file, only use the
+		// file if the track isn't in the library on its own
+		if name := r.bySearch(e); name != "" {
+			return name
+		}
+		if name := r.byPath(e.Path); name != "" && !r.used[name] {
+			r.used[name] = true
+			return name
+		}
+		return ""
+	}
+	if name := r.byPath(e.Path); name != "" {
+		return name
+	}
+	return r.bySearch(e)
+}
+
+// Import an M3U or cue file into a playlist, replacing it. Entries not
+// in the library are reported.
+func (s *Server) playlistImport(w http.ResponseWriter, r *http.Request, name, format string) error {
+	data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxPlaylistFile))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return nil
+	}
+	text := playlistText(data)
+
+	var entries []playlistEntry
+	cue := format == "cue"
+	if cue {
+		entries = parseCue(text)
+	} else {
+		entries = parseM3U(text)
+	}
+
+	res := s.newResolver()
+	result := PlaylistImport{Name: name, Songs: []string{}, Unmatched: []Unmatched{}}
+	for _, e := range entries {
+		if song := res.resolve(e, cue); song != "" {
+			result.Songs = append(result.Songs, song)
+		} else if !cue || !res.used[res.byPath(e.Path)] {
+			result.Unmatched = append(result.Unmatched, Unmatched{Line: e.Line, Text: e.String()})
+		}
+	}
+	if err := s.store.SavePlaylist(name, result.Songs); err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(&result)
+}
+
+// Write songs as an extended M3U. Entries are stream URLs unless local
+// is set, then paths relative to the Music directory.
+func (s *Server) writeM3U(w http.ResponseWriter, filename string, songs []string, local bool) error {
+	w.Header().Set("Content-Type", "audio/x-mpegurl; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename+".m3u8"))
+	b := bufio.NewWriter(w)
+	fmt.Fprintln(b, "#EXTM3U")
+	for _, name := range songs {
+		e := playlistEntry{Title: strings.TrimSuffix(path.Base(name), path.Ext(name))}
+		if m, err := s.store.Meta(name); err == nil && m != nil {
+			e.Title, e.Artist = m.Title, m.Artist
+		}
+		fmt.Fprintf(b, "#EXTINF:-1,%s\n", m3uText(e.String()))
+		if local {
+			fmt.Fprintln(b, m3uText(name))
+		} else {
+			fmt.Fprintln(b, s.baseURL()+"/audio/"+(&url.URL{Path: name}).EscapedPath())
+		}
+	}
+	return b.Flush()
+}
+
+// Text for one M3U line, so tags can't add lines of their own
+func m3uText(s string) string {
+	return strings.NewReplacer("\r", " ", "\n", " ").Replace(s)
+}
+
+// Whether a request asks for M3U
+func wantM3U(r *http.Request) bool {
+	f := r.FormValue("format")
+	return f == "m3u" || f == "m3u8"
+}
@@ -2,26 +2,74 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"html/template"
+	"io"
 	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
-	"net/url"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"runtime"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
+	"github.com/emcfarlane/jukebox/core"
 	"github.com/gorilla/websocket" // Websockets
 )
 
 var (
 	debug    = flag.Bool("debug", false, "Debug flag")
+	voteRate = flag.Int("vote-rate", 30, "Max votes per user per minute, 0 for no limit")
+
+	frameAncestors = flag.String("frame-ancestors", "'self'", "Origins allowed to embed the widget")
+	liveInput      = flag.Bool("live", true, "Allow live WebRTC audio input")
+	dbPath         = flag.String("db", "jukebox.db", "SQLite database path or postgres:// URL")
+	scanWorkers    = flag.Int("scan-workers", runtime.NumCPU(), "Files to scan in parallel")
+	cacheDir       = flag.String("cache-dir", "cache", "Directory for transcoded and generated files")
+	cacheSize      = flag.Int64("cache-size", 1024, "Cache size limit in MB")
+	ffmpeg         = flag.String("ffmpeg", "ffmpeg", "ffmpeg binary used for transcoding")
+	tts            = flag.String("tts", "espeak-ng --stdout", "Text to speech command, writes WAV to stdout")
+	rateConn       = flag.Int("rate-conn", 0, "Audio bandwidth cap per connection in KB/s, 0 for none")
+	rateTotal      = flag.Int("rate-total", 0, "Audio bandwidth cap for all connections in KB/s, 0 for none")
+	sessionTTL     = flag.Duration("session-ttl", 30*24*time.Hour, "Time before an unused session expires")
+	busURL         = flag.String("bus", "", "Redis URL shared by jukebox instances, empty for a single instance")
+	busChannel     = flag.String("bus-channel", "jukebox", "Channel and key prefix on the bus")
+	nowPlayingDir  = flag.String("nowplaying", "", "Directory to write nowplaying.txt and .json to on every track change")
+	webhookURL     = flag.String("webhook", "", "URL to POST play, vote and other events to")
+	tunnelKind     = flag.String("tunnel", "", "Public tunnel for remote guests, tailscale or ngrok")
+	roomName       = flag.String("room", "main", "Room for scores, instances in a room share them")
+	adminToken     = flag.String("admin-token", "", "Token to log in as an admin, empty disables admin")
+	explicitURL    = flag.String("explicit-lookup", "", "URL to look up explicit songs by artist and title")
+	inviteOnly     = flag.Bool("invite-only", false, "Only allow sessions with an invite link")
+	probeFiles     = flag.Bool("probe", true, "Decode files when scanning to quarantine corrupt or silent ones")
+	skipRatio      = flag.Float64("skip-ratio", 0.5, "Share of listening clients that must vote to skip a song")
+
+	subsonicPassword = flag.String("subsonic-password", "", "Password for Subsonic clients, empty disables the Subsonic API")
+
+	zipMax = flag.Int("zip-max", 4096, "Largest playlist ZIP export in MB, 0 for no limit")
+
+	musicFlag = flag.String("music", "Music", "Library directory, until one is set from the browser")
+
+	pushContact = flag.String("push-contact", "", "mailto: or https: contact for Web Push services, empty disables push")
+
+	scoreMode = flag.String("scoring", "net", "How votes rank songs: net, wilson or veto")
+	vetoDown  = flag.Float64("veto", 3, "Down votes that send a song to the bottom with -scoring veto")
+
+	localeFlag = flag.String("locale", "", "Language to sort names in, e.g. sv, empty sorts ignoring case and accents")
+
+	configPath = flag.String("config", "", "JSON file of settings to use over the flags, reread on SIGHUP")
+
+	allowRequests = flag.Bool("requests", false, "Let guests request songs by uploading audio files")
+
 	upgrader = websocket.Upgrader{
 		ReadBufferSize:  1024,
 		WriteBufferSize: 1024,
@@ -38,6 +86,14 @@ func errorHandler(f func(w http.ResponseWriter, r *http.Request) error) http.Han
 	}
 }
 
+// Address guests should use, the tunnel if there is one
+func (s *Server) baseURL() string {
+	if s.public != "" {
+		return s.public
+	}
+	return "http://" + s.addrs
+}
+
 // Single file serving
 func (s *Server) sServe(pattern string, filename string) {
 	http.HandleFunc(pattern, func(w http.ResponseWriter, r *http.Request) {
@@ -47,51 +103,189 @@ func (s *Server) sServe(pattern string, filename string) {
 
 type Song struct {
 	Name  string
-	Score int
+	Score float64
+	Hints *Hints `json:",omitempty"`
+	Track string `json:",omitempty"` // Canonical track ID
+
+	// Weight of up and down votes since it last played
+	Up   float64 `json:",omitempty"`
+	Down float64 `json:",omitempty"`
 }
 
 type State struct {
 	Address string
 	Songs   []Song
 	Playing string
+	URL     string // Base URL, as seen from outside
 }
 
 type Message struct {
 	Command string
 	Song    Song
 	Time    int
+
+	ID    string `json:",omitempty"` // Client command ID, echoed in its ack
+	Error string `json:",omitempty"` // Why an acked command wasn't applied
+
+	Votes    []Message   `json:",omitempty"`
+	Rejected []Rejection `json:",omitempty"`
+
+	Epoch    int `json:",omitempty"` // Counts plays, a next must name the one it ends
+	Duration int `json:",omitempty"` // Of the song played, ms
+	Ends     int `json:",omitempty"` // When the server moves on, ms
+	Version  int `json:",omitempty"` // Library version, see libraryVersion
+
+	Scan  *ScanStatus `json:",omitempty"`
+	Name  string      `json:",omitempty"` // Display name
+	Songs []Song      `json:",omitempty"`
+
+	Weight   float64       `json:",omitempty"` // How much a vote counted
+	Sleep    *Sleep        `json:",omitempty"`
+	Family   *bool         `json:",omitempty"` // Family mode switched
+	Announce *Announcement `json:",omitempty"` // Played instead of a song
+	Presence *Presence     `json:",omitempty"`
+	Skips    *Skips        `json:",omitempty"`
+	Singer   *Singer       `json:",omitempty"` // Singing the song played
+	Karaoke  *Karaoke      `json:",omitempty"`
+	Config   *Config       `json:",omitempty"` // What clients use of it
+
+	// WebRTC signalling between users
+	From int             `json:",omitempty"`
+	To   int             `json:",omitempty"`
+	Data json.RawMessage `json:",omitempty"`
+}
+
+// Vote refused by a merge
+type Rejection struct {
+	Vote   Message
+	Reason string
+}
+
+// Websocket user
+type User struct {
+	id      int
+	conn    *websocket.Conn
+	session *Session
+	heard   time.Time // Last listening heartbeat
+	ip      string    // Empty if only known to be local
+
+	// For the connections API
+	addr      string
+	connected time.Time
+	active    atomic.Int64 // ms
+	rtt       atomic.Int64 // ns
+	sent      atomic.Int64
+	received  atomic.Int64
 }
 
 type Server struct {
 	songLock    *sync.Mutex
-	songMap     map[string]int
+	pool        *core.Pool
+	songHints   map[string]*Hints
 	songList    []Song
 	songPlaying *Message
 
+	songExplicit map[string]bool
+	songKaraoke  map[string]bool
+	songDuration map[string]int
+	family       bool // Hide explicit songs
+
+	songTrack   map[string]string  // Canonical track of each name
+	trackSong   map[string]string  // Name in the pool for each track
+	trackScores map[string]float64 // This room's scores
+	titleSong   map[string]string  // Name in the pool for each artist and title
+
+	sleep      Sleep
+	sleepTimer *time.Timer
+
+	advance *time.Timer // Next song once this one ends
+	liveAt  int         // When a live set held the queue, ms, 0 if not
+
+	version      int // Library version, see libraryVersion
+	versionDirty bool
+	versionTimer *time.Timer
+
+	skipEpoch int             // Play the votes are for
+	skipVotes map[string]bool // By session, so tabs aren't counted twice
+
+	night night // For the recap
+
+	announceQueue []*Announcement
+	announceMap   map[string]*Announcement // Queued and playing, by ID
+
+	karaoke     bool           // Karaoke mode, singers go before the pool
+	singers     []*Singer      // Sign-ups in singing order
+	singerTurns map[string]int // Songs sung, by session
+
 	sockLock  *sync.Mutex
-	sockUsers []*websocket.Conn
+	sockUsers []*User
+	sockNext  int   // Next user id
+	liveHost  *User // User broadcasting live audio
+
+	scanLock *sync.Mutex
+	scan     ScanStatus
+	scanSent time.Time
+
+	addrs  string
+	public string // Tunnel URL, if any
+	tmpl   *template.Template
+	store  Store
+	cache  *Cache
+	bus    Bus // Nil for a single instance
+
+	bandwidth *limiter // Shared audio bandwidth cap
+
+	configLock *sync.Mutex
+	config     Config
+	quietTimer *time.Timer
+
+	commands *dedup // Command IDs already applied
+	abuse    *abuse
+
+	requestQuota *requestQuota
+
+	collate *core.Collator // Name order
+
+	pluginLock *sync.Mutex
+	plugins    []*pluginRunner
+	shutdown   hooks
+	push       *pusher // Nil if Web Push is off
+
+	weightLock *sync.Mutex
+	weights    Weights
 
-	addrs string
-	tmpl  *template.Template
+	sessionKey []byte // Cookie signing key
+	inviteKey  []byte // Invite signing key, from sessionKey
+
+	ctx  context.Context // Done on shutdown, parent of requests and scans
+	stop context.CancelFunc
 }
 
-func (s *Server) plus(song Song) {
-	s.songUpdate(song, +1)
+func (s *Server) plus(song Song, weight float64) {
+	s.songUpdate(song, +weight, true)
 }
-func (s *Server) minus(song Song) {
-	s.songUpdate(song, -1)
+func (s *Server) minus(song Song, weight float64) {
+	s.songUpdate(song, -weight, true)
 }
 
-func (s *Server) songUpdate(song Song, i int) {
+// Apply a vote, record is false for votes logged by another instance
+func (s *Server) songUpdate(song Song, i float64, record bool) {
 	s.songLock.Lock()
 	defer s.songLock.Unlock()
 
-	s.songMap[song.Name] = s.songMap[song.Name] + i
-	song.Score = s.songMap[song.Name]
+	song.Score = s.pool.Vote(song.Name, i)
+	t := s.pool.Tally(song.Name)
+	song.Up, song.Down = t.Up, t.Down
+	s.libraryChanged()
+	s.scoreSave(song.Name, song.Score)
+	if record {
+		s.record(core.EventVote, song.Name, i, int(makeTimestamp()))
+	}
 
 	msg := &Message{
 		Command: "update",
 		Song:    song,
+		Weight:  i,
 	}
 
 	log.Println(s.sockUsers)
@@ -102,49 +296,74 @@ func makeTimestamp() int64 {
 	return time.Now().UnixNano() / int64(time.Millisecond)
 }
 
-func (s *Server) next(song Song) {
+// Play the next song, if epoch is still the playing one
+func (s *Server) next(song Song, epoch int) {
 	s.songLock.Lock()
 	defer s.songLock.Unlock()
-	if song.Name != s.songPlaying.Song.Name && s.songPlaying.Song.Name != "" {
-		log.Println("Error: Should not call next")
+	if epoch != s.songPlaying.Epoch {
+		log.Println("next: Stale epoch ", epoch)
 		return
 	}
-	// Find next song
-	var topSong string
-
-	// Random first song
-	for key, _ := range s.songMap {
-		topSong = key
-		break
+	if s.sleep.Stopped {
+		return
 	}
-
-	// Generate next values
-	for key, value := range s.songMap {
-		if value >= s.songMap[topSong] {
-			topSong = key
+	if s.sleep.AfterSong && s.songPlaying.Song.Name != "" {
+		s.sleepStop()
+		return
+	}
+	if s.announcePlay() {
+		return
+	}
+	// Find next song, singers go first in karaoke mode
+	name, singer := s.karaokeNext()
+	if singer == nil {
+		var ok bool
+		if name, ok = s.pool.Next(); !ok {
+			log.Println("next: No songs to play")
+			return
 		}
 	}
-	song.Name = topSong
+	song.Name = name
 
 	// Update
-	s.songMap[song.Name] = 0
-	song.Score = s.songMap[song.Name]
+	now := int(makeTimestamp())
+	s.pool.Play(song.Name, now)
+	s.libraryChanged()
+	s.record(core.EventPlay, song.Name, 0, now)
+	s.nightPlay(now)
+	s.scoreSave(song.Name, 0)
+	song.Score = 0
+	song.Hints = s.songHints[song.Name]
 	msg := &Message{
-		Command: "play",
-		Song:    song,
-		Time:    int(makeTimestamp()),
+		Command:  "play",
+		Song:     song,
+		Time:     now,
+		Epoch:    epoch + 1,
+		Duration: s.songDuration[song.Name],
+		Singer:   singer,
 	}
 
 	log.Println("Now Playing: ", song.Name)
+	play := Play{Song: song.Name, Track: s.songTrack[song.Name], Room: *roomName, Time: msg.Time}
+	if err := s.store.RecordPlay(play); err != nil {
+		log.Println("next: ", err)
+	}
 	s.songPlaying = msg
+	s.schedule()
 	s.sockWriteLoop(msg)
+	s.publish(msg)
+	s.emit(msg)
+	if s.karaoke {
+		s.karaokeChanged() // The leader took a singer
+	}
+	go s.nowPlayingWrite(msg)
 }
 
-func (s *Server) sockPopUser(c *websocket.Conn) {
+func (s *Server) sockPopUser(u *User) {
 	s.sockLock.Lock()
 	defer s.sockLock.Unlock()
 	for i := range s.sockUsers {
-		if s.sockUsers[i] == c {
+		if s.sockUsers[i] == u {
 			s.sockUsers = append(s.sockUsers[:i], s.sockUsers[i+1:]...)
 			break
 		}
@@ -152,55 +371,169 @@ func (s *Server) sockPopUser(c *websocket.Conn) {
 }
 
 // Sock read loop
-func (s *Server) sockReadLoop(c *websocket.Conn) {
-	var msg Message
+func (s *Server) sockReadLoop(u *User) {
+	c := u.conn
+	c.SetReadLimit(maxMessageSize)
+	bad := 0
 	for {
-		if err := websocket.ReadJSON(c, &msg); err != nil {
+		_, data, err := c.ReadMessage()
+		if err != nil {
 			log.Println("SOCKET ERROR!")
-			log.Println(msg)
-			s.sockPopUser(c)
+			log.Println(err)
+			s.sockPopUser(u)
+			s.liveEnd(u)
 			c.Close()
 			break
 		}
-		log.Println("sockReadLoop: Commad: ", msg.Command)
-		switch msg.Command {
-		case "plus":
-			s.plus(msg.Song)
-		case "minus":
-			s.minus(msg.Song)
-		case "next":
-			if msg.Song.Name != s.songPlaying.Song.Name && s.songPlaying.Song.Name != "" {
-				log.Println("New Stream")
-				log.Println(msg.Song.Name)
-				s.sockLock.Lock()
-				websocket.WriteJSON(c, s.songPlaying)
-				s.sockLock.Unlock()
-				log.Println(s.songPlaying.Command)
-			} else {
-				log.Println("New song")
-				s.next(msg.Song)
+		u.received.Add(1)
+		u.touch()
+		msg, err := decodeMessage(data)
+		if err != nil {
+			log.Println("sockReadLoop: Bad message, ", err)
+			s.ack(u, msg.ID, "bad message")
+			// Drop clients that keep sending junk
+			if bad++; bad >= maxBadMessages {
+				c.Close()
 			}
-		default:
-			log.Println("sockReadLoop: Command unknown, ", msg.Command)
+			continue
 		}
+		s.sockHandle(u, msg)
 	}
 }
 
+// Handle a decoded message
+func (s *Server) sockHandle(u *User, msg Message) {
+	log.Println("sockReadLoop: Commad: ", msg.Command)
+	if reason := s.abuseCommand(u, msg); reason != "" {
+		log.Println("sockReadLoop: Refused, ", reason)
+		s.ack(u, msg.ID, reason)
+		return
+	}
+	scope := commandScope[msg.Command]
+	if scope == "" {
+		scope = "vote"
+	}
+	if !s.can(u.session, scope) {
+		log.Println("sockReadLoop: Not allowed, ", msg.Command)
+		s.ack(u, msg.ID, "not allowed")
+		return
+	}
+	// Retried after a reconnect
+	if !s.fresh(u, msg.ID) {
+		log.Println("sockReadLoop: Duplicate, ", msg.ID)
+		s.ack(u, msg.ID, "duplicate")
+		return
+	}
+	var reason string
+	switch msg.Command {
+	case "plus", "minus":
+		now := int(makeTimestamp())
+		if !s.allow(u, now) {
+			log.Println("sockReadLoop: Vote rate limited")
+			reason = "rate limited"
+			break
+		}
+		if !s.votable(msg.Song.Name) {
+			log.Println("sockReadLoop: Vote for hidden song")
+			reason = "explicit"
+			break
+		}
+		s.vote(u, msg, now)
+	case "merge":
+		s.merge(u, msg.Votes)
+	case "live":
+		if !s.enabled("live") {
+			reason = "disabled"
+			break
+		}
+		s.liveStart(u)
+	case "unlive":
+		s.liveEnd(u)
+	case "signal":
+		s.signal(u, msg)
+	case "hints":
+		s.hints(msg.Song)
+	case "name":
+		s.rename(u, msg.Name)
+	case "sleep":
+		s.sleepCommand(msg.Sleep)
+	case "listening":
+		s.listening(u, msg.Song.Name)
+	case "skip":
+		if !s.enabled("skip") {
+			reason = "disabled"
+			break
+		}
+		reason = s.skip(u, msg.Song.Name)
+	case "state":
+		s.sockWriteUser(u, s.state())
+	case "next":
+		var playing *Message
+		if reason, playing = s.nextRefused(msg.Epoch); reason != "" {
+			// Catch the client up, a new one asks with no epoch
+			s.sockWriteUser(u, playing)
+		} else if s.leader() {
+			log.Println("New song")
+			s.next(msg.Song, msg.Epoch)
+		} else {
+			s.publish(&Message{Command: "next", Song: msg.Song, Epoch: msg.Epoch})
+		}
+	default:
+		log.Println("sockReadLoop: Command unknown, ", msg.Command)
+		reason = "unknown command"
+	}
+	if reason != "" {
+		s.refused(u, msg.ID)
+	} else {
+		s.applied(u, msg.ID)
+	}
+	s.ack(u, msg.ID, reason)
+}
+
 // Sock write
 func (s *Server) sockWriteLoop(data interface{}) {
 	s.sockLock.Lock()
 	defer s.sockLock.Unlock()
-	for i := range s.sockUsers {
-		c := s.sockUsers[i]
-		if err := websocket.WriteJSON(c, data); err != nil {
+	for _, u := range s.sockUsers {
+		if err := u.writeJSON(data); err != nil {
 			log.Println("sockWriteLoop: Error wrting json, ", err)
 		}
 	}
 }
 
+// Close every websocket, they aren't closed by the http server's shutdown
+func (s *Server) sockCloseAll() {
+	s.sockLock.Lock()
+	defer s.sockLock.Unlock()
+	for _, u := range s.sockUsers {
+		u.conn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseGoingAway, "shutting down"), time.Now().Add(time.Second))
+		u.conn.Close()
+	}
+}
+
+// Sock write to a single user
+func (s *Server) sockWriteUser(u *User, data interface{}) {
+	s.sockLock.Lock()
+	defer s.sockLock.Unlock()
+	if err := u.writeJSON(data); err != nil {
+		log.Println("sockWriteUser: Error wrting json, ", err)
+	}
+}
+
 // Websocket handles
 func (s *Server) sock(w http.ResponseWriter, r *http.Request) error {
-	c, err := upgrader.Upgrade(w, r, nil)
+	h := http.Header{}
+	sess, err := s.session(r, h)
+	if err != nil {
+		return err
+	}
+	ip := clientIP(r)
+	if b := s.abuseConnect(ip, sess.ID, s.isAdmin(r)); b != nil {
+		banError(w, b)
+		return nil
+	}
+	c, err := upgrader.Upgrade(w, r, h)
 	if err != nil {
 		return err
 	}
@@ -209,46 +542,140 @@ func (s *Server) sock(w http.ResponseWriter, r *http.Request) error {
 	// Log
 	log.Println("sock: Got new user!")
 
-	// Read
-	go s.sockReadLoop(c)
+	u := &User{conn: c, session: sess, ip: ip, addr: r.RemoteAddr, connected: time.Now()}
+	u.touch()
 
-	// Write
+	s.songLock.Lock()
+	family := s.family
+	sleep := s.sleep
+	s.songLock.Unlock()
+	config := s.clientConfig()
+
+	// Register before reading, so a quick disconnect finds u to pop
 	s.sockLock.Lock()
 	defer s.sockLock.Unlock()
-	s.sockUsers = append(s.sockUsers, c)
+	s.sockNext++
+	u.id = s.sockNext
+	s.sockUsers = append(s.sockUsers, u)
 
-	return nil
-}
+	// Read
+	go s.sockReadLoop(u)
+	go s.sockPing(u)
+
+	// Write
+
+	if err := u.writeJSON(&Message{Command: "session", Name: sess.Name}); err != nil {
+		log.Println("sock: Error wrting json, ", err)
+	}
+
+	// Library still loading, or there's none yet
+	if status := s.scanStatus(); status.Scanning || status.Missing || status.Empty {
+		if err := u.writeJSON(&Message{Command: "scan", Scan: &status}); err != nil {
+			log.Println("sock: Error wrting json, ", err)
+		}
+	}
+
+	if config != nil {
+		if err := u.writeJSON(&Message{Command: "config", Config: config}); err != nil {
+			log.Println("sock: Error wrting json, ", err)
+		}
+	}
+	if family {
+		if err := u.writeJSON(&Message{Command: "family", Family: &family}); err != nil {
+			log.Println("sock: Error wrting json, ", err)
+		}
+	}
+	if sleep.active() {
+		if err := u.writeJSON(&Message{Command: "sleep", Sleep: &sleep}); err != nil {
+			log.Println("sock: Error wrting json, ", err)
+		}
+	}
 
-// Song generation
-var isAudio = map[string]bool{
-	".mp3": true,
-	".ogg": true,
-	".wav": true,
+	// Join a live broadcast in progress
+	if s.liveHost != nil {
+		if err := u.writeJSON(&Message{Command: "live", From: s.liveHost.id}); err != nil {
+			log.Println("sock: Error wrting json, ", err)
+		}
+	}
+
+	return nil
 }
 
+// Scan the library in the background, songs are added as they are found
 func (s *Server) songGen() error {
-	s.songLock.Lock()
-	defer s.songLock.Unlock()
-
 	// Folders to serch for music... Need to expand to many files
-	files, err := ioutil.ReadDir("Music")
+	dir := musicDir()
+	files, err := ioutil.ReadDir(dir)
 	if err != nil {
+		// Keep the pool, the directory may only be unmounted, until
+		// the music is found or moved from the browser
+		s.scanLock.Lock()
+		s.scan = ScanStatus{Library: dir, Missing: os.IsNotExist(err)}
+		s.scanLock.Unlock()
+		s.scanDone(err)
 		return err
 	}
 
-	// Add files to library
+	var names []string
 	for i := range files {
-		if !files[i].IsDir() && isAudio[strings.ToLower(filepath.Ext(files[i].Name()))] {
-			s.songMap[files[i].Name()] = 0
+		// Hidden files, like uploads still being checked
+		if files[i].IsDir() || strings.HasPrefix(files[i].Name(), ".") {
+			continue
+		}
+		// Files with other extensions are checked by their content
+		name := files[i].Name()
+		if audioExts[strings.ToLower(filepath.Ext(name))] != "" || sniffAudio(musicPath(name)) {
+			names = append(names, name)
 		}
 	}
-	return nil
+
+	// Skip files already found to be bad
+	bad, err := s.quarantined()
+	if err != nil {
+		log.Println(err)
+	}
+	var good []string
+	for _, name := range names {
+		if !bad[name] {
+			good = append(good, name)
+		}
+	}
+	s.scanStart(dir, len(good))
+
+	// Hashes of files unchanged since they were indexed
+	stamps, err := s.store.Stamps()
+	if err != nil {
+		log.Println(err)
+	}
+	for name, st := range stamps {
+		s.cache.remember(musicPath(name), st)
+	}
+
+	// Add files to library
+	probeInit()
+	s.scanFiles(good, stamps)
+
+	// Songs replayed from the log that have been deleted
+	s.songLock.Lock()
+	s.songPrune(names)
+	s.songLock.Unlock()
+
+	err = s.store.Prune(names)
+	if len(names) == 0 {
+		log.Println("Library empty: ", dir)
+		s.scanLock.Lock()
+		s.scan.Empty = true
+		s.scanLock.Unlock()
+	}
+	s.scanDone(err)
+	return err
 }
 
 type Dukebox struct {
 	Address string
+	Public  string
 	Songs   []Song
+	Scan    ScanStatus
 }
 
 func (s *Server) pageGen() (*bytes.Reader, error) {
@@ -256,13 +683,15 @@ func (s *Server) pageGen() (*bytes.Reader, error) {
 	defer s.songLock.Unlock()
 
 	var songs []Song
-	for key, value := range s.songMap {
-		songs = append(songs, Song{Name: key, Score: value})
+	for _, song := range s.pool.Songs() {
+		songs = append(songs, Song{Name: song.Name, Score: song.Score, Up: song.Up, Down: song.Down})
 	}
 
 	data := &Dukebox{
 		Address: s.addrs,
+		Public:  s.public,
 		Songs:   songs,
+		Scan:    s.scanStatus(),
 	}
 
 	b := new(bytes.Buffer)
@@ -275,21 +704,33 @@ func (s *Server) pageGen() (*bytes.Reader, error) {
 
 // Http handles
 func (s *Server) client(w http.ResponseWriter, r *http.Request) error {
+	if _, err := s.session(r, w.Header()); err != nil {
+		return err
+	}
 	content, err := s.pageGen()
 	http.ServeContent(w, r, ".html", time.Now(), content)
 	return err
 }
 func (s *Server) audio(w http.ResponseWriter, r *http.Request) error {
-	path, err := url.QueryUnescape(strings.TrimPrefix(r.URL.String(), "/audio"))
-	if err != nil {
-		return err
+	w = s.throttle(w, r)
+	path := strings.TrimPrefix(r.URL.Path, "/audio")
+	fm := s.songFormat(strings.TrimPrefix(path, "/"))
+	format := r.FormValue("format")
+	if format == "" && fm.Codec != "" && !fm.playable() {
+		format = "mp3" // Browsers can't play it as it is
 	}
-	f, err := os.Open("Music" + path)
-	defer f.Close()
+	if format != "" {
+		return s.audioTranscoded(w, r, musicDir()+path, format, fm, s.songHintsFor(r, strings.TrimPrefix(path, "/")))
+	}
+	f, err := os.Open(musicDir() + path)
 	if err != nil {
 		return err
 	}
+	defer f.Close()
 	log.Println("Audio Request!")
+	if t := containerTypes[fm.Container]; t != "" {
+		w.Header().Set("Content-Type", t)
+	}
 
 	//w.Header().Set("X-Content-Duration", string(20))
 	//w.WriteHeader(http.StatusPartialContent)
@@ -300,6 +741,22 @@ func (s *Server) audio(w http.ResponseWriter, r *http.Request) error {
 }
 
 func main() {
+	flag.Parse()
+	log.SetOutput(io.MultiWriter(os.Stderr, recentLogs))
+
+	if flag.Arg(0) == "replay" {
+		if err := replayCommand(flag.Args()[1:]); err != nil {
+			fmt.Printf("Oops: %v\n", err)
+		}
+		return
+	}
+	if flag.Arg(0) == "bench" {
+		if err := benchCommand(flag.Args()[1:]); err != nil {
+			fmt.Printf("Oops: %v\n", err)
+		}
+		return
+	}
+
 	name, err := os.Hostname()
 	if err != nil {
 		fmt.Printf("Oops: %v\n", err)
@@ -311,39 +768,231 @@ func main() {
 		return
 	}
 
-	tmpl, err := template.ParseFiles("base.html")
+	config, err := configLoad()
+	if err != nil {
+		fmt.Printf("Oops: %v\n", err)
+		return
+	}
+
+	tmpl, err := template.ParseFiles("base.html", "widget.html", "recap.html", "admin.html", "profile.html")
+	if err != nil {
+		fmt.Printf("Oops: %v\n", err)
+		return
+	}
+
+	store, err := openStore(*dbPath)
+	if err != nil {
+		fmt.Printf("Oops: %v\n", err)
+		return
+	}
+	defer store.Close()
+
+	cache, err := newCache(*cacheDir, *cacheSize<<20)
 	if err != nil {
 		fmt.Printf("Oops: %v\n", err)
 		return
 	}
 
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+
 	// Server
 	s := &Server{
 		songLock:    &sync.Mutex{},
-		songMap:     make(map[string]int),
+		pool:        core.NewPool(),
+		songHints:   make(map[string]*Hints),
 		songPlaying: &Message{Song: Song{Name: ""}},
 
+		songExplicit: make(map[string]bool),
+		songKaraoke:  make(map[string]bool),
+		songDuration: make(map[string]int),
+		announceMap:  make(map[string]*Announcement),
+		singerTurns:  make(map[string]int),
+		songTrack:    make(map[string]string),
+		trackSong:    make(map[string]string),
+		titleSong:    make(map[string]string),
+		trackScores:  make(map[string]float64),
+
 		sockLock:  &sync.Mutex{},
-		sockUsers: []*websocket.Conn{},
+		sockUsers: []*User{},
+
+		scanLock: &sync.Mutex{},
 
 		addrs: addrs[0] + ":8000",
 		tmpl:  tmpl,
+		store: store,
+		cache: cache,
+
+		bandwidth: &limiter{lock: &sync.Mutex{}}, // Set by configApply
+
+		configLock: &sync.Mutex{},
+
+		commands: newDedup(),
+		abuse:    newAbuse(),
+
+		requestQuota: newRequestQuota(),
+
+		collate: core.NewCollator(*localeFlag),
+
+		pluginLock: &sync.Mutex{},
+		shutdown:   hooks{lock: &sync.Mutex{}},
+
+		weightLock: &sync.Mutex{},
+		weights:    defaultWeights(),
+
+		ctx:  ctx,
+		stop: stop,
 	}
 
-	// Generate songs
-	if err := s.songGen(); err != nil {
+	s.pool.Hidden = s.hidden
+	s.configApply(config)
+
+	if err := s.hintsLoad(); err != nil {
+		log.Println(err)
+	}
+	if err := s.explicitLoad(); err != nil {
+		log.Println(err)
+	}
+	if err := s.karaokeLoad(); err != nil {
+		log.Println(err)
+	}
+	if err := s.libraryLoad(); err != nil {
+		log.Println(err)
+	}
+	if err := s.scoresLoad(); err != nil {
+		log.Println(err)
+	}
+	if err := s.weightsLoad(); err != nil {
+		log.Println(err)
+	}
+	if err := s.bansLoad(); err != nil {
 		log.Println(err)
 	}
-	log.Println(s.songMap)
+	if err := s.replay(); err != nil {
+		fmt.Printf("Oops: %v\n", err)
+		return
+	}
+	if err := s.sessionInit(); err != nil {
+		fmt.Printf("Oops: %v\n", err)
+		return
+	}
+
+	// Share state with other instances
+	if *busURL != "" {
+		bus, err := newRedisBus(*busURL, *busChannel, s.receive)
+		if err != nil {
+			fmt.Printf("Oops: %v\n", err)
+			return
+		}
+		defer bus.Close()
+		s.bus = bus
+		s.publish(&Message{Command: "sync"})
+	}
+
+	// Reachable from outside the LAN
+	if *tunnelKind != "" {
+		tunnel, err := openTunnel(*tunnelKind, "8000")
+		if err != nil {
+			fmt.Printf("Oops: %v\n", err)
+			return
+		}
+		defer tunnel.Close()
+		s.public = tunnel.URL()
+		trustForwarded = true
+		log.Println("Public: ", s.public)
+		if !*inviteOnly {
+			log.Println("Tunnel is open to anyone with the link, see -invite-only")
+		}
+	}
+
+	// Optional integrations
+	if *webhookURL != "" {
+		s.Register(&webhook{url: *webhookURL})
+	}
+	if *pushContact != "" {
+		s.push = &pusher{contact: *pushContact}
+		s.Register(s.push)
+	}
+	if err := s.pluginsStart(); err != nil {
+		fmt.Printf("Oops: %v\n", err)
+		return
+	}
+	s.OnShutdown(s.pluginsStop)
+	s.OnShutdown(s.sockCloseAll)
+	s.OnShutdown(s.recapShutdown)
+
+	// Generate songs
+	go func() {
+		if err := s.songGen(); err != nil {
+			log.Println(err)
+		}
+	}()
+	go s.presenceLoop()
 
 	// Http handles
-	http.HandleFunc("/", errorHandler(s.client))
-	http.HandleFunc("/audio/", errorHandler(s.audio))
+	http.HandleFunc("/", errorHandler(s.guest("vote", s.client)))
+	http.HandleFunc("/audio/", errorHandler(s.guest("vote", s.audio)))
+	http.HandleFunc("/preview/", errorHandler(s.guest("vote", s.preview)))
+	http.HandleFunc("/api/v1/waveform/", errorHandler(s.guest("vote", s.waveformAPI)))
+	http.HandleFunc("/widget", errorHandler(s.guest("vote", s.widget)))
+	http.HandleFunc("/oembed", errorHandler(s.oembed))
+	http.HandleFunc("/invite", errorHandler(s.invite))
+	http.HandleFunc("/api/v1/invites", errorHandler(s.invitesAPI))
+	http.HandleFunc("/api/v1/search", errorHandler(s.guest("vote", s.searchAPI)))
+	http.HandleFunc("/api/v1/songs", errorHandler(s.guest("vote", s.songsAPI)))
+	http.HandleFunc("/api/v1/version", errorHandler(s.guest("vote", s.versionAPI)))
+	http.HandleFunc("/api/v1/scan", errorHandler(s.scanStartAPI))
+	http.HandleFunc("/api/v1/scan/status", errorHandler(s.scanAPI))
+	http.HandleFunc("/api/v1/library", errorHandler(s.guest("vote", s.libraryAPI)))
+	http.HandleFunc("/api/v1/cache", errorHandler(s.cacheAPI))
+	http.HandleFunc("/api/v1/history", errorHandler(s.guest("vote", s.historyAPI)))
+	http.HandleFunc("/api/v1/tracks/", errorHandler(s.guest("vote", s.trackAPI)))
+	http.HandleFunc("/api/v1/playlists", errorHandler(s.guest("vote", s.playlistsAPI)))
+	http.HandleFunc("/api/v1/playlists/", errorHandler(s.guest("vote", s.playlistAPI)))
+	http.HandleFunc("/api/v1/schema", errorHandler(s.schemaAPI))
+	http.HandleFunc("/api/v1/nowplaying", errorHandler(s.nowPlayingAPI))
+	http.HandleFunc("/api/v1/login", errorHandler(s.loginAPI))
+	http.HandleFunc("/api/v1/family", errorHandler(s.familyAPI))
+	http.HandleFunc("/api/v1/weights", errorHandler(s.weightsAPI))
+	http.HandleFunc("/api/v1/announce", errorHandler(s.announceAPI))
+	http.HandleFunc("/announce/", errorHandler(s.announceAudio))
+	http.HandleFunc("/api/v1/quarantine", errorHandler(s.quarantineAPI))
+	http.HandleFunc("/api/v1/quarantine/", errorHandler(s.quarantineFileAPI))
+	http.HandleFunc("/api/v1/recaps", errorHandler(s.recapsAPI))
+	http.HandleFunc("/api/v1/recaps/", errorHandler(s.recapAPI))
+	http.HandleFunc("/recap/", errorHandler(s.recap))
+	http.HandleFunc("/api/v1/events", errorHandler(s.eventsAPI))
+	http.HandleFunc("/api/v1/profile", errorHandler(s.guest("vote", s.profileAPI)))
+	http.HandleFunc("/api/v1/profiles/", errorHandler(s.guest("vote", s.profileAPI)))
+	http.HandleFunc("/profile/", errorHandler(s.guest("vote", s.profilePage)))
+	http.HandleFunc("/api/v1/logs", errorHandler(s.logsAPI))
+	http.HandleFunc("/api/v1/stats", errorHandler(s.statsAPI))
+	http.HandleFunc("/api/v1/bans", errorHandler(s.bansAPI))
+	http.HandleFunc("/api/v1/bans/", errorHandler(s.bansAPI))
+	http.HandleFunc("/api/v1/config", errorHandler(s.configAPI))
+	http.HandleFunc("/api/v1/connections", errorHandler(s.connectionsAPI))
+	http.HandleFunc("/api/v1/connections/", errorHandler(s.connectionsAPI))
+	http.HandleFunc("/api/v1/requests", errorHandler(s.guest("request", s.requestsAPI)))
+	http.HandleFunc("/api/v1/push", errorHandler(s.guest("vote", s.pushAPI)))
+	http.HandleFunc("/api/v1/karaoke", errorHandler(s.guest("vote", s.karaokeAPI)))
+	http.HandleFunc("/api/v1/karaoke/singers", errorHandler(s.guest("vote", s.singersAPI)))
+	http.HandleFunc("/api/v1/karaoke/singers/", errorHandler(s.guest("vote", s.singersAPI)))
+	http.HandleFunc("/admin", errorHandler(s.console))
+	http.HandleFunc("/feeds/played.atom", errorHandler(s.guest("vote", s.playedFeed)))
+	if *subsonicPassword != "" {
+		http.HandleFunc("/rest/", errorHandler(s.subsonic))
+	}
 
-	http.HandleFunc("/sock", errorHandler(s.sock))
+	http.HandleFunc("/sock", errorHandler(s.guest("vote", s.sock)))
 
 	s.sServe("/list.min.js", "list.min.js")
 	s.sServe("/style.css", "style.css")
+	s.sServe("/nowplaying", "nowplaying.html")
+	s.sServe("/karaoke", "karaoke.html")
+	http.HandleFunc("/manifest.webmanifest", errorHandler(s.manifest))
+	http.HandleFunc("/sw.js", errorHandler(s.serviceWorker))
+	http.HandleFunc("/icon-192.png", errorHandler(s.icon))
+	http.HandleFunc("/icon-512.png", errorHandler(s.icon))
 
 	msg := &Message{
 		Command: "play",
@@ -354,10 +1003,35 @@ func main() {
 	b, _ := json.Marshal(msg)
 	fmt.Println(string(b))
 
-	// Run
+	// Run until interrupted
+	srv := &http.Server{
+		Addr:        ":8000",
+		BaseContext: func(net.Listener) context.Context { return s.ctx },
+	}
+	go func() {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		for range hup {
+			s.reload()
+		}
+	}()
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		<-sig
+		log.Println("Shutting down")
+		s.stop() // Ends downloads, transcodes and scans
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Println("Shutdown: ", err)
+		}
+	}()
+
 	log.Println("Running: ", s.addrs)
-	err = http.ListenAndServe(":8000", nil)
-	if err != nil {
+	err = srv.ListenAndServe()
+	if err != http.ErrServerClosed {
 		log.Fatal("ListenAndServe: ", err)
 	}
+	s.shutdownRun(shutdownTimeout)
 }
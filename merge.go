@@ -0,0 +1,117 @@
+package main
+
+import (
+	"log"
+	"sort"
+)
+
+const maxMergeVotes = 200
+
+// Rate limit votes to the config's VoteRate per minute, per session
+func (s *Server) allow(u *User, now int) bool {
+	rate := s.settings().VoteRate
+	if rate == 0 {
+		return true
+	}
+	n, err := s.store.CountVotes(u.session.ID, now-60*1000)
+	if err != nil {
+		log.Println("allow: ", err)
+		return true
+	}
+	return n < rate
+}
+
+// Whether a song can be voted for, explicit songs can't in family mode
+func (s *Server) votable(name string) bool {
+	s.songLock.Lock()
+	defer s.songLock.Unlock()
+	return s.pool.Visible(s.canonical(name))
+}
+
+// Apply a vote, weighted by who cast it
+func (s *Server) vote(u *User, vote Message, now int) {
+	delta := 1
+	if vote.Command == "minus" {
+		delta = -1
+	}
+	weight := s.weight(u.session, now)
+	s.songLock.Lock()
+	vote.Song.Name = s.canonical(vote.Song.Name)
+	vote.Song.Track = s.songTrack[vote.Song.Name]
+	s.songLock.Unlock()
+
+	if err := s.store.RecordVote(u.session.ID, *roomName, vote.Song, delta, weight, now); err != nil {
+		log.Println("vote: ", err)
+	}
+	if delta > 0 {
+		s.plus(vote.Song, weight)
+	} else {
+		s.minus(vote.Song, weight)
+	}
+	msg := &Message{Command: vote.Command, Song: Song{Name: vote.Song.Name}, Weight: weight}
+	s.publish(msg)
+	s.emit(msg)
+}
+
+type byTime []Message
+
+func (v byTime) Len() int           { return len(v) }
+func (v byTime) Swap(i, j int)      { v[i], v[j] = v[j], v[i] }
+func (v byTime) Less(i, j int) bool { return v[i].Time < v[j].Time }
+
+// Check a queued vote is still valid, returns the reason if not
+func (s *Server) validate(u *User, vote Message, now int) string {
+	if vote.Command != "plus" && vote.Command != "minus" {
+		return "unknown command"
+	}
+
+	s.songLock.Lock()
+	reason := s.pool.Check(s.canonical(vote.Song.Name), vote.Time, now)
+	s.songLock.Unlock()
+	if reason != "" {
+		return reason
+	}
+
+	if !s.allow(u, now) {
+		return "rate limited"
+	}
+	// Already applied, the ack was lost
+	if !s.fresh(u, vote.ID) {
+		return "duplicate"
+	}
+	return ""
+}
+
+// Merge votes queued by a client while it was offline
+func (s *Server) merge(u *User, votes []Message) {
+	var accepted []Message
+	var rejected []Rejection
+
+	if len(votes) > maxMergeVotes {
+		for _, vote := range votes[maxMergeVotes:] {
+			rejected = append(rejected, Rejection{Vote: vote, Reason: "too many votes"})
+		}
+		votes = votes[:maxMergeVotes]
+	}
+
+	// Apply in the order they were cast
+	sort.Stable(byTime(votes))
+
+	now := int(makeTimestamp())
+	for _, vote := range votes {
+		if reason := s.validate(u, vote, now); reason != "" {
+			rejected = append(rejected, Rejection{Vote: vote, Reason: reason})
+			continue
+		}
+		s.vote(u, vote, now)
+		s.applied(u, vote.ID)
+		accepted = append(accepted, vote)
+	}
+	log.Printf("merge: %d accepted, %d rejected", len(accepted), len(rejected))
+
+	s.sockWriteUser(u, &Message{
+		Command:  "merged",
+		Votes:    accepted,
+		Rejected: rejected,
+	})
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// The current song for overlays, times in ms
+type NowPlaying struct {
+	Name         string
+	Title        string `json:",omitempty"`
+	Artist       string `json:",omitempty"`
+	Album        string `json:",omitempty"`
+	Started      int
+	Announcement bool `json:",omitempty"`
+}
+
+func (np *NowPlaying) String() string {
+	if np.Announcement {
+		return "Announcement"
+	}
+	if np.Artist != "" && np.Title != "" {
+		return np.Artist + " - " + np.Title
+	}
+	if np.Title != "" {
+		return np.Title
+	}
+	return np.Name
+}
+
+// Now playing for a play message, filled in from the library
+func (s *Server) nowPlaying(msg *Message) *NowPlaying {
+	np := &NowPlaying{Name: msg.Song.Name, Started: msg.Time, Announcement: msg.Announce != nil}
+	if np.Announcement || np.Name == "" {
+		return np
+	}
+	m, err := s.store.Meta(np.Name)
+	if err != nil {
+		log.Println("nowPlaying: ", err)
+	} else if m != nil {
+		np.Title, np.Artist, np.Album = m.Title, m.Artist, m.Album
+	}
+	return np
+}
+
+// Write nowplaying.txt and nowplaying.json to -nowplaying for streaming
+// software to pick up
+func (s *Server) nowPlayingWrite(msg *Message) {
+	if *nowPlayingDir == "" {
+		return
+	}
+	np := s.nowPlaying(msg)
+	b, err := json.Marshal(np)
+	if err != nil {
+		log.Println("nowPlayingWrite: ", err)
+		return
+	}
+	if err := writeFile(filepath.Join(*nowPlayingDir, "nowplaying.json"), b); err != nil {
+		log.Println("nowPlayingWrite: ", err)
+	}
+	if err := writeFile(filepath.Join(*nowPlayingDir, "nowplaying.txt"), []byte(np.String()+"\n")); err != nil {
+		log.Println("nowPlayingWrite: ", err)
+	}
+}
+
+// Replace a file in one step so readers never see it half written
+func writeFile(path string, b []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), ".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// Now playing handle, for overlays
+func (s *Server) nowPlayingAPI(w http.ResponseWriter, r *http.Request) error {
+	s.songLock.Lock()
+	msg := s.songPlaying
+	s.songLock.Unlock()
+
+	np := s.nowPlaying(msg)
+	w.Header().Set("Cache-Control", "no-store")
+	if r.FormValue("format") == "text" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		_, err := w.Write([]byte(np.String() + "\n"))
+		return err
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(np)
+}
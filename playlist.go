@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Play history handle
+func (s *Server) historyAPI(w http.ResponseWriter, r *http.Request) error {
+	limit, err := strconv.Atoi(r.FormValue("limit"))
+	if err != nil || limit <= 0 || limit > 1000 {
+		limit = 100
+	}
+	// This room unless asked, ?room= for all
+	room := *roomName
+	if v, ok := r.URL.Query()["room"]; ok {
+		room = v[0]
+	}
+	plays, err := s.store.History(room, limit)
+	if err != nil {
+		return err
+	}
+	if wantM3U(r) {
+		// Oldest first, as it was played
+		songs := make([]string, len(plays))
+		for i, p := range plays {
+			songs[len(plays)-1-i] = p.Song
+		}
+		return s.writeM3U(w, "history", songs, r.FormValue("local") != "")
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(plays)
+}
+
+// Playlist names handle
+func (s *Server) playlistsAPI(w http.ResponseWriter, r *http.Request) error {
+	names, err := s.store.Playlists()
+	if err != nil {
+		return err
+	}
+	if names == nil {
+		names = []string{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(names)
+}
+
+// Whether a name is a song in the library, so playlists can't name
+// other files
+func (s *Server) librarySong(name string) bool {
+	s.songLock.Lock()
+	defer s.songLock.Unlock()
+	_, ok := s.songTrack[name]
+	return ok || s.pool.Has(name)
+}
+
+// Playlist handle, GET, PUT a JSON list of song names, or DELETE.
+// ?format=m3u or zip exports, PUT with ?format=m3u, m3u8 or cue imports.
+func (s *Server) playlistAPI(w http.ResponseWriter, r *http.Request) error {
+	name := strings.TrimPrefix(r.URL.Path, "/api/v1/playlists/")
+	if name == "" {
+		http.NotFound(w, r)
+		return nil
+	}
+
+	if r.Method != "GET" {
+		sess, err := s.cookieSession(r)
+		if err != nil {
+			return err
+		}
+		if !s.can(sess, "request") && !s.isAdmin(r) {
+			http.Error(w, "not allowed", http.StatusForbidden)
+			return nil
+		}
+	}
+
+	switch r.Method {
+	case "GET":
+		songs, err := s.store.Playlist(name)
+		if err != nil {
+			return err
+		}
+		if songs == nil {
+			http.NotFound(w, r)
+			return nil
+		}
+		if wantM3U(r) {
+			return s.writeM3U(w, name, songs, r.FormValue("local") != "")
+		}
+		if r.FormValue("format") == "zip" {
+			return s.playlistZip(w, r, name, songs)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		return json.NewEncoder(w).Encode(songs)
+	case "PUT":
+		switch format := r.FormValue("format"); format {
+		case "m3u", "m3u8", "cue":
+			return s.playlistImport(w, r, name, format)
+		case "", "json":
+		default:
+			http.Error(w, "unknown format", http.StatusBadRequest)
+			return nil
+		}
+		var songs []string
+		if err := json.NewDecoder(r.Body).Decode(&songs); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return nil
+		}
+		for _, song := range songs {
+			if !s.librarySong(song) {
+				http.Error(w, fmt.Sprintf("%q is not in the library", song), http.StatusBadRequest)
+				return nil
+			}
+		}
+		if err := s.store.SavePlaylist(name, songs); err != nil {
+			return err
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case "DELETE":
+		if err := s.store.DeletePlaylist(name); err != nil {
+			return err
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+	return nil
+}
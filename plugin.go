@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	pluginQueue     = 64 // Events queued per plugin before new ones are dropped
+	shutdownTimeout = 10 * time.Second
+)
+
+// Optional integration such as scrobbling, webhooks or chat bots.
+// Init is called once the server is built, Start before it serves,
+// and Stop on shutdown in reverse order. HandleEvent is called from
+// one goroutine per plugin, so a slow plugin only delays itself.
+type Plugin interface {
+	Name() string
+	Init(s *Server) error
+	Start() error
+	Stop() error
+	HandleEvent(e Event)
+}
+
+// Something that happened, Type is the message command such as
+// "play", "plus", "minus", "scan" or "family". Time is in ms.
+type Event struct {
+	Type    string
+	Time    int
+	Message *Message
+}
+
+type pluginRunner struct {
+	plugin Plugin
+	events chan Event
+	done   chan struct{}
+}
+
+// Add a plugin, before pluginsStart
+func (s *Server) Register(p Plugin) {
+	s.pluginLock.Lock()
+	defer s.pluginLock.Unlock()
+	s.plugins = append(s.plugins, &pluginRunner{plugin: p})
+}
+
+// Init then start plugins, stopping those already started on error
+func (s *Server) pluginsStart() error {
+	s.pluginLock.Lock()
+	plugins := s.plugins
+	s.pluginLock.Unlock()
+
+	for i, r := range plugins {
+		err := r.plugin.Init(s)
+		if err == nil {
+			err = r.plugin.Start()
+		}
+		if err != nil {
+			s.pluginLock.Lock()
+			s.plugins = plugins[:i]
+			s.pluginLock.Unlock()
+			s.pluginsStop()
+			return fmt.Errorf("plugin %s: %v", r.plugin.Name(), err)
+		}
+
+		events := make(chan Event, pluginQueue)
+		r.done = make(chan struct{})
+		go func(r *pluginRunner) {
+			defer close(r.done)
+			for e := range events {
+				r.plugin.HandleEvent(e)
+			}
+		}(r)
+		s.pluginLock.Lock()
+		r.events = events
+		s.pluginLock.Unlock()
+		log.Println("Plugin started: ", r.plugin.Name())
+	}
+	return nil
+}
+
+// Drain and stop plugins, last started first
+func (s *Server) pluginsStop() {
+	s.pluginLock.Lock()
+	plugins := s.plugins
+	s.plugins = nil
+	s.pluginLock.Unlock()
+
+	for i := len(plugins) - 1; i >= 0; i-- {
+		r := plugins[i]
+		if r.events != nil {
+			close(r.events)
+			<-r.done
+		}
+		if err := r.plugin.Stop(); err != nil {
+			log.Println("Plugin stop: ", r.plugin.Name(), err)
+		}
+	}
+}
+
+// Send an event to every plugin. Each gets its own copy of the message,
+// decoded from JSON so nothing is shared with the server or other
+// plugins.
+func (s *Server) emit(msg *Message) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		log.Println("emit: ", err)
+		return
+	}
+	now := int(makeTimestamp())
+	s.pluginLock.Lock()
+	defer s.pluginLock.Unlock()
+	for _, r := range s.plugins {
+		if r.events == nil {
+			continue
+		}
+		e := Event{Type: msg.Command, Time: now, Message: &Message{}}
+		if err := json.Unmarshal(data, e.Message); err != nil {
+			log.Println("emit: ", err)
+			return
+		}
+		select {
+		case r.events <- e:
+		default:
+			log.Println("Plugin behind, dropped event: ", r.plugin.Name(), e.Type)
+		}
+	}
+}
+
+// Shutdown hooks, run after the http server stops
+type hooks struct {
+	lock  *sync.Mutex
+	funcs []func()
+}
+
+// Run f on shutdown, hooks run last added first
+func (s *Server) OnShutdown(f func()) {
+	s.shutdown.lock.Lock()
+	defer s.shutdown.lock.Unlock()
+	s.shutdown.funcs = append(s.shutdown.funcs, f)
+}
+
+func (s *Server) shutdownRun(timeout time.Duration) {
+	s.shutdown.lock.Lock()
+	funcs := s.shutdown.funcs
+	s.shutdown.funcs = nil
+	s.shutdown.lock.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		for i := len(funcs) - 1; i >= 0; i-- {
+			funcs[i]()
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		log.Println("Shutdown: Timed out")
+	}
+}
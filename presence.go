@@ -0,0 +1,112 @@
+package main
+
+import (
+	"log"
+	"math"
+	"time"
+
+	"github.com/emcfarlane/jukebox/core"
+)
+
+const (
+	listenTimeout = 45 * time.Second // Three missed heartbeats
+	presenceEvery = 5 * time.Second  // How often counts are checked
+)
+
+// Connected clients and the people actually playing audio, a guest
+// listening in two tabs is one
+type Presence struct {
+	Connected int
+	Listening int
+}
+
+// Skip votes for the playing song
+type Skips struct {
+	Votes  int
+	Needed int
+}
+
+// Listening heartbeat, sent while a client's audio plays. An empty
+// song name means it stopped.
+func (s *Server) listening(u *User, name string) {
+	s.sockLock.Lock()
+	defer s.sockLock.Unlock()
+	if name == "" {
+		u.heard = time.Time{}
+		return
+	}
+	u.heard = time.Now()
+}
+
+func (s *Server) presence() Presence {
+	s.sockLock.Lock()
+	defer s.sockLock.Unlock()
+	now := time.Now()
+	p := Presence{Connected: len(s.sockUsers)}
+	listening := make(map[string]bool)
+	for _, u := range s.sockUsers {
+		if now.Sub(u.heard) < listenTimeout && u.session != nil {
+			listening[u.session.ID] = true
+		}
+	}
+	p.Listening = len(listening)
+	return p
+}
+
+// Broadcast counts when they change
+func (s *Server) presenceLoop() {
+	t := time.NewTicker(presenceEvery)
+	defer t.Stop()
+	var sent Presence
+	for {
+		select {
+		case <-t.C:
+		case <-s.ctx.Done():
+			return
+		}
+		if p := s.presence(); p != sent {
+			sent = p
+			s.sockWriteLoop(&Message{Command: "presence", Presence: &p})
+		}
+	}
+}
+
+// Votes needed to skip, a share of listeners so connected clients that
+// aren't playing don't raise the bar
+func skipNeeded(listening int) int {
+	n := int(math.Ceil(float64(listening) * *skipRatio))
+	if n < 1 {
+		n = 1
+	}
+	return n
+}
+
+// Vote to skip the playing song, returns why the vote wasn't counted.
+// Votes are counted per instance.
+func (s *Server) skip(u *User, name string) string {
+	s.songLock.Lock()
+	playing, epoch := s.songPlaying.Song, s.songPlaying.Epoch
+	if name == "" || name != playing.Name || s.songPlaying.Announce != nil {
+		s.songLock.Unlock()
+		return "not playing"
+	}
+	if s.skipVotes == nil || s.skipEpoch != epoch {
+		s.skipEpoch, s.skipVotes = epoch, make(map[string]bool)
+	}
+	s.skipVotes[u.session.ID] = true
+	s.record(core.EventSkip, name, 0, int(makeTimestamp()))
+	tally := Skips{Votes: len(s.skipVotes), Needed: skipNeeded(s.presence().Listening)}
+	s.songLock.Unlock()
+
+	s.sockWriteLoop(&Message{Command: "skip", Song: playing, Skips: &tally})
+	if tally.Votes < tally.Needed {
+		return ""
+	}
+	log.Println("Skipping: ", name)
+	if s.leader() {
+		s.next(playing, epoch)
+	} else {
+		s.publish(&Message{Command: "next", Song: playing, Epoch: epoch})
+	}
+	return ""
+}
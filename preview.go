@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+const (
+	previewLength = 30  // Seconds in a preview clip
+	waveformPeaks = 200 // Peaks in a waveform
+	waveformRate  = 2000
+)
+
+// Waveform of a song, peaks from 0 to 1 over its length
+type Waveform struct {
+	Peaks []float64
+}
+
+// Cut a preview clip with ffmpeg, from start seconds in
+func previewClip(ctx context.Context, src string, start float64, w io.Writer) error {
+	args := []string{"-v", "error", "-ss", fmt.Sprint(start), "-i", src, "-vn", "-t", fmt.Sprint(previewLength)}
+	args = append(args, transcodeArgs["mp3"]...)
+	cmd := exec.CommandContext(ctx, *ffmpeg, append(args, "-")...)
+	cmd.Stdout = w
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+// Decode a song with ffmpeg to low rate mono samples and take their
+// peaks, duration is its length in ms
+func waveform(ctx context.Context, src string, duration int) (*Waveform, error) {
+	cmd := exec.CommandContext(ctx, *ffmpeg, "-v", "error", "-i", src, "-vn",
+		"-ac", "1", "-ar", fmt.Sprint(waveformRate), "-f", "s16le", "-")
+	cmd.Stderr = os.Stderr
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	// Samples per peak, from the length if it's known
+	per := duration * waveformRate / 1000 / waveformPeaks
+	if per < 1 {
+		per = waveformRate
+	}
+	v := &Waveform{}
+	r := bufio.NewReader(out)
+	var peak, n int
+	for {
+		var sample int16
+		if err := binary.Read(r, binary.LittleEndian, &sample); err != nil {
+			break
+		}
+		if sample < 0 {
+			sample = -(sample + 1)
+		}
+		if int(sample) > peak {
+			peak = int(sample)
+		}
+		if n++; n == per {
+			v.Peaks = append(v.Peaks, float64(peak)/32767)
+			peak, n = 0, 0
+		}
+	}
+	if n > 0 {
+		v.Peaks = append(v.Peaks, float64(peak)/32767)
+	}
+	if err := cmd.Wait(); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// Open a song's preview or waveform from the cache, generating it on a
+// miss. Returns nil if the song isn't in the library.
+func (s *Server) artifact(w http.ResponseWriter, r *http.Request, prefix, kind string) (*os.File, error) {
+	name := strings.TrimPrefix(r.URL.Path, prefix)
+	if !s.librarySong(name) {
+		http.NotFound(w, r)
+		return nil, nil
+	}
+	src := musicPath(name)
+	fm := s.songFormat(name)
+	start := float64(fm.Duration) / 1000 / 3 // Past the intro
+
+	params := []string{kind}
+	if kind == "preview" {
+		params = append(params, fmt.Sprint(start))
+	} else {
+		params = append(params, fmt.Sprint(waveformPeaks, waveformRate))
+	}
+	key, err := s.cache.Key(src, params...)
+	if err != nil {
+		return nil, err
+	}
+	f, err := s.cache.Open(r.Context(), key, func(w io.Writer) error {
+		if kind == "preview" {
+			return previewClip(r.Context(), src, start, w)
+		}
+		v, err := waveform(r.Context(), src, fm.Duration)
+		if err != nil {
+			return err
+		}
+		return json.NewEncoder(w).Encode(v)
+	})
+	if err != nil && r.Context().Err() != nil {
+		return nil, nil // Client went away
+	}
+	return f, err
+}
+
+// Preview handle, a short mp3 clip of a song
+func (s *Server) preview(w http.ResponseWriter, r *http.Request) error {
+	w = s.throttle(w, r)
+	f, err := s.artifact(w, r, "/preview/", "preview")
+	if err != nil || f == nil {
+		return err
+	}
+	defer f.Close()
+	http.ServeContent(w, r, ".mp3", time.Now(), f)
+	return nil
+}
+
+// Waveform handle, a song's peaks as JSON for drawing
+func (s *Server) waveformAPI(w http.ResponseWriter, r *http.Request) error {
+	f, err := s.artifact(w, r, "/api/v1/waveform/", "waveform")
+	if err != nil || f == nil {
+		return err
+	}
+	defer f.Close()
+	w.Header().Set("Content-Type", "application/json")
+	_, err = io.Copy(w, f)
+	return err
+}
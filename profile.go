@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Votes and artists shown on a profile
+const profileEntries = 20
+
+// A session's voting history, for people who use the same browser every
+// day. Times in ms.
+type Profile struct {
+	ID      string // Session's public profile ID
+	Name    string
+	Votes   int
+	Up      int
+	Down    int
+	First   int // First vote
+	Last    int
+	Days    int // Days with a vote, in UTC
+	Artists []ProfileArtist
+	Recent  []ProfileVote
+}
+
+// Artist by the songs of theirs upvoted
+type ProfileArtist struct {
+	Artist string
+	Votes  int
+}
+
+type ProfileVote struct {
+	Song  string
+	Room  string
+	Delta int
+	Time  int
+}
+
+func (p *Profile) Since() string {
+	return time.Unix(0, int64(p.First)*int64(time.Millisecond)).Format("2 Jan 2006")
+}
+
+func (v ProfileVote) Date() string {
+	return time.Unix(0, int64(v.Time)*int64(time.Millisecond)).Format("Mon 2 Jan 15:04")
+}
+
+// Profile for a public ID, or the request's own if id is "". Nil if
+// there's no such session.
+func (s *Server) profile(w http.ResponseWriter, r *http.Request, id string) (*Profile, error) {
+	var sess *Session
+	var err error
+	if id == "" {
+		sess, err = s.session(r, w.Header())
+	} else {
+		sess, err = s.store.ProfileSession(id)
+	}
+	if err != nil || sess == nil {
+		return nil, err
+	}
+	p, err := s.store.Profile(sess.ID, profileEntries)
+	if err != nil {
+		return nil, err
+	}
+	p.ID, p.Name = sess.Profile, sess.Name
+	return p, nil
+}
+
+// Profile page, /profile/ for your own
+func (s *Server) profilePage(w http.ResponseWriter, r *http.Request) error {
+	p, err := s.profile(w, r, strings.TrimPrefix(r.URL.Path, "/profile/"))
+	if err != nil {
+		return err
+	}
+	if p == nil {
+		http.NotFound(w, r)
+		return nil
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	return s.tmpl.ExecuteTemplate(w, "profile.html", p)
+}
+
+// Profile handle, /api/v1/profile for your own
+func (s *Server) profileAPI(w http.ResponseWriter, r *http.Request) error {
+	var id string
+	if strings.HasPrefix(r.URL.Path, "/api/v1/profiles/") {
+		id = strings.TrimPrefix(r.URL.Path, "/api/v1/profiles/")
+	}
+	p, err := s.profile(w, r, id)
+	if err != nil {
+		return err
+	}
+	if p == nil {
+		http.NotFound(w, r)
+		return nil
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(p)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"unicode/utf8"
+)
+
+// Limits on websocket messages from clients
+const (
+	maxMessageSize = 256 << 10 // Room for a full merge
+	maxDepth       = 8
+	maxNameLen     = 1024 // Song names
+	maxFieldLen    = 64   // Commands, IDs and display names
+	maxSignalLen   = 16 << 10
+	maxBadMessages = 10 // Before the connection is dropped
+)
+
+var clientCommands = make(map[string]bool)
+
+func init() {
+	for _, c := range sockCommands["client"] {
+		clientCommands[c] = true
+	}
+}
+
+// Decode and check a message from a client. Malformed messages are
+// refused whole, the returned message only has a usable ID.
+func decodeMessage(data []byte) (Message, error) {
+	var msg Message
+	if len(data) > maxMessageSize {
+		return msg, errors.New("message too large")
+	}
+	if err := checkDepth(data); err != nil {
+		return msg, err
+	}
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return Message{}, err
+	}
+	if len(msg.ID) > maxFieldLen || !utf8.ValidString(msg.ID) {
+		msg.ID = ""
+		return msg, errors.New("bad ID")
+	}
+	if !clientCommands[msg.Command] {
+		return msg, fmt.Errorf("unknown command %.32q", msg.Command)
+	}
+	if err := checkMessage(&msg); err != nil {
+		return msg, err
+	}
+	if msg.Command != "merge" && len(msg.Votes) > 0 {
+		return msg, errors.New("votes outside a merge")
+	}
+	if len(msg.Votes) > maxMergeVotes {
+		return msg, errors.New("too many votes")
+	}
+	for i := range msg.Votes {
+		v := &msg.Votes[i]
+		if v.Command != "plus" && v.Command != "minus" {
+			return msg, fmt.Errorf("vote %d: not a vote", i)
+		}
+		if len(v.Votes) > 0 || len(v.ID) > maxFieldLen {
+			return msg, fmt.Errorf("vote %d: bad vote", i)
+		}
+		if err := checkMessage(v); err != nil {
+			return msg, fmt.Errorf("vote %d: %v", i, err)
+		}
+	}
+	return msg, nil
+}
+
+// Fields shared by messages and the votes in a merge
+func checkMessage(msg *Message) error {
+	if len(msg.Song.Name) > maxNameLen || !utf8.ValidString(msg.Song.Name) {
+		return errors.New("bad song name")
+	}
+	if len(msg.Name) > maxFieldLen*4 || !utf8.ValidString(msg.Name) {
+		return errors.New("bad display name")
+	}
+	if msg.Time < 0 {
+		return errors.New("negative time")
+	}
+	if len(msg.Data) > maxSignalLen {
+		return errors.New("signal too large")
+	}
+	// Only the server sends these
+	if msg.Scan != nil || msg.Announce != nil || msg.Family != nil || len(msg.Songs) > 0 || len(msg.Rejected) > 0 {
+		return errors.New("server only field")
+	}
+	return nil
+}
+
+// Refuse JSON nested deeper than maxDepth without decoding it
+func checkDepth(data []byte) error {
+	depth := 0
+	inString, escaped := false, false
+	for _, b := range data {
+		switch {
+		case escaped:
+			escaped = false
+		case inString:
+			if b == '\\' {
+				escaped = true
+			} else if b == '"' {
+				inString = false
+			}
+		case b == '"':
+			inString = true
+		case b == '{' || b == '[':
+			if depth++; depth > maxDepth {
+				return errors.New("message nested too deep")
+			}
+		case b == '}' || b == ']':
+			depth--
+		}
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestDecodeMessage(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		ok   bool
+	}{
+		{"vote", `{"Command":"plus","ID":"a1","Song":{"Name":"song.mp3"}}`, true},
+		{"merge", `{"Command":"merge","Votes":[{"Command":"plus","Song":{"Name":"a"}},{"Command":"minus","Song":{"Name":"b"}}]}`, true},
+		{"empty", ``, false},
+		{"not json", `plus`, false},
+		{"unknown command", `{"Command":"shutdown"}`, false},
+		{"server command", `{"Command":"merged"}`, false},
+		{"huge message", `{"Command":"plus","Song":{"Name":"` + strings.Repeat("a", maxMessageSize) + `"}}`, false},
+		{"huge name", `{"Command":"plus","Song":{"Name":"` + strings.Repeat("a", maxNameLen+1) + `"}}`, false},
+		{"huge ID", `{"Command":"plus","ID":"` + strings.Repeat("a", maxFieldLen+1) + `"}`, false},
+		{"display name", `{"Command":"name","Name":"é"}`, true},
+		{"huge display name", `{"Command":"name","Name":"` + strings.Repeat("a", maxFieldLen*4+1) + `"}`, false},
+		{"huge signal", `{"Command":"signal","Data":"` + strings.Repeat("a", maxSignalLen+1) + `"}`, false},
+		{"command not a string", `{"Command":1}`, false},
+		{"song not an object", `{"Command":"plus","Song":"a"}`, false},
+		{"votes not a list", `{"Command":"merge","Votes":{}}`, false},
+		{"time not a number", `{"Command":"plus","Time":"now"}`, false},
+		{"negative time", `{"Command":"plus","Time":-1}`, false},
+		{"deep nesting", strings.Repeat("[", maxDepth+1) + strings.Repeat("]", maxDepth+1), false},
+		{"deep nesting in a field", `{"Command":"plus","X":` + strings.Repeat("[", maxDepth) + strings.Repeat("]", maxDepth) + `}`, false},
+		{"brackets in a string", `{"Command":"plus","Song":{"Name":"` + strings.Repeat("[", maxDepth*2) + `"}}`, true},
+		{"votes outside a merge", `{"Command":"plus","Votes":[{"Command":"plus"}]}`, false},
+		{"not a vote in a merge", `{"Command":"merge","Votes":[{"Command":"skip"}]}`, false},
+		{"nested merge", `{"Command":"merge","Votes":[{"Command":"plus","Votes":[{"Command":"plus"}]}]}`, false},
+		{"too many votes", `{"Command":"merge","Votes":[` + strings.Repeat(`{"Command":"plus"},`, maxMergeVotes) + `{"Command":"plus"}]}`, false},
+		{"server only field", `{"Command":"plus","Songs":[{"Name":"a"}]}`, false},
+	}
+	for _, tt := range tests {
+		_, err := decodeMessage([]byte(tt.data))
+		if ok := err == nil; ok != tt.ok {
+			t.Errorf("%s: got error %v, want ok %v", tt.name, err, tt.ok)
+		}
+	}
+}
+
+func FuzzDecodeMessage(f *testing.F) {
+	f.Add([]byte(`{"Command":"plus","ID":"a1","Song":{"Name":"song.mp3"}}`))
+	f.Add([]byte(`{"Command":"merge","Votes":[{"Command":"minus","Song":{"Name":"b"},"Time":1}]}`))
+	f.Add([]byte(`{"Command":"rename","Name":"é"}`))
+	f.Add([]byte(`{"Command":"signal","Data":{"sdp":"v=0"}}`))
+	f.Add([]byte(`[[[[[[[[[]]]]]]]]]`))
+	f.Add([]byte(`{"Command":"plus","Song":{"Name":"\"[{"}}`))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		msg, err := decodeMessage(data)
+		if len(msg.ID) > maxFieldLen || !utf8.ValidString(msg.ID) {
+			t.Fatalf("returned ID %q is unusable", msg.ID)
+		}
+		if err != nil {
+			return
+		}
+		if len(data) > maxMessageSize {
+			t.Fatalf("accepted %d bytes", len(data))
+		}
+		if checkDepth(data) != nil {
+			t.Fatal("accepted a message nested too deep")
+		}
+		if !clientCommands[msg.Command] {
+			t.Fatalf("accepted command %q", msg.Command)
+		}
+		if err := checkMessage(&msg); err != nil {
+			t.Fatalf("accepted a bad message: %v", err)
+		}
+		if len(msg.Votes) > maxMergeVotes || msg.Command != "merge" && len(msg.Votes) > 0 {
+			t.Fatalf("accepted %d votes for %q", len(msg.Votes), msg.Command)
+		}
+		for _, v := range msg.Votes {
+			if v.Command != "plus" && v.Command != "minus" || len(v.Votes) > 0 || len(v.ID) > maxFieldLen {
+				t.Fatalf("accepted vote %+v", v)
+			}
+			if err := checkMessage(&v); err != nil {
+				t.Fatalf("accepted a bad vote: %v", err)
+			}
+		}
+	})
+}
@@ -0,0 +1,570 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	pushBatch    = 2 * time.Second  // Notifications are gathered and sent this often
+	pushWorkers  = 8                // Push services sent to at once
+	pushTTL      = 10 * time.Minute // Push services drop undelivered notifications after
+	pushPrune    = time.Hour
+	roundWarning = 30 * time.Second // Before a song ends, when voting for the next closes
+
+	maxPushSubscriptions = 5 // Per session, a browser has one per device
+)
+
+// Hosts of the browsers' push services, endpoints anywhere else are
+// refused so the server can't be made to post to internal hosts
+var pushHosts = []string{
+	"fcm.googleapis.com",
+	"updates.push.services.mozilla.com",
+	"push.services.mozilla.com",
+	"notify.windows.com",
+	"push.apple.com",
+}
+
+func pushHost(endpoint string) bool {
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Scheme != "https" || u.Port() != "" {
+		return false
+	}
+	host := strings.ToLower(u.Hostname())
+	for _, h := range pushHosts {
+		if host == h || strings.HasSuffix(host, "."+h) {
+			return true
+		}
+	}
+	return false
+}
+
+// Events a subscription can ask for
+var pushEvents = map[string]string{
+	"playing": "The song changes",
+	"next":    "A song you upvoted is up next",
+	"round":   "Voting for the next song is about to close",
+}
+
+// A browser's PushSubscription as JSON, with the events it wants.
+// ExpirationTime is in ms, 0 if it doesn't expire.
+type PushSubscription struct {
+	Endpoint       string
+	ExpirationTime int
+	Keys           PushKeys
+	Events         []string
+	Session        string `json:"-"`
+}
+
+type PushKeys struct {
+	P256dh string // Browser's P-256 public key
+	Auth   string
+}
+
+func (sub *PushSubscription) wants(event string) bool {
+	for _, e := range sub.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// Notification payload, shown by the service worker
+type PushNote struct {
+	Title string
+	Body  string
+	Tag   string // A newer notification with the same tag replaces it
+	URL   string `json:",omitempty"`
+}
+
+// Sends Web Push notifications signed with a VAPID key. Notifications
+// are queued by endpoint and tag, so one replaced before the next batch
+// is never sent, and endpoints push services say are gone are dropped.
+type pusher struct {
+	contact string // mailto: or https: URL for push services to reach us
+	s       *Server
+	key     *ecdsa.PrivateKey
+	public  string // Application server key, base64url
+	client  *http.Client
+
+	lock    *sync.Mutex
+	pending map[string]*pushQueued
+	round   *time.Timer
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+type pushQueued struct {
+	sub   PushSubscription
+	notes []PushNote
+}
+
+func (p *pusher) Name() string { return "push" }
+
+// Load the VAPID key, making one on first run
+func (p *pusher) Init(s *Server) error {
+	p.s = s
+	p.client = &http.Client{Timeout: 10 * time.Second}
+	p.lock = &sync.Mutex{}
+	p.pending = make(map[string]*pushQueued)
+
+	v, err := s.store.Setting("vapid_key")
+	if err != nil {
+		return err
+	}
+	if v == "" {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return err
+		}
+		b, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return err
+		}
+		v = base64.StdEncoding.EncodeToString(b)
+		if err := s.store.SetSetting("vapid_key", v); err != nil {
+			return err
+		}
+	}
+	b, err := base64.StdEncoding.DecodeString(v)
+	if err != nil {
+		return err
+	}
+	if p.key, err = x509.ParseECPrivateKey(b); err != nil {
+		return err
+	}
+	pub, err := p.key.PublicKey.ECDH()
+	if err != nil {
+		return err
+	}
+	p.public = base64.RawURLEncoding.EncodeToString(pub.Bytes())
+	return nil
+}
+
+func (p *pusher) Start() error {
+	p.done = make(chan struct{})
+	p.stopped = make(chan struct{})
+	go p.loop()
+	return nil
+}
+
+// Send what's queued and stop
+func (p *pusher) Stop() error {
+	p.lock.Lock()
+	if p.round != nil {
+		p.round.Stop()
+	}
+	p.lock.Unlock()
+	close(p.done)
+	<-p.stopped
+	return nil
+}
+
+func (p *pusher) loop() {
+	defer close(p.stopped)
+	batch := time.NewTicker(pushBatch)
+	defer batch.Stop()
+	prune := time.NewTicker(pushPrune)
+	defer prune.Stop()
+	for {
+		select {
+		case <-batch.C:
+			p.flush()
+		case <-prune.C:
+			if err := p.s.store.PruneSubscriptions(int(makeTimestamp())); err != nil {
+				log.Println("push: ", err)
+			}
+		case <-p.done:
+			p.flush()
+			return
+		}
+	}
+}
+
+func (p *pusher) HandleEvent(e Event) {
+	if e.Type != "play" || e.Message == nil || e.Message.Announce != nil || !p.s.enabled("push") {
+		return
+	}
+	msg := e.Message
+	p.notify("playing", nil, PushNote{Title: "Now playing", Body: msg.Song.Name, Tag: "playing"}, PushNote{})
+
+	// Voting closes shortly before the end, songs of unknown length
+	// end whenever a client says so
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.round != nil {
+		p.round.Stop()
+		p.round = nil
+	}
+	if msg.Ends == 0 {
+		go p.upNext(false)
+		return
+	}
+	d := time.Duration(msg.Ends-int(makeTimestamp()))*time.Millisecond - roundWarning
+	epoch := msg.Epoch
+	p.round = time.AfterFunc(d, func() { p.roundEnding(epoch) })
+}
+
+func (p *pusher) roundEnding(epoch int) {
+	p.s.songLock.Lock()
+	playing := p.s.songPlaying.Epoch
+	p.s.songLock.Unlock()
+	if playing == epoch {
+		p.upNext(true)
+	}
+}
+
+// Tell the upvoters of the song that would play next, and if the
+// round is ending everyone else who asked
+func (p *pusher) upNext(round bool) {
+	s := p.s
+	s.songLock.Lock()
+	name, ok := s.pool.Next()
+	track := s.songTrack[name]
+	s.songLock.Unlock()
+	if !ok {
+		return
+	}
+
+	voters := make(map[string]bool)
+	if track != "" {
+		sessions, err := s.store.Voters(*roomName, track)
+		if err != nil {
+			log.Println("push: ", err)
+		}
+		for _, id := range sessions {
+			voters[id] = true
+		}
+	}
+	mine := PushNote{Title: "Up next", Body: name, Tag: "next"}
+	var others PushNote
+	if round {
+		others = PushNote{Title: "Voting closes soon", Body: "Next up so far: " + name, Tag: "round"}
+	}
+	p.notify("next", voters, mine, others)
+}
+
+// Queue note for subscriptions wanting event, or for those of sessions
+// in voters if it isn't nil. Anyone else who wants "round" gets round
+// if it has a title.
+func (p *pusher) notify(event string, voters map[string]bool, note, round PushNote) {
+	subs, err := p.s.store.Subscriptions()
+	if err != nil {
+		log.Println("push: ", err)
+		return
+	}
+	for _, sub := range subs {
+		switch {
+		case sub.wants(event) && (voters == nil || voters[sub.Session]):
+			p.queue(sub, note)
+		case round.Title != "" && sub.wants("round"):
+			p.queue(sub, round)
+		}
+	}
+}
+
+func (p *pusher) queue(sub PushSubscription, note PushNote) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	q, ok := p.pending[sub.Endpoint]
+	if !ok {
+		q = &pushQueued{sub: sub}
+		p.pending[sub.Endpoint] = q
+	}
+	for i := range q.notes {
+		if q.notes[i].Tag == note.Tag {
+			q.notes[i] = note
+			return
+		}
+	}
+	q.notes = append(q.notes, note)
+}
+
+// Send everything queued, pushWorkers endpoints at a time
+func (p *pusher) flush() {
+	p.lock.Lock()
+	pending := p.pending
+	p.pending = make(map[string]*pushQueued)
+	p.lock.Unlock()
+	if len(pending) == 0 {
+		return
+	}
+
+	work := make(chan *pushQueued)
+	var wg sync.WaitGroup
+	for i := 0; i < pushWorkers && i < len(pending); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for q := range work {
+				for _, note := range q.notes {
+					if gone := p.send(q.sub, note); gone {
+						break
+					}
+				}
+			}
+		}()
+	}
+	for _, q := range pending {
+		work <- q
+	}
+	close(work)
+	wg.Wait()
+}
+
+// Send a notification, reports whether the subscription has gone and
+// was deleted
+func (p *pusher) send(sub PushSubscription, note PushNote) bool {
+	b, err := json.Marshal(note)
+	if err != nil {
+		log.Println("push: ", err)
+		return false
+	}
+	body, err := pushEncrypt(sub.Keys, b)
+	if err != nil {
+		log.Println("push: ", err)
+		return false
+	}
+	auth, err := p.vapid(sub.Endpoint)
+	if err != nil {
+		log.Println("push: ", err)
+		return false
+	}
+	req, err := http.NewRequest("POST", sub.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		log.Println("push: ", err)
+		return false
+	}
+	req.Header.Set("Authorization", auth)
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("Content-Encoding", "aes128gcm")
+	req.Header.Set("TTL", strconv.Itoa(int(pushTTL/time.Second)))
+	req.Header.Set("Topic", note.Tag)
+	req.Header.Set("Urgency", "normal")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		log.Println("push: ", err)
+		return false
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+		log.Println("push: Subscription gone, deleting")
+		if err := p.s.store.DeleteSubscription(sub.Endpoint); err != nil {
+			log.Println("push: ", err)
+		}
+		return true
+	case resp.StatusCode/100 != 2:
+		log.Println("push: ", fmt.Sprintf("%s: %s", note.Tag, resp.Status))
+	}
+	return false
+}
+
+// Authorization header for an endpoint, a VAPID JWT for its origin
+// (RFC 8292)
+func (p *pusher) vapid(endpoint string) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(map[string]interface{}{
+		"aud": u.Scheme + "://" + u.Host,
+		"exp": time.Now().Add(12 * time.Hour).Unix(),
+		"sub": p.contact,
+	})
+	if err != nil {
+		return "", err
+	}
+	enc := base64.RawURLEncoding
+	token := enc.EncodeToString([]byte(`{"typ":"JWT","alg":"ES256"}`)) + "." + enc.EncodeToString(claims)
+	h := sha256.Sum256([]byte(token))
+	r, s, err := ecdsa.Sign(rand.Reader, p.key, h[:])
+	if err != nil {
+		return "", err
+	}
+	sig := make([]byte, 64)
+	r.FillBytes(sig[:32])
+	s.FillBytes(sig[32:])
+	return "vapid t=" + token + "." + enc.EncodeToString(sig) + ", k=" + p.public, nil
+}
+
+// Encrypt a payload for a subscription as a single aes128gcm record
+// (RFC 8291)
+func pushEncrypt(keys PushKeys, plain []byte) ([]byte, error) {
+	enc := base64.RawURLEncoding
+	uaKey, err := enc.DecodeString(strings.TrimRight(keys.P256dh, "="))
+	if err != nil {
+		return nil, err
+	}
+	secret, err := enc.DecodeString(strings.TrimRight(keys.Auth, "="))
+	if err != nil {
+		return nil, err
+	}
+	ua, err := ecdh.P256().NewPublicKey(uaKey)
+	if err != nil {
+		return nil, err
+	}
+	as, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := as.ECDH(ua)
+	if err != nil {
+		return nil, err
+	}
+	asKey := as.PublicKey().Bytes()
+
+	info := "WebPush: info\x00" + string(uaKey) + string(asKey)
+	ikm, err := hkdf.Key(sha256.New, shared, secret, info, 32)
+	if err != nil {
+		return nil, err
+	}
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	cek, err := hkdf.Key(sha256.New, ikm, salt, "Content-Encoding: aes128gcm\x00", 16)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := hkdf.Key(sha256.New, ikm, salt, "Content-Encoding: nonce\x00", 12)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	// Header of salt, record size and our key, then the record with its
+	// last record delimiter
+	out := append([]byte{}, salt...)
+	out = binary.BigEndian.AppendUint32(out, 4096)
+	out = append(out, byte(len(asKey)))
+	out = append(out, asKey...)
+	return gcm.Seal(out, nonce, append(plain, 2), nil), nil
+}
+
+// Push handle. GET for the application server key and events, POST a
+// subscription to start and DELETE ?endpoint= to stop.
+func (s *Server) pushAPI(w http.ResponseWriter, r *http.Request) error {
+	if s.push == nil || !s.enabled("push") {
+		http.Error(w, "push disabled", http.StatusNotFound)
+		return nil
+	}
+	switch r.Method {
+	case "GET":
+		w.Header().Set("Content-Type", "application/json")
+		return json.NewEncoder(w).Encode(PushInfo{PublicKey: s.push.public, Events: pushEvents})
+	case "POST":
+		var sub PushSubscription
+		if err := json.NewDecoder(r.Body).Decode(&sub); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return nil
+		}
+		if !pushHost(sub.Endpoint) {
+			http.Error(w, "endpoint is not a known push service", http.StatusBadRequest)
+			return nil
+		}
+		if sub.Keys.P256dh == "" || sub.Keys.Auth == "" {
+			http.Error(w, "missing keys", http.StatusBadRequest)
+			return nil
+		}
+		var events []string
+		for _, e := range sub.Events {
+			if _, ok := pushEvents[e]; ok {
+				events = append(events, e)
+			}
+		}
+		if len(sub.Events) == 0 {
+			for e := range pushEvents {
+				events = append(events, e)
+			}
+		}
+		sub.Events = events
+
+		sess, err := s.session(r, w.Header())
+		if err != nil {
+			return err
+		}
+		subs, err := s.store.Subscriptions()
+		if err != nil {
+			return err
+		}
+		n := 0
+		for _, v := range subs {
+			if v.Session == sess.ID && v.Endpoint != sub.Endpoint {
+				n++
+			}
+		}
+		if n >= maxPushSubscriptions {
+			http.Error(w, "too many subscriptions", http.StatusTooManyRequests)
+			return nil
+		}
+		sub.Session = sess.ID
+		if err := s.store.SaveSubscription(&sub); err != nil {
+			return err
+		}
+		w.Header().Set("Content-Type", "application/json")
+		return json.NewEncoder(w).Encode(&sub)
+	case "DELETE":
+		endpoint := r.URL.Query().Get("endpoint")
+		if endpoint == "" {
+			http.Error(w, "missing endpoint", http.StatusBadRequest)
+			return nil
+		}
+		sess, err := s.cookieSession(r)
+		if err != nil {
+			return err
+		}
+		subs, err := s.store.Subscriptions()
+		if err != nil {
+			return err
+		}
+		for _, sub := range subs {
+			if sub.Endpoint != endpoint {
+				continue
+			}
+			if (sess == nil || sub.Session != sess.ID) && !s.isAdmin(r) {
+				http.Error(w, "not your subscription", http.StatusForbidden)
+				return nil
+			}
+			return s.store.DeleteSubscription(endpoint)
+		}
+		http.NotFound(w, r)
+		return nil
+	}
+	http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	return nil
+}
+
+// What a page needs to subscribe
+type PushInfo struct {
+	PublicKey string            // VAPID key for pushManager.subscribe
+	Events    map[string]string // Event to description
+}
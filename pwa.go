@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Web app manifest, so guests can add the jukebox to their home screen
+func (s *Server) manifest(w http.ResponseWriter, r *http.Request) error {
+	type icon struct {
+		Src     string `json:"src"`
+		Sizes   string `json:"sizes"`
+		Type    string `json:"type"`
+		Purpose string `json:"purpose,omitempty"`
+	}
+	m := struct {
+		Name            string `json:"name"`
+		ShortName       string `json:"short_name"`
+		StartURL        string `json:"start_url"`
+		Scope           string `json:"scope"`
+		Display         string `json:"display"`
+		BackgroundColor string `json:"background_color"`
+		ThemeColor      string `json:"theme_color"`
+		Icons           []icon `json:"icons"`
+	}{
+		Name:            "Jukebox",
+		ShortName:       "Jukebox",
+		StartURL:        "/",
+		Scope:           "/",
+		Display:         "standalone",
+		BackgroundColor: "#ffffff",
+		ThemeColor:      "#34A9da",
+	}
+	if t := s.settings().Theme; t != nil {
+		if t.Accent != "" {
+			m.ThemeColor = t.Accent
+		}
+		if t.Background != "" {
+			m.BackgroundColor = t.Background
+		}
+	}
+	for _, size := range iconSizes {
+		n := strconv.Itoa(size)
+		m.Icons = append(m.Icons, icon{
+			Src:     "/icon-" + n + ".png",
+			Sizes:   n + "x" + n,
+			Type:    "image/png",
+			Purpose: "any maskable",
+		})
+	}
+	w.Header().Set("Content-Type", "application/manifest+json")
+	return json.NewEncoder(w).Encode(m)
+}
+
+var iconSizes = []int{192, 512}
+
+var (
+	iconOnce sync.Once
+	iconPNGs = make(map[int][]byte)
+)
+
+// Draw a record: accent background, dark disc, label and spindle hole.
+// Maskable icons keep their content inside the middle 80%.
+func drawIcon(size int) []byte {
+	img := image.NewNRGBA(image.Rect(0, 0, size, size))
+	accent := color.NRGBA{0x34, 0xA9, 0xda, 0xff}
+	disc := color.NRGBA{0x40, 0x40, 0x40, 0xff}
+	groove := color.NRGBA{0x55, 0x55, 0x55, 0xff}
+	label := color.NRGBA{0xEE, 0x36, 0x58, 0xff}
+
+	c := float64(size) / 2
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			d := math.Hypot(float64(x)+0.5-c, float64(y)+0.5-c) / c
+			switch {
+			case d < 0.04:
+				img.Set(x, y, accent)
+			case d < 0.22:
+				img.Set(x, y, label)
+			case d < 0.7:
+				if int(d*100)%6 == 0 {
+					img.Set(x, y, groove)
+				} else {
+					img.Set(x, y, disc)
+				}
+			default:
+				img.Set(x, y, accent)
+			}
+		}
+	}
+	var buf bytes.Buffer
+	png.Encode(&buf, img)
+	return buf.Bytes()
+}
+
+// Home screen icons, drawn once on first request
+func (s *Server) icon(w http.ResponseWriter, r *http.Request) error {
+	iconOnce.Do(func() {
+		for _, size := range iconSizes {
+			iconPNGs[size] = drawIcon(size)
+		}
+	})
+	name := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/icon-"), ".png")
+	size, _ := strconv.Atoi(name)
+	b, ok := iconPNGs[size]
+	if !ok {
+		http.NotFound(w, r)
+		return nil
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	_, err := w.Write(b)
+	return err
+}
+
+// Service worker. Served from the root so its scope covers the whole app,
+// and never cached so a new version is picked up on the next visit.
+func (s *Server) serviceWorker(w http.ResponseWriter, r *http.Request) error {
+	w.Header().Set("Content-Type", "application/javascript")
+	w.Header().Set("Cache-Control", "no-cache")
+	_, err := w.Write([]byte(serviceWorkerJS))
+	return err
+}
+
+// Caches the page shell for offline starts, leaves audio, the API and the
+// socket to the network, and shows now playing notifications. Those come
+// either from an open page while it's hidden or as Web Push messages of
+// {Title, Body, Tag, URL}.
+const serviceWorkerJS = `var CACHE = 'jukebox-v1';
+var SHELL = ['/', '/style.css', '/list.min.js', '/manifest.webmanifest', '/icon-192.png'];
+
+self.addEventListener('install', function(e) {
+	e.waitUntil(caches.open(CACHE).then(function(cache) {
+		return cache.addAll(SHELL);
+	}).then(function() {
+		return self.skipWaiting();
+	}));
+});
+
+self.addEventListener('activate', function(e) {
+	e.waitUntil(caches.keys().then(function(keys) {
+		return Promise.all(keys.filter(function(key) {
+			return key != CACHE;
+		}).map(function(key) {
+			return caches.delete(key);
+		}));
+	}).then(function() {
+		return self.clients.claim();
+	}));
+});
+
+self.addEventListener('fetch', function(e) {
+	var req = e.request;
+	var url = new URL(req.url);
+	if (req.method != 'GET' || url.origin != location.origin) {
+		return;
+	}
+	if (/^\/(audio|announce|api|sock|rest)\b/.test(url.pathname)) {
+		return;
+	}
+	if (req.mode == 'navigate') {
+		// Fresh page when online, the cached one when not
+		e.respondWith(fetch(req).then(function(res) {
+			if (url.pathname == '/' && res.ok) {
+				var copy = res.clone();
+				caches.open(CACHE).then(function(cache) { cache.put('/', copy); });
+			}
+			return res;
+		}).catch(function() {
+			return caches.match('/');
+		}));
+		return;
+	}
+	e.respondWith(caches.match(req).then(function(hit) {
+		return hit || fetch(req);
+	}));
+});
+
+var notify = function(msg) {
+	return self.registration.showNotification(msg.Title || 'Jukebox', {
+		body: msg.Body || '',
+		tag: msg.Tag || 'playing',
+		renotify: false,
+		icon: '/icon-192.png',
+		badge: '/icon-192.png',
+		data: {url: msg.URL || '/'}
+	});
+};
+
+self.addEventListener('push', function(e) {
+	var msg = {};
+	try {
+		msg = e.data ? e.data.json() : {};
+	} catch (err) {
+		msg = {Body: e.data.text()};
+	}
+	e.waitUntil(notify(msg));
+});
+
+self.addEventListener('message', function(e) {
+	if (e.data && e.data.Command == 'notify') {
+		e.waitUntil(notify(e.data));
+	}
+});
+
+self.addEventListener('notificationclick', function(e) {
+	e.notification.close();
+	var url = (e.notification.data && e.notification.data.url) || '/';
+	e.waitUntil(self.clients.matchAll({type: 'window', includeUncontrolled: true}).then(function(list) {
+		for (var i = 0; i < list.length; i++) {
+			if ('focus' in list[i]) {
+				return list[i].focus();
+			}
+		}
+		return self.clients.openWindow(url);
+	}));
+});
+`
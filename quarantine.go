@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/emcfarlane/jukebox/core"
+)
+
+// Loudest sample in dB below which a file counts as silent
+const silenceDB = -90
+
+var maxVolume = regexp.MustCompile(`max_volume: (-inf|-?[0-9.]+) dB`)
+
+// A file kept out of the pool, times in ms
+type Quarantined struct {
+	Name   string
+	Reason string
+	Time   int
+}
+
+// Decode a file to find ones that are empty, corrupt or silent.
+// Returns why the file is bad, or "" if it plays.
+func probe(ctx context.Context, name string) (string, error) {
+	path := musicPath(name)
+	fi, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	if fi.Size() == 0 {
+		return "empty file", nil
+	}
+	if !*probeFiles {
+		return "", nil
+	}
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, *ffmpeg, "-nostats", "-i", path, "-vn", "-af", "volumedetect", "-f", "null", "-")
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return "", ctx.Err() // Killed, not corrupt
+		}
+		if _, ok := err.(*exec.ExitError); !ok {
+			return "", err
+		}
+		lines := strings.Split(strings.TrimSpace(stderr.String()), "\n")
+		return "corrupt: " + lines[len(lines)-1], nil
+	}
+
+	m := maxVolume.FindSubmatch(stderr.Bytes())
+	if m == nil {
+		return "no audio", nil
+	}
+	if v, err := strconv.ParseFloat(string(m[1]), 64); string(m[1]) == "-inf" || err == nil && v <= silenceDB {
+		return "silent", nil
+	}
+	return "", nil
+}
+
+// Turn off probing if ffmpeg can't be found
+func probeInit() {
+	if !*probeFiles {
+		return
+	}
+	if _, err := exec.LookPath(*ffmpeg); err != nil {
+		log.Println("probe: Disabled, ", err)
+		*probeFiles = false
+	}
+}
+
+// Take a song out of the pool
+func (s *Server) quarantine(name, reason string) {
+	log.Println("Quarantine: ", name, reason)
+	s.songLock.Lock()
+	if s.pool.Has(name) {
+		s.pool.Remove(name)
+		s.record(core.EventRemove, name, 0, int(makeTimestamp()))
+		s.libraryChanged()
+	}
+	s.songLock.Unlock()
+
+	q := Quarantined{Name: name, Reason: reason, Time: int(makeTimestamp())}
+	if err := s.store.Quarantine(q); err != nil {
+		log.Println("quarantine: ", err)
+	}
+}
+
+func (s *Server) quarantined() (map[string]bool, error) {
+	list, err := s.store.Quarantined()
+	if err != nil {
+		return nil, err
+	}
+	bad := make(map[string]bool, len(list))
+	for _, q := range list {
+		bad[q.Name] = true
+	}
+	return bad, nil
+}
+
+// Quarantine list handle, admins only
+func (s *Server) quarantineAPI(w http.ResponseWriter, r *http.Request) error {
+	if !s.isAdmin(r) {
+		http.Error(w, "admin only", http.StatusForbidden)
+		return nil
+	}
+	list, err := s.store.Quarantined()
+	if err != nil {
+		return err
+	}
+	if list == nil {
+		list = []Quarantined{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(list)
+}
+
+// Quarantined file handle, POST probes it again and DELETE removes the file
+func (s *Server) quarantineFileAPI(w http.ResponseWriter, r *http.Request) error {
+	if !s.isAdmin(r) {
+		http.Error(w, "admin only", http.StatusForbidden)
+		return nil
+	}
+	name := strings.TrimPrefix(r.URL.Path, "/api/v1/quarantine/")
+	bad, err := s.quarantined()
+	if err != nil {
+		return err
+	}
+	if !bad[name] {
+		http.NotFound(w, r)
+		return nil
+	}
+
+	switch r.Method {
+	case "POST":
+		reason, err := probe(r.Context(), name)
+		if err != nil {
+			return err
+		}
+		if reason != "" {
+			s.quarantine(name, reason)
+		} else {
+			if err := s.store.Release(name); err != nil {
+				return err
+			}
+			log.Println("Released: ", name)
+			m, err := s.fileMeta(name)
+			if err != nil {
+				return err
+			}
+			m.Probed = *probeFiles
+			if err := s.store.Index([]Meta{m}); err != nil {
+				return err
+			}
+			s.songLock.Lock()
+			s.songAdd(m)
+			s.libraryChanged()
+			s.songLock.Unlock()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		return json.NewEncoder(w).Encode(&Quarantined{Name: name, Reason: reason})
+	case "DELETE":
+		if err := os.Remove(musicPath(name)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("delete %s: %v", name, err)
+		}
+		if err := s.store.Release(name); err != nil {
+			return err
+		}
+		log.Println("Deleted: ", name)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+	return nil
+}
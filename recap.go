@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	nightGap     = 3 * time.Hour    // Time without a play that ends a night
+	maxPlayTime  = 15 * time.Minute // Most a play counts for, songs aren't timed
+	recapEntries = 10               // Top songs and voters kept
+)
+
+// The night being played, guarded by songLock. Times in ms.
+type night struct {
+	id    string
+	start int
+	last  int // Last play
+}
+
+// Summary of a night, kept so it can be shared afterwards. Times in ms.
+type Recap struct {
+	ID        string
+	Room      string
+	Start     int
+	End       int
+	PlayTime  int // Seconds
+	Setlist   []Play
+	TopSongs  []RecapSong
+	TopVoters []RecapVoter
+}
+
+// Song by the weighted votes it got in a night
+type RecapSong struct {
+	Name  string
+	Score float64
+	Votes int
+}
+
+// Voter by display name, the session isn't shared
+type RecapVoter struct {
+	Name  string
+	Votes int
+}
+
+func (r *Recap) Date() string {
+	return time.Unix(0, int64(r.Start)*int64(time.Millisecond)).Format("Mon 2 Jan 2006")
+}
+
+func (r *Recap) Length() string {
+	return (time.Duration(r.PlayTime) * time.Second).String()
+}
+
+// Count a play towards the night, starting a new one after a gap.
+// songLock must be held.
+func (s *Server) nightPlay(now int) {
+	if s.night.id != "" && now-s.night.last > int(nightGap/time.Millisecond) {
+		s.nightEnd(s.night.last + int(maxPlayTime/time.Millisecond))
+	}
+	if s.night.id == "" {
+		id, err := randomID()
+		if err != nil {
+			log.Println("recap: ", err)
+			return
+		}
+		s.night = night{id: id, start: now}
+	}
+	s.night.last = now
+}
+
+// End the night and save its recap in the background, songLock must
+// be held
+func (s *Server) nightEnd(end int) {
+	if s.night.id == "" {
+		return
+	}
+	n := s.night
+	s.night = night{}
+	go func() {
+		if _, err := s.recapSave(n, end); err != nil {
+			log.Println("recap: ", err)
+		}
+	}()
+}
+
+// Save the night on shutdown
+func (s *Server) recapShutdown() {
+	s.songLock.Lock()
+	n := s.night
+	s.night = night{}
+	s.songLock.Unlock()
+	if n.id == "" {
+		return
+	}
+	if _, err := s.recapSave(n, int(makeTimestamp())); err != nil {
+		log.Println("recap: ", err)
+	}
+}
+
+func (s *Server) recapSave(n night, end int) (*Recap, error) {
+	plays, err := s.store.Plays(*roomName, n.start, end)
+	if err != nil {
+		return nil, err
+	}
+	songs, voters, err := s.store.VoteTotals(*roomName, n.start, end, recapEntries)
+	if err != nil {
+		return nil, err
+	}
+	r := &Recap{
+		ID:        n.id,
+		Room:      *roomName,
+		Start:     n.start,
+		End:       end,
+		Setlist:   plays,
+		TopSongs:  songs,
+		TopVoters: voters,
+	}
+
+	// Each play lasts until the next, less any idle time
+	for i, p := range plays {
+		until := end
+		if i+1 < len(plays) {
+			until = plays[i+1].Time
+		}
+		d := until - p.Time
+		if max := int(maxPlayTime / time.Millisecond); d > max {
+			d = max
+		}
+		r.PlayTime += d / 1000
+	}
+
+	if err := s.store.SaveRecap(r); err != nil {
+		return nil, err
+	}
+	log.Println("Recap: ", s.baseURL()+"/recap/"+r.ID)
+	return r, nil
+}
+
+// Recap page, JSON with ?format=json
+func (s *Server) recap(w http.ResponseWriter, r *http.Request) error {
+	id := strings.TrimPrefix(r.URL.Path, "/recap/")
+	return s.recapServe(w, r, id, r.FormValue("format") == "json")
+}
+
+func (s *Server) recapServe(w http.ResponseWriter, r *http.Request, id string, asJSON bool) error {
+	rc, err := s.store.Recap(id)
+	if err != nil {
+		return err
+	}
+	if rc == nil {
+		http.NotFound(w, r)
+		return nil
+	}
+	if asJSON {
+		w.Header().Set("Content-Type", "application/json")
+		return json.NewEncoder(w).Encode(rc)
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	return s.tmpl.ExecuteTemplate(w, "recap.html", rc)
+}
+
+// Recap handle
+func (s *Server) recapAPI(w http.ResponseWriter, r *http.Request) error {
+	return s.recapServe(w, r, strings.TrimPrefix(r.URL.Path, "/api/v1/recaps/"), true)
+}
+
+// Recaps handle, POST ends the night now and returns its recap
+func (s *Server) recapsAPI(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return nil
+	}
+	if !s.isAdmin(r) {
+		http.Error(w, "admin only", http.StatusForbidden)
+		return nil
+	}
+
+	s.songLock.Lock()
+	n := s.night
+	s.night = night{}
+	s.songLock.Unlock()
+	if n.id == "" {
+		http.Error(w, "nothing played", http.StatusConflict)
+		return nil
+	}
+	rc, err := s.recapSave(n, int(makeTimestamp()))
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(rc)
+}
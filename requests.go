@@ -0,0 +1,270 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emcfarlane/jukebox/core"
+)
+
+// Largest song a guest can upload, and how many songs and bytes a
+// session can upload over requestWindow
+const (
+	maxRequest      = 50 << 20
+	maxRequests     = 10
+	maxRequestBytes = 200 << 20
+	requestWindow   = 24 * time.Hour
+)
+
+// What came of a song request. A song already in the library is
+// merged, the request counts as the requester's vote for it.
+type RequestResult struct {
+	Song   string // Name in the pool
+	Merged bool   `json:",omitempty"`
+	Reason string `json:",omitempty"` // Why it was merged
+	Score  float64
+}
+
+// Folded artist and title, "" without an artist to tell songs apart
+func titleKey(m Meta) string {
+	if strings.TrimSpace(m.Artist) == "" {
+		return ""
+	}
+	fold := func(v string) string {
+		return strings.Join(strings.Fields(core.Fold(v)), " ")
+	}
+	return fold(m.Artist) + "\x00" + fold(m.Title)
+}
+
+// Song in the pool that m duplicates and why, songLock must be held
+func (s *Server) duplicate(m Meta) (string, string) {
+	if name, ok := s.trackSong[m.Track]; ok && s.pool.Has(name) {
+		return name, "same audio"
+	}
+	if name, ok := s.titleSong[titleKey(m)]; ok && s.pool.Has(name) {
+		return name, "same title and artist"
+	}
+	return "", ""
+}
+
+// Uploads over requestWindow, by session
+type requestQuota struct {
+	lock  *sync.Mutex
+	start map[string]time.Time
+	count map[string]int
+	bytes map[string]int64
+}
+
+func newRequestQuota() *requestQuota {
+	return &requestQuota{
+		lock:  &sync.Mutex{},
+		start: make(map[string]time.Time),
+		count: make(map[string]int),
+		bytes: make(map[string]int64),
+	}
+}
+
+// Count an upload of n bytes, false if it's over the session's quota
+func (q *requestQuota) take(session string, n int64) bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	now := time.Now()
+	if now.Sub(q.start[session]) > requestWindow {
+		q.start[session] = now
+		q.count[session], q.bytes[session] = 0, 0
+	}
+	if q.count[session] >= maxRequests || q.bytes[session]+n > maxRequestBytes {
+		return false
+	}
+	q.count[session]++
+	q.bytes[session] += n
+	return true
+}
+
+// A free name in the library for an upload
+func requestName(name string, fm Format) string {
+	name = filepath.Base(strings.TrimSpace(name))
+	if strings.HasPrefix(name, ".") || name == string(filepath.Separator) {
+		name = ""
+	}
+	ext := filepath.Ext(name)
+	if audioExts[strings.ToLower(ext)] == "" {
+		ext = "." + fm.Container
+		for e, c := range audioExts {
+			if c == fm.Container && len(e) <= len(ext) {
+				ext = e // Shortest, so .mp4 is .m4a
+			}
+		}
+	}
+	base := strings.TrimSuffix(name, filepath.Ext(name))
+	if base == "" {
+		base = "Request"
+	}
+	return base + ext
+}
+
+// Write an upload to a hidden file in the library, so it can be probed
+// and moved into place, and hash it on the way
+func requestTemp(body io.Reader) (string, string, int64, error) {
+	f, err := ioutil.TempFile(musicDir(), ".request-")
+	if err != nil {
+		return "", "", 0, err
+	}
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(f, h), body)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", "", n, err
+	}
+	return filepath.Base(f.Name()), hex.EncodeToString(h.Sum(nil)), n, nil
+}
+
+// Link an upload into the library under name, or a free one like it.
+// The upload is left for the caller to remove.
+func requestSave(tmp, name string) (string, error) {
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	for i := 1; i < 100; i++ {
+		if i > 1 {
+			name = fmt.Sprintf("%s (%d)%s", base, i, ext)
+		}
+		err := os.Link(musicPath(tmp), musicPath(name))
+		if os.IsExist(err) {
+			continue
+		}
+		return name, err
+	}
+	return "", fmt.Errorf("requests: no free name for %s", name)
+}
+
+// Requests handle, guests POST an audio file, named by ?name=, to add
+// it to the library. A song that's already there, by its audio or its
+// artist and title, takes the request as a vote instead.
+func (s *Server) requestsAPI(w http.ResponseWriter, r *http.Request) error {
+	if !*allowRequests {
+		http.Error(w, "requests are switched off", http.StatusForbidden)
+		return nil
+	}
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return nil
+	}
+	sess, err := s.session(r, w.Header())
+	if err != nil {
+		return err
+	}
+	targets := []string{"session:" + sess.ID}
+	if ip := clientIP(r); ip != "" {
+		targets = append(targets, "ip:"+ip)
+	}
+	if b := s.abuse.banned(targets...); b != nil {
+		banError(w, b)
+		return nil
+	}
+	if r.ContentLength > maxRequest {
+		http.Error(w, "file too large", http.StatusRequestEntityTooLarge)
+		return nil
+	}
+
+	tmp, track, size, err := requestTemp(http.MaxBytesReader(w, r.Body, maxRequest))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return nil
+	}
+	defer os.Remove(musicPath(tmp))
+	if !s.requestQuota.take(sess.ID, size) {
+		http.Error(w, "too many requests, try again tomorrow", http.StatusTooManyRequests)
+		return nil
+	}
+
+	// The checks a scan makes, before anything is held
+	f, err := os.Open(musicPath(tmp))
+	if err != nil {
+		return err
+	}
+	_, ferr := readFormat(f)
+	if ferr == nil {
+		_, ferr = f.Seek(0, 0)
+	}
+	if ferr != nil {
+		f.Close()
+		http.Error(w, "not an audio file", http.StatusUnsupportedMediaType)
+		return nil
+	}
+	m, err := metaOf(r.FormValue("name"), f)
+	f.Close()
+	if err != nil {
+		log.Println("requests: ", err) // Tags are optional
+	}
+	m.Track = track
+	if bad, err := probe(r.Context(), tmp); err != nil {
+		return err
+	} else if bad != "" {
+		http.Error(w, "can't be played: "+bad, http.StatusUnprocessableEntity)
+		return nil
+	}
+	m.Probed = *probeFiles
+	if !m.Explicit && *explicitURL != "" {
+		if m.Explicit, err = explicitLookup(r.Context(), m); err != nil {
+			log.Println("requests: ", err)
+		}
+	}
+	m.Name = requestName(m.Name, m.Format)
+	if m.Title == "" {
+		m.Title = strings.TrimSuffix(m.Name, filepath.Ext(m.Name))
+	}
+
+	u := &User{session: sess}
+	now := int(makeTimestamp())
+	s.songLock.Lock()
+	name, reason := s.duplicate(m)
+	if name == "" {
+		if m.Name, err = requestSave(tmp, m.Name); err != nil {
+			s.songLock.Unlock()
+			return err
+		}
+		s.songAdd(m)
+		s.libraryChanged()
+		name = m.Name
+	}
+	s.songLock.Unlock()
+
+	status := http.StatusOK
+	if reason != "" {
+		log.Println("Requests: Merged into ", name, ", ", reason)
+	} else {
+		log.Println("Requests: Added ", name)
+		if info, err := os.Stat(musicPath(name)); err == nil {
+			m.Size, m.ModTime = info.Size(), info.ModTime().UnixNano()
+			s.cache.remember(musicPath(name), Stamp{Size: m.Size, ModTime: m.ModTime, Track: m.Track})
+		}
+		if err := s.store.Index([]Meta{m}); err != nil {
+			log.Println("requests: ", err)
+		}
+		status = http.StatusCreated
+	}
+	if s.votable(name) && s.allow(u, now) {
+		s.vote(u, Message{Command: "plus", Song: Song{Name: name}}, now)
+	}
+
+	s.songLock.Lock()
+	v := RequestResult{Song: name, Merged: reason != "", Reason: reason, Score: s.pool.Score(name)}
+	s.songLock.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	return json.NewEncoder(w).Encode(&v)
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Songs committed to the index per transaction
+const scanBatch = 500
+
+// Library scan progress
+type ScanStatus struct {
+	Scanning  bool
+	Scanned   int
+	Total     int
+	Errors    int
+	LastError string `json:",omitempty"`
+
+	Library string // Directory scanned
+	Missing bool   `json:",omitempty"` // It doesn't exist
+	Empty   bool   `json:",omitempty"` // It has no audio files
+}
+
+type scanResult struct {
+	meta Meta
+	bad  string // Why the file was quarantined
+	err  error
+}
+
+// Read a file's metadata, a bad file never stops the scan
+func scanFile(name string) (m Meta, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			m = Meta{Name: name, Title: strings.TrimSuffix(name, filepath.Ext(name))}
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return readMeta(name)
+}
+
+// Read a file's metadata and hash, as a scan does
+func (s *Server) fileMeta(name string) (Meta, error) {
+	m, err := scanFile(name)
+	if err == nil && !m.Explicit && *explicitURL != "" {
+		if m.Explicit, err = explicitLookup(s.ctx, m); err != nil {
+			log.Println("scan: ", name, err)
+			err = nil
+		}
+	}
+	if fh, err := s.cache.stamp(musicPath(name)); err == nil {
+		m.Track, m.Size, m.ModTime = fh.hash, fh.size, fh.modTime.UnixNano()
+	} else {
+		log.Println("scan: hash ", name, err)
+	}
+	return m, err
+}
+
+// Scan files with a pool of workers, committing results in batches.
+// Files that decoded cleanly as they are now, by stamps, aren't probed
+// again.
+func (s *Server) scanFiles(names []string, stamps map[string]Stamp) {
+	workers := *scanWorkers
+	if workers < 1 {
+		workers = 1
+	}
+
+	jobs := make(chan string)
+	results := make(chan scanResult)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for name := range jobs {
+				m, err := s.fileMeta(name)
+				var bad string
+				if st, ok := stamps[name]; ok && st.Probed && st.Size == m.Size && st.ModTime == m.ModTime {
+					m.Probed = true
+				} else if err == nil {
+					if bad, err = probe(s.ctx, name); err != nil {
+						log.Println("scan: probe ", name, err)
+						err = nil
+					} else {
+						m.Probed = bad == "" && *probeFiles
+					}
+				}
+				results <- scanResult{m, bad, err}
+			}
+		}()
+	}
+	go func() {
+		defer close(jobs)
+		for _, name := range names {
+			select {
+			case jobs <- name:
+			case <-s.ctx.Done():
+				return // Shutting down
+			}
+		}
+	}()
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	var batch []Meta
+	commit := func() {
+		if err := s.store.Index(batch); err != nil {
+			s.scanError("index", err)
+		}
+		if len(batch) > 0 {
+			s.songLock.Lock()
+			s.libraryChanged() // Tags may have changed, and search with them
+			s.songLock.Unlock()
+		}
+		batch = batch[:0]
+	}
+	for r := range results {
+		if r.bad != "" {
+			s.quarantine(r.meta.Name, r.bad)
+		} else {
+			s.songLock.Lock()
+			s.songAdd(r.meta)
+			s.songLock.Unlock()
+		}
+
+		s.scanProgress(r.meta.Name, r.err)
+		batch = append(batch, r.meta)
+		if len(batch) >= scanBatch {
+			commit()
+		}
+	}
+	commit()
+}
+
+func (s *Server) scanStart(dir string, total int) {
+	s.scanLock.Lock()
+	s.scan = ScanStatus{Scanning: true, Total: total, Library: dir}
+	status := s.scan
+	s.scanLock.Unlock()
+
+	log.Println("Scanning: ", total)
+	s.sockWriteLoop(&Message{Command: "scan", Scan: &status})
+}
+
+// Count a scanned file, broadcasting progress a few times a second
+func (s *Server) scanProgress(name string, err error) {
+	s.scanLock.Lock()
+	s.scan.Scanned++
+	if err != nil {
+		log.Println("scan: ", name, err)
+		s.scan.Errors++
+		s.scan.LastError = name + ": " + err.Error()
+	}
+	status := s.scan
+	send := time.Since(s.scanSent) > 250*time.Millisecond
+	if send {
+		s.scanSent = time.Now()
+	}
+	s.scanLock.Unlock()
+
+	if send {
+		s.sockWriteLoop(&Message{Command: "scan", Scan: &status})
+	}
+}
+
+// Record an error not tied to a file
+func (s *Server) scanError(what string, err error) {
+	s.scanLock.Lock()
+	defer s.scanLock.Unlock()
+	log.Println("scan: ", what, err)
+	s.scan.Errors++
+	s.scan.LastError = what + ": " + err.Error()
+}
+
+func (s *Server) scanDone(err error) {
+	s.scanLock.Lock()
+	s.scan.Scanning = false
+	if err != nil {
+		s.scan.Errors++
+		s.scan.LastError = err.Error()
+	}
+	status := s.scan
+	s.scanLock.Unlock()
+
+	log.Printf("Scanned: %d/%d, %d errors", status.Scanned, status.Total, status.Errors)
+	msg := &Message{Command: "scan", Scan: &status}
+	s.sockWriteLoop(msg)
+	s.emit(msg)
+}
+
+func (s *Server) scanStatus() ScanStatus {
+	s.scanLock.Lock()
+	defer s.scanLock.Unlock()
+	return s.scan
+}
+
+// Scan status handle
+func (s *Server) scanAPI(w http.ResponseWriter, r *http.Request) error {
+	status := s.scanStatus()
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(&status)
+}
+
+// Song list handle, best first or by name with ?sort=name
+func (s *Server) songsAPI(w http.ResponseWriter, r *http.Request) error {
+	s.songLock.Lock()
+	songs := []Song{}
+	for _, song := range s.pool.Songs() {
+		songs = append(songs, Song{Name: song.Name, Score: song.Score, Up: song.Up, Down: song.Down, Track: s.songTrack[song.Name]})
+	}
+	version := s.libraryVersion()
+	s.songLock.Unlock()
+	if r.FormValue("sort") == "name" {
+		sort.SliceStable(songs, func(i, j int) bool { return s.collate.Compare(songs[i].Name, songs[j].Name) < 0 })
+	}
+
+	// The queue, best first
+	if wantM3U(r) {
+		names := make([]string, len(songs))
+		for i, song := range songs {
+			names[i] = song.Name
+		}
+		return s.writeM3U(w, "queue", names, r.FormValue("local") != "")
+	}
+	return writeListing(w, r, version, songs)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+const (
+	fadeTime     = 5 * time.Second // Fade out length, as in base.html
+	advanceGrace = 2 * time.Second // Time clients have to end a song first
+)
+
+// Length of a play in ms, less any skipped intro and cut short by a fade
+// out. 0 if unknown.
+func playLength(duration int, hints *Hints) int {
+	if duration <= 0 || hints == nil {
+		return duration
+	}
+	if hints.Fade > 0 {
+		if end := int(hints.Fade*1000) + int(fadeTime/time.Millisecond); end < duration {
+			duration = end
+		}
+	}
+	duration -= int(hints.Start * 1000)
+	if duration < 0 {
+		duration = 0
+	}
+	return duration
+}
+
+// Move on once the playing song ends, so the queue keeps going without
+// clients. Songs of unknown length still wait for a client's next.
+// songLock must be held.
+func (s *Server) schedule() {
+	if s.advance != nil {
+		s.advance.Stop()
+		s.advance = nil
+	}
+	msg := s.songPlaying
+	msg.Ends = 0
+	length := playLength(msg.Duration, msg.Song.Hints)
+	if length <= 0 || s.sleep.Stopped || s.liveAt != 0 {
+		return
+	}
+	msg.Ends = msg.Time + length
+
+	epoch := msg.Epoch
+	d := time.Duration(msg.Ends-int(makeTimestamp()))*time.Millisecond + advanceGrace
+	s.advance = time.AfterFunc(d, func() { s.ended(epoch) })
+}
+
+// Play the next song if epoch is still playing
+func (s *Server) ended(epoch int) {
+	s.songLock.Lock()
+	playing := *s.songPlaying
+	s.songLock.Unlock()
+	if playing.Epoch != epoch {
+		return // A client got there first
+	}
+	log.Println("Ended: ", playing.Song.Name)
+	s.next(playing.Song, epoch)
+}
+
+// Why a client's next can't be applied, with the play it should be on.
+// A next for an earlier epoch lost a race with another client or the
+// scheduler, and a song can't be ended before its time, only skipped.
+// The queue is held while live.
+func (s *Server) nextRefused(epoch int) (string, *Message) {
+	s.songLock.Lock()
+	defer s.songLock.Unlock()
+	playing := s.songPlaying
+	if epoch != playing.Epoch {
+		return "stale epoch", playing
+	}
+	if s.liveAt != 0 {
+		return "live", playing
+	}
+	if playing.Ends != 0 && int(makeTimestamp()) < playing.Ends-int(advanceGrace/time.Millisecond) {
+		return "song hasn't ended", playing
+	}
+	return "", playing
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emcfarlane/jukebox/core"
+)
+
+// REST endpoints described in the schema, keep in step with main
+var restAPI = []struct {
+	Method, Path      string
+	Request, Response interface{}
+}{
+	{"GET", "/api/v1/songs?format=&local=&version=&sort=", nil, []Song{}},
+	{"GET", "/api/v1/search?q=&limit=&version=", nil, []Song{}},
+	{"GET", "/api/v1/version?version=", nil, LibraryVersion{}},
+	{"POST", "/api/v1/scan", nil, nil},
+	{"GET", "/api/v1/scan/status", nil, ScanStatus{}},
+	{"GET", "/api/v1/library", nil, ScanStatus{}},
+	{"POST", "/api/v1/library", LibraryConfig{}, nil},
+	{"GET", "/api/v1/cache", nil, CacheStats{}},
+	{"GET", "/api/v1/history?limit=&room=&format=&local=", nil, []Play{}},
+	{"GET", "/api/v1/nowplaying?format=", nil, NowPlaying{}},
+	{"GET", "/api/v1/tracks/{id}", nil, Track{}},
+	{"GET", "/api/v1/playlists", nil, []string{}},
+	{"GET", "/api/v1/playlists/{name}?format=&local=", nil, []string{}},
+	{"PUT", "/api/v1/playlists/{name}", []string{}, nil},
+	{"PUT", "/api/v1/playlists/{name}?format=", nil, PlaylistImport{}},
+	{"DELETE", "/api/v1/playlists/{name}", nil, nil},
+	{"POST", "/api/v1/login?token=", nil, Session{}},
+	{"POST", "/api/v1/invites", Invite{}, Invite{}},
+	{"GET", "/api/v1/weights", nil, Weights{}},
+	{"PUT", "/api/v1/weights", Weights{}, Weights{}},
+	{"GET", "/api/v1/family", nil, Family{}},
+	{"POST", "/api/v1/family", Family{}, Family{}},
+	{"GET", "/api/v1/announce", nil, []Announcement{}},
+	{"POST", "/api/v1/announce", Announcement{}, Announcement{}},
+	{"GET", "/api/v1/quarantine", nil, []Quarantined{}},
+	{"POST", "/api/v1/quarantine/{name}", nil, Quarantined{}},
+	{"DELETE", "/api/v1/quarantine/{name}", nil, nil},
+	{"GET", "/api/v1/recaps/{id}", nil, Recap{}},
+	{"POST", "/api/v1/recaps", nil, Recap{}},
+	{"GET", "/api/v1/profile", nil, Profile{}},
+	{"GET", "/api/v1/profiles/{id}", nil, Profile{}},
+	{"GET", "/feeds/played.atom?room=&upcoming=", nil, nil},
+	{"GET", "/api/v1/events?after=&room=", nil, core.Event{}},
+	{"GET", "/api/v1/logs?lines=", nil, []string{}},
+	{"GET", "/api/v1/stats", nil, ServerStats{}},
+	{"GET", "/api/v1/bans", nil, []Ban{}},
+	{"DELETE", "/api/v1/bans/{id}", nil, nil},
+	{"GET", "/api/v1/config", nil, Config{}},
+	{"POST", "/api/v1/config", nil, Config{}},
+	{"GET", "/api/v1/connections", nil, []Connection{}},
+	{"DELETE", "/api/v1/connections/{id}", nil, nil},
+	{"POST", "/api/v1/requests?name=", nil, RequestResult{}},
+	{"GET", "/api/v1/push", nil, PushInfo{}},
+	{"POST", "/api/v1/push", PushSubscription{}, PushSubscription{}},
+	{"DELETE", "/api/v1/push?endpoint=", nil, nil},
+	{"GET", "/api/v1/karaoke", nil, Karaoke{}},
+	{"POST", "/api/v1/karaoke", Karaoke{}, Karaoke{}},
+	{"POST", "/api/v1/karaoke/singers", Singer{}, Singer{}},
+	{"DELETE", "/api/v1/karaoke/singers/{id}", nil, nil},
+	{"GET", "/oembed?url=&maxwidth=&maxheight=", nil, OEmbed{}},
+}
+
+// Websocket commands, all carried in a Message
+var sockCommands = map[string][]string{
+	"client": {"plus", "minus", "merge", "next", "live", "unlive", "signal", "hints", "name", "state", "sleep", "listening", "skip"},
+	"server": {"update", "play", "merged", "live", "unlive", "signal", "hints", "session", "scan", "state", "family", "sleep", "ack", "presence", "skip", "karaoke", "version", "config"},
+}
+
+var (
+	schemaOnce sync.Once
+	schemaJSON []byte
+)
+
+// JSON Schema for a Go type, named structs go in defs
+func jsonSchema(t reflect.Type, defs map[string]interface{}) map[string]interface{} {
+	switch t {
+	case reflect.TypeOf(json.RawMessage{}):
+		return map[string]interface{}{}
+	case reflect.TypeOf(time.Time{}):
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		return jsonSchema(t.Elem(), defs)
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": jsonSchema(t.Elem(), defs)}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": jsonSchema(t.Elem(), defs)}
+	case reflect.Struct:
+		ref := map[string]interface{}{"$ref": "#/$defs/" + t.Name()}
+		if _, ok := defs[t.Name()]; ok {
+			return ref
+		}
+		def := map[string]interface{}{"type": "object"}
+		defs[t.Name()] = def // Placeholder for recursive types
+
+		props := map[string]interface{}{}
+		var required []string
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if f.PkgPath != "" {
+				continue // Unexported
+			}
+			name, opts := f.Name, ""
+			if tag := f.Tag.Get("json"); tag != "" {
+				parts := strings.SplitN(tag, ",", 2)
+				if parts[0] == "-" {
+					continue
+				}
+				if parts[0] != "" {
+					name = parts[0]
+				}
+				if len(parts) > 1 {
+					opts = parts[1]
+				}
+			}
+			props[name] = jsonSchema(f.Type, defs)
+			if !strings.Contains(opts, "omitempty") && f.Type.Kind() != reflect.Ptr {
+				required = append(required, name)
+			}
+		}
+		def["properties"] = props
+		if len(required) > 0 {
+			def["required"] = required
+		}
+		return ref
+	}
+	return map[string]interface{}{}
+}
+
+func genSchema() ([]byte, error) {
+	defs := map[string]interface{}{}
+	message := jsonSchema(reflect.TypeOf(Message{}), defs)
+
+	var commands []string
+	seen := map[string]bool{}
+	for _, c := range append(sockCommands["client"], sockCommands["server"]...) {
+		if !seen[c] {
+			seen[c] = true
+			commands = append(commands, c)
+		}
+	}
+	defs["Message"].(map[string]interface{})["properties"].(map[string]interface{})["Command"] =
+		map[string]interface{}{"type": "string", "enum": commands}
+
+	var rest []interface{}
+	for _, e := range restAPI {
+		endpoint := map[string]interface{}{"method": e.Method, "path": e.Path}
+		if e.Request != nil {
+			endpoint["request"] = jsonSchema(reflect.TypeOf(e.Request), defs)
+		}
+		if e.Response != nil {
+			endpoint["response"] = jsonSchema(reflect.TypeOf(e.Response), defs)
+		}
+		rest = append(rest, endpoint)
+	}
+
+	return json.MarshalIndent(map[string]interface{}{
+		"$schema": "https://json-schema.org/draft/2020-12/schema",
+		"$id":     "/api/v1/schema",
+		"title":   "Jukebox API",
+		"$defs":   defs,
+		"x-websocket": map[string]interface{}{
+			"path":     "/sock",
+			"message":  message,
+			"commands": sockCommands,
+		},
+		"x-rest": rest,
+	}, "", "  ")
+}
+
+// Schema handle
+func (s *Server) schemaAPI(w http.ResponseWriter, r *http.Request) error {
+	var err error
+	schemaOnce.Do(func() {
+		schemaJSON, err = genSchema()
+	})
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/schema+json")
+	_, err = w.Write(schemaJSON)
+	return err
+}
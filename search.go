@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// Search the library, best matches first
+func (s *Server) search(q string, limit int) ([]Song, error) {
+	names, err := s.store.Search(q, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	s.songLock.Lock()
+	defer s.songLock.Unlock()
+	songs := []Song{}
+	seen := make(map[string]bool)
+	for _, name := range names {
+		// Aliases match as the song in the pool
+		name = s.canonical(name)
+		if s.pool.Visible(name) && !seen[name] {
+			seen[name] = true
+			t := s.pool.Tally(name)
+			songs = append(songs, Song{Name: name, Score: s.pool.Score(name), Up: t.Up, Down: t.Down})
+		}
+	}
+	return songs, nil
+}
+
+// Search handle
+func (s *Server) searchAPI(w http.ResponseWriter, r *http.Request) error {
+	limit, err := strconv.Atoi(r.FormValue("limit"))
+	if err != nil || limit <= 0 || limit > 500 {
+		limit = 50
+	}
+	s.songLock.Lock()
+	version := s.libraryVersion()
+	s.songLock.Unlock()
+	songs, err := s.search(r.FormValue("q"), limit)
+	if err != nil {
+		return err
+	}
+	return writeListing(w, r, version, songs)
+}
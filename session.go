@@ -0,0 +1,162 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const sessionCookie = "session"
+
+// Browser session, identity for votes and limits
+type Session struct {
+	ID      string
+	Name    string
+	Admin   bool
+	Created time.Time
+	Expires time.Time
+
+	// Granted by an invite link
+	Scope        string    `json:",omitempty"`
+	ScopeExpires time.Time `json:",omitempty"`
+
+	Profile string `json:",omitempty"` // Public ID for the profile page
+}
+
+func randomID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Load the cookie signing key and drop expired sessions
+func (s *Server) sessionInit() error {
+	key, err := s.store.Setting("session_key")
+	if err != nil {
+		return err
+	}
+	if key == "" {
+		b := make([]byte, 32)
+		if _, err := rand.Read(b); err != nil {
+			return err
+		}
+		key = hex.EncodeToString(b)
+		if err := s.store.SetSetting("session_key", key); err != nil {
+			return err
+		}
+	}
+	s.sessionKey = []byte(key)
+
+	// Its own key, so an invite is never a valid cookie or the reverse
+	mac := hmac.New(sha256.New, s.sessionKey)
+	mac.Write([]byte("invite"))
+	s.inviteKey = mac.Sum(nil)
+
+	return s.store.PruneSessions(time.Now())
+}
+
+func (s *Server) sign(id string) string {
+	return sign(s.sessionKey, id)
+}
+
+func (s *Server) unsign(value string) (string, bool) {
+	return unsign(s.sessionKey, value)
+}
+
+func sign(key []byte, id string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(id))
+	return id + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func unsign(key []byte, value string) (string, bool) {
+	i := strings.LastIndex(value, ".")
+	if i < 0 {
+		return "", false
+	}
+	id := value[:i]
+	return id, hmac.Equal([]byte(sign(key, id)), []byte(value))
+}
+
+// Session from a request's cookie, nil if there isn't a valid one
+func (s *Server) cookieSession(r *http.Request) (*Session, error) {
+	c, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return nil, nil
+	}
+	id, ok := s.unsign(c.Value)
+	if !ok {
+		return nil, nil
+	}
+	sess, err := s.store.Session(id)
+	if err != nil {
+		return nil, err
+	}
+	if sess != nil && sess.Expires.Before(time.Now()) {
+		return nil, nil
+	}
+	return sess, nil
+}
+
+// Session for a request, starting a new one if needed. The cookie is
+// added to h so it can be passed to a websocket upgrade.
+func (s *Server) session(r *http.Request, h http.Header) (*Session, error) {
+	now := time.Now()
+	sess, err := s.cookieSession(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if sess == nil {
+		id, err := randomID()
+		if err != nil {
+			return nil, err
+		}
+		sess = &Session{ID: id, Created: now}
+		log.Println("session: New session")
+	}
+	if sess.Profile == "" {
+		id, err := randomID()
+		if err != nil {
+			return nil, err
+		}
+		sess.Profile = id[:12]
+	}
+	sess.Expires = now.Add(*sessionTTL)
+	if err := s.store.SaveSession(sess); err != nil {
+		return nil, err
+	}
+
+	c := &http.Cookie{
+		Name:     sessionCookie,
+		Value:    s.sign(sess.ID),
+		Path:     "/",
+		Expires:  sess.Expires,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode, // Not sent with other sites' POSTs
+	}
+	h.Add("Set-Cookie", c.String())
+	return sess, nil
+}
+
+// Set a user's display name
+func (s *Server) rename(u *User, name string) {
+	name = strings.TrimSpace(name)
+	if r := []rune(name); len(r) > 32 {
+		name = string(r[:32]) // Whole characters
+	}
+	u.session.Name = name
+	if err := s.store.SaveSession(u.session); err != nil {
+		log.Println("rename: ", err)
+		return
+	}
+	s.sockWriteUser(u, &Message{Command: "session", Name: name})
+}
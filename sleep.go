@@ -0,0 +1,69 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// Sleep timer state. Clients ask for Minutes or AfterSong, zero for
+// both cancels. The server sends Until, when playback stops, and
+// Stopped once it has.
+type Sleep struct {
+	Minutes   float64 `json:",omitempty"`
+	AfterSong bool    `json:",omitempty"`
+	Until     int     `json:",omitempty"` // ms
+	Stopped   bool    `json:",omitempty"`
+}
+
+func (z *Sleep) active() bool {
+	return z.Until != 0 || z.AfterSong || z.Stopped
+}
+
+// Set the sleep timer and tell clients, songLock must be held
+func (s *Server) sleepSet(z Sleep) {
+	if s.sleepTimer != nil {
+		s.sleepTimer.Stop()
+		s.sleepTimer = nil
+	}
+	if z.Minutes > 0 && !z.Stopped {
+		if z.Until == 0 {
+			z.Until = int(makeTimestamp()) + int(z.Minutes*60*1000)
+		}
+		d := time.Duration(z.Until-int(makeTimestamp())) * time.Millisecond
+		s.sleepTimer = time.AfterFunc(d, s.sleepEnd)
+	}
+	s.sleep = z
+	log.Printf("Sleep: %+v", z)
+	s.sockWriteLoop(&Message{Command: "sleep", Sleep: &z})
+}
+
+// Sleep command from a client
+func (s *Server) sleepCommand(z *Sleep) {
+	if z == nil {
+		return
+	}
+	if z.Minutes < 0 || z.Minutes > 24*60 {
+		log.Println("sleep: Minutes out of range, ", z.Minutes)
+		return
+	}
+	req := Sleep{Minutes: z.Minutes, AfterSong: z.AfterSong && z.Minutes == 0}
+
+	s.songLock.Lock()
+	s.sleepSet(req)
+	state := s.sleep
+	s.songLock.Unlock()
+	s.publish(&Message{Command: "sleep", Sleep: &state})
+}
+
+// Timer ran out, stop playing
+func (s *Server) sleepEnd() {
+	s.songLock.Lock()
+	defer s.songLock.Unlock()
+	s.sleepStop()
+}
+
+// songLock must be held
+func (s *Server) sleepStop() {
+	s.sleepSet(Sleep{Stopped: true})
+	s.nightEnd(int(makeTimestamp()))
+}
@@ -0,0 +1,1023 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emcfarlane/jukebox/core"
+	_ "github.com/lib/pq"  // Postgres driver
+	_ "modernc.org/sqlite" // SQLite driver
+)
+
+// Tables, created on startup if missing
+var sqliteSchema = []string{
+	`CREATE TABLE IF NOT EXISTS hints (
+		name  TEXT PRIMARY KEY,
+		gain  REAL NOT NULL DEFAULT 0,
+		start REAL NOT NULL DEFAULT 0,
+		fade  REAL NOT NULL DEFAULT 0
+	)`,
+	`CREATE TABLE IF NOT EXISTS tracks (
+		name   TEXT PRIMARY KEY,
+		title  TEXT NOT NULL DEFAULT '',
+		artist TEXT NOT NULL DEFAULT '',
+		album  TEXT NOT NULL DEFAULT '',
+		genre  TEXT NOT NULL DEFAULT ''
+	)`,
+	`CREATE VIRTUAL TABLE IF NOT EXISTS search USING fts5(
+		name UNINDEXED, file, title, artist, album, genre,
+		tokenize = 'unicode61 remove_diacritics 2',
+		prefix = '2 3'
+	)`,
+	`CREATE TABLE IF NOT EXISTS settings (
+		name  TEXT PRIMARY KEY,
+		value TEXT NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS sessions (
+		id      TEXT PRIMARY KEY,
+		name    TEXT NOT NULL DEFAULT '',
+		created INTEGER NOT NULL,
+		expires INTEGER NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS votes (
+		session TEXT NOT NULL,
+		song    TEXT NOT NULL,
+		delta   INTEGER NOT NULL,
+		time    INTEGER NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS votes_session ON votes (session, time)`,
+	`CREATE TABLE IF NOT EXISTS plays (
+		song TEXT NOT NULL,
+		time INTEGER NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS plays_time ON plays (time)`,
+	`CREATE TABLE IF NOT EXISTS playlists (
+		name     TEXT NOT NULL,
+		position INTEGER NOT NULL,
+		song     TEXT NOT NULL,
+		PRIMARY KEY (name, position)
+	)`,
+	`CREATE TABLE IF NOT EXISTS quarantine (
+		name   TEXT PRIMARY KEY,
+		reason TEXT NOT NULL,
+		time   INTEGER NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS scores (
+		room  TEXT NOT NULL,
+		track TEXT NOT NULL,
+		score REAL NOT NULL,
+		PRIMARY KEY (room, track)
+	)`,
+	`CREATE TABLE IF NOT EXISTS recaps (
+		id   TEXT PRIMARY KEY,
+		room TEXT NOT NULL,
+		time INTEGER NOT NULL,
+		data TEXT NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS events (
+		seq    INTEGER PRIMARY KEY AUTOINCREMENT,
+		room   TEXT NOT NULL,
+		type   TEXT NOT NULL,
+		time   INTEGER NOT NULL,
+		song   TEXT NOT NULL,
+		weight REAL NOT NULL DEFAULT 0
+	)`,
+	`CREATE INDEX IF NOT EXISTS events_room ON events (room, seq)`,
+	`CREATE TABLE IF NOT EXISTS push_subscriptions (
+		endpoint TEXT PRIMARY KEY,
+		session  TEXT NOT NULL,
+		p256dh   TEXT NOT NULL,
+		auth     TEXT NOT NULL,
+		events   TEXT NOT NULL,
+		created  INTEGER NOT NULL,
+		expires  INTEGER NOT NULL DEFAULT 0
+	)`,
+	`CREATE TABLE IF NOT EXISTS bans (
+		id      TEXT PRIMARY KEY,
+		target  TEXT NOT NULL,
+		reason  TEXT NOT NULL,
+		level   INTEGER NOT NULL,
+		time    INTEGER NOT NULL,
+		expires INTEGER NOT NULL,
+		lifted  INTEGER NOT NULL DEFAULT 0
+	)`,
+	`CREATE INDEX IF NOT EXISTS bans_time ON bans (time)`,
+}
+
+// Postgres searches a weighted tsvector instead of FTS5
+var postgresSchema = []string{
+	`CREATE TABLE IF NOT EXISTS hints (
+		name  TEXT PRIMARY KEY,
+		gain  DOUBLE PRECISION NOT NULL DEFAULT 0,
+		start DOUBLE PRECISION NOT NULL DEFAULT 0,
+		fade  DOUBLE PRECISION NOT NULL DEFAULT 0
+	)`,
+	`CREATE TABLE IF NOT EXISTS tracks (
+		name   TEXT PRIMARY KEY,
+		title  TEXT NOT NULL DEFAULT '',
+		artist TEXT NOT NULL DEFAULT '',
+		album  TEXT NOT NULL DEFAULT '',
+		genre  TEXT NOT NULL DEFAULT '',
+		doc    TSVECTOR
+	)`,
+	`CREATE INDEX IF NOT EXISTS tracks_doc ON tracks USING GIN (doc)`,
+	`CREATE TABLE IF NOT EXISTS settings (
+		name  TEXT PRIMARY KEY,
+		value TEXT NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS sessions (
+		id      TEXT PRIMARY KEY,
+		name    TEXT NOT NULL DEFAULT '',
+		created BIGINT NOT NULL,
+		expires BIGINT NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS votes (
+		session TEXT NOT NULL,
+		song    TEXT NOT NULL,
+		delta   INTEGER NOT NULL,
+		time    BIGINT NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS votes_session ON votes (session, time)`,
+	`CREATE TABLE IF NOT EXISTS plays (
+		song TEXT NOT NULL,
+		time BIGINT NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS plays_time ON plays (time)`,
+	`CREATE TABLE IF NOT EXISTS playlists (
+		name     TEXT NOT NULL,
+		position INTEGER NOT NULL,
+		song     TEXT NOT NULL,
+		PRIMARY KEY (name, position)
+	)`,
+	`CREATE TABLE IF NOT EXISTS quarantine (
+		name   TEXT PRIMARY KEY,
+		reason TEXT NOT NULL,
+		time   BIGINT NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS scores (
+		room  TEXT NOT NULL,
+		track TEXT NOT NULL,
+		score DOUBLE PRECISION NOT NULL,
+		PRIMARY KEY (room, track)
+	)`,
+	`CREATE TABLE IF NOT EXISTS recaps (
+		id   TEXT PRIMARY KEY,
+		room TEXT NOT NULL,
+		time BIGINT NOT NULL,
+		data TEXT NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS events (
+		seq    BIGSERIAL PRIMARY KEY,
+		room   TEXT NOT NULL,
+		type   TEXT NOT NULL,
+		time   BIGINT NOT NULL,
+		song   TEXT NOT NULL,
+		weight DOUBLE PRECISION NOT NULL DEFAULT 0
+	)`,
+	`CREATE INDEX IF NOT EXISTS events_room ON events (room, seq)`,
+	`CREATE TABLE IF NOT EXISTS push_subscriptions (
+		endpoint TEXT PRIMARY KEY,
+		session  TEXT NOT NULL,
+		p256dh   TEXT NOT NULL,
+		auth     TEXT NOT NULL,
+		events   TEXT NOT NULL,
+		created  BIGINT NOT NULL,
+		expires  BIGINT NOT NULL DEFAULT 0
+	)`,
+	`CREATE TABLE IF NOT EXISTS bans (
+		id      TEXT PRIMARY KEY,
+		target  TEXT NOT NULL,
+		reason  TEXT NOT NULL,
+		level   INTEGER NOT NULL,
+		time    BIGINT NOT NULL,
+		expires BIGINT NOT NULL,
+		lifted  BIGINT NOT NULL DEFAULT 0
+	)`,
+	`CREATE INDEX IF NOT EXISTS bans_time ON bans (time)`,
+}
+
+// Schema changes, applied once in order and tracked in settings
+var sqliteMigrations = []string{
+	`ALTER TABLE sessions ADD COLUMN admin INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE tracks ADD COLUMN explicit INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE sessions ADD COLUMN scope TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE sessions ADD COLUMN scope_expires INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE tracks ADD COLUMN track TEXT NOT NULL DEFAULT ''`,
+	`CREATE INDEX IF NOT EXISTS tracks_track ON tracks (track)`,
+	`ALTER TABLE votes ADD COLUMN track TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE votes ADD COLUMN room TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE plays ADD COLUMN track TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE plays ADD COLUMN room TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE votes ADD COLUMN weight REAL NOT NULL DEFAULT 1`,
+	`ALTER TABLE tracks ADD COLUMN duration INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE sessions ADD COLUMN profile TEXT NOT NULL DEFAULT ''`,
+	`CREATE INDEX IF NOT EXISTS sessions_profile ON sessions (profile)`,
+	`ALTER TABLE tracks ADD COLUMN container TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE tracks ADD COLUMN codec TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE tracks ADD COLUMN bitrate INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE tracks ADD COLUMN sample_rate INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE tracks ADD COLUMN channels INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE tracks ADD COLUMN karaoke INTEGER NOT NULL DEFAULT 0`,
+	// Search holds folded text from here, the scan at start up fills it
+	`DROP TABLE IF EXISTS search`,
+	`CREATE VIRTUAL TABLE search USING fts5(
+		name UNINDEXED, file, title, artist, album, genre,
+		tokenize = 'unicode61 remove_diacritics 2',
+		prefix = '2 3'
+	)`,
+	`ALTER TABLE tracks ADD COLUMN size INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE tracks ADD COLUMN mtime INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE tracks ADD COLUMN probed INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE events ADD COLUMN note TEXT NOT NULL DEFAULT ''`,
+}
+
+var postgresMigrations = []string{
+	`ALTER TABLE sessions ADD COLUMN admin BOOLEAN NOT NULL DEFAULT FALSE`,
+	`ALTER TABLE tracks ADD COLUMN explicit BOOLEAN NOT NULL DEFAULT FALSE`,
+	`ALTER TABLE sessions ADD COLUMN scope TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE sessions ADD COLUMN scope_expires BIGINT NOT NULL DEFAULT 0`,
+	`ALTER TABLE tracks ADD COLUMN track TEXT NOT NULL DEFAULT ''`,
+	`CREATE INDEX IF NOT EXISTS tracks_track ON tracks (track)`,
+	`ALTER TABLE votes ADD COLUMN track TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE votes ADD COLUMN room TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE plays ADD COLUMN track TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE plays ADD COLUMN room TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE votes ADD COLUMN weight DOUBLE PRECISION NOT NULL DEFAULT 1`,
+	`ALTER TABLE scores ALTER COLUMN score TYPE DOUBLE PRECISION`,
+	`ALTER TABLE tracks ADD COLUMN duration INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE sessions ADD COLUMN profile TEXT NOT NULL DEFAULT ''`,
+	`CREATE INDEX IF NOT EXISTS sessions_profile ON sessions (profile)`,
+	`ALTER TABLE tracks ADD COLUMN container TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE tracks ADD COLUMN codec TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE tracks ADD COLUMN bitrate INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE tracks ADD COLUMN sample_rate INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE tracks ADD COLUMN channels INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE tracks ADD COLUMN karaoke BOOLEAN NOT NULL DEFAULT FALSE`,
+	`ALTER TABLE tracks ADD COLUMN size BIGINT NOT NULL DEFAULT 0`,
+	`ALTER TABLE tracks ADD COLUMN mtime BIGINT NOT NULL DEFAULT 0`,
+	`ALTER TABLE tracks ADD COLUMN probed BOOLEAN NOT NULL DEFAULT FALSE`,
+	`ALTER TABLE events ADD COLUMN note TEXT NOT NULL DEFAULT ''`,
+}
+
+// Store on database/sql, the two dialects differ in placeholders and search
+type sqlStore struct {
+	db       *sql.DB
+	postgres bool
+}
+
+func openSQLStore(driver, dsn string) (*sqlStore, error) {
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	s := &sqlStore{db: db, postgres: driver == "postgres"}
+
+	schema, migrations := sqliteSchema, sqliteMigrations
+	if s.postgres {
+		schema, migrations = postgresSchema, postgresMigrations
+	} else {
+		// SQLite only allows one writer
+		db.SetMaxOpenConns(1)
+	}
+	for _, stmt := range schema {
+		if _, err := db.Exec(stmt); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	if err := s.migrate(migrations); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *sqlStore) migrate(migrations []string) error {
+	v, err := s.Setting("schema_version")
+	if err != nil {
+		return err
+	}
+	version, _ := strconv.Atoi(v)
+	for i := version; i < len(migrations); i++ {
+		if _, err := s.db.Exec(migrations[i]); err != nil {
+			return fmt.Errorf("migration %d: %v", i+1, err)
+		}
+		if err := s.SetSetting("schema_version", strconv.Itoa(i+1)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Rewrite ? placeholders for Postgres
+func (s *sqlStore) q(query string) string {
+	if !s.postgres {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, c := range query {
+		if c == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+func (s *sqlStore) Close() error {
+	return s.db.Close()
+}
+
+func (s *sqlStore) Index(metas []Meta) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, m := range metas {
+		if s.postgres {
+			if _, err := tx.Exec(`INSERT INTO tracks (name, title, artist, album, genre, explicit, track, duration,
+					container, codec, bitrate, sample_rate, channels, karaoke, size, mtime, probed, doc)
+				VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17,
+					setweight(to_tsvector('simple', $18::text), 'A') ||
+					setweight(to_tsvector('simple', $19::text), 'B') ||
+					setweight(to_tsvector('simple', $20::text), 'C') ||
+					setweight(to_tsvector('simple', $21::text || ' ' || $22::text), 'D'))
+				ON CONFLICT (name) DO UPDATE SET title = excluded.title, artist = excluded.artist,
+					album = excluded.album, genre = excluded.genre, explicit = excluded.explicit,
+					track = excluded.track, duration = excluded.duration, container = excluded.container,
+					codec = excluded.codec, bitrate = excluded.bitrate, sample_rate = excluded.sample_rate,
+					channels = excluded.channels, karaoke = excluded.karaoke, size = excluded.size,
+					mtime = excluded.mtime, probed = excluded.probed, doc = excluded.doc`,
+				m.Name, m.Title, m.Artist, m.Album, m.Genre, m.Explicit, m.Track, m.Duration,
+				m.Container, m.Codec, m.Bitrate, m.SampleRate, m.Channels, m.Karaoke, m.Size, m.ModTime, m.Probed,
+				core.SearchText(m.Title), core.SearchText(m.Artist), core.SearchText(m.Album),
+				core.SearchText(m.Name), core.SearchText(m.Genre)); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if _, err := tx.Exec(`INSERT OR REPLACE INTO tracks (name, title, artist, album, genre, explicit, track, duration,
+			container, codec, bitrate, sample_rate, channels, karaoke, size, mtime, probed)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			m.Name, m.Title, m.Artist, m.Album, m.Genre, m.Explicit, m.Track, m.Duration,
+			m.Container, m.Codec, m.Bitrate, m.SampleRate, m.Channels, m.Karaoke, m.Size, m.ModTime, m.Probed); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`DELETE FROM search WHERE name = ?`, m.Name); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`INSERT INTO search (name, file, title, artist, album, genre) VALUES (?, ?, ?, ?, ?, ?)`,
+			m.Name, core.SearchText(m.Name), core.SearchText(m.Title), core.SearchText(m.Artist),
+			core.SearchText(m.Album), core.SearchText(m.Genre)); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *sqlStore) Prune(names []string) error {
+	keep := make(map[string]bool, len(names))
+	for _, name := range names {
+		keep[name] = true
+	}
+
+	rows, err := s.db.Query(`SELECT name FROM tracks`)
+	if err != nil {
+		return err
+	}
+	var gone []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return err
+		}
+		if !keep[name] {
+			gone = append(gone, name)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, name := range gone {
+		if _, err := tx.Exec(s.q(`DELETE FROM tracks WHERE name = ?`), name); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(s.q(`DELETE FROM quarantine WHERE name = ?`), name); err != nil {
+			return err
+		}
+		if s.postgres {
+			continue
+		}
+		if _, err := tx.Exec(`DELETE FROM search WHERE name = ?`, name); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *sqlStore) Search(query string, limit int) ([]string, error) {
+	var rows *sql.Rows
+	var err error
+	if s.postgres {
+		q := tsQuery(query)
+		if q == "" {
+			return nil, nil
+		}
+		rows, err = s.db.Query(`SELECT name FROM tracks, to_tsquery('simple', $1) query
+			WHERE doc @@ query ORDER BY ts_rank(doc, query) DESC LIMIT $2`, q, limit)
+	} else {
+		q := ftsQuery(query)
+		if q == "" {
+			return nil, nil
+		}
+		// Weight title and artist matches over the rest
+		rows, err = s.db.Query(`SELECT name FROM search WHERE search MATCH ?
+			ORDER BY bm25(search, 0.0, 1.0, 10.0, 5.0, 3.0, 1.0) LIMIT ?`, q, limit)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return scanStrings(rows)
+}
+
+// Turn user input into an FTS5 query, folded like the index. Every
+// word is a prefix match, and CJK a phrase of its pairs.
+func ftsQuery(q string) string {
+	var terms []string
+	for _, phrase := range core.SearchTerms(q) {
+		words := strings.Replace(strings.Join(phrase, " "), `"`, `""`, -1)
+		terms = append(terms, `"`+words+`"*`)
+	}
+	return strings.Join(terms, " ")
+}
+
+// Same for a Postgres tsquery
+func tsQuery(q string) string {
+	var terms []string
+	for _, phrase := range core.SearchTerms(q) {
+		var words []string
+		for _, word := range phrase {
+			word = strings.Replace(word, `\`, `\\`, -1)
+			word = strings.Replace(word, `'`, `''`, -1)
+			words = append(words, `'`+word+`'`)
+		}
+		terms = append(terms, strings.Join(words, " <-> ")+":*")
+	}
+	return strings.Join(terms, " & ")
+}
+
+func scanStrings(rows *sql.Rows) ([]string, error) {
+	defer rows.Close()
+	var v []string
+	for rows.Next() {
+		var str string
+		if err := rows.Scan(&str); err != nil {
+			return nil, err
+		}
+		v = append(v, str)
+	}
+	return v, rows.Err()
+}
+
+func (s *sqlStore) Meta(name string) (*Meta, error) {
+	m := &Meta{Name: name}
+	err := s.db.QueryRow(s.q(`SELECT title, artist, album, genre, explicit, track, duration,
+		container, codec, bitrate, sample_rate, channels, karaoke FROM tracks WHERE name = ?`), name).Scan(
+		&m.Title, &m.Artist, &m.Album, &m.Genre, &m.Explicit, &m.Track, &m.Duration,
+		&m.Container, &m.Codec, &m.Bitrate, &m.SampleRate, &m.Channels, &m.Karaoke)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return m, err
+}
+
+func (s *sqlStore) Stamps() (map[string]Stamp, error) {
+	rows, err := s.db.Query(`SELECT name, size, mtime, track, probed FROM tracks WHERE track != ''`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	stamps := make(map[string]Stamp)
+	for rows.Next() {
+		var name string
+		var st Stamp
+		if err := rows.Scan(&name, &st.Size, &st.ModTime, &st.Track, &st.Probed); err != nil {
+			return nil, err
+		}
+		stamps[name] = st
+	}
+	return stamps, rows.Err()
+}
+
+func (s *sqlStore) Explicit() ([]string, error) {
+	rows, err := s.db.Query(s.q(`SELECT name FROM tracks WHERE explicit = ?`), true)
+	if err != nil {
+		return nil, err
+	}
+	return scanStrings(rows)
+}
+
+func (s *sqlStore) Quarantine(q Quarantined) error {
+	_, err := s.db.Exec(s.q(`INSERT INTO quarantine (name, reason, time) VALUES (?, ?, ?)
+		ON CONFLICT (name) DO UPDATE SET reason = excluded.reason, time = excluded.time`),
+		q.Name, q.Reason, q.Time)
+	return err
+}
+
+func (s *sqlStore) Quarantined() ([]Quarantined, error) {
+	rows, err := s.db.Query(`SELECT name, reason, time FROM quarantine ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []Quarantined
+	for rows.Next() {
+		var q Quarantined
+		if err := rows.Scan(&q.Name, &q.Reason, &q.Time); err != nil {
+			return nil, err
+		}
+		list = append(list, q)
+	}
+	return list, rows.Err()
+}
+
+func (s *sqlStore) Release(name string) error {
+	_, err := s.db.Exec(s.q(`DELETE FROM quarantine WHERE name = ?`), name)
+	return err
+}
+
+func (s *sqlStore) Hints() (map[string]*Hints, error) {
+	rows, err := s.db.Query(`SELECT name, gain, start, fade FROM hints`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	hints := make(map[string]*Hints)
+	for rows.Next() {
+		var name string
+		h := &Hints{}
+		if err := rows.Scan(&name, &h.Gain, &h.Start, &h.Fade); err != nil {
+			return nil, err
+		}
+		hints[name] = h
+	}
+	return hints, rows.Err()
+}
+
+func (s *sqlStore) SetHints(name string, h *Hints) error {
+	_, err := s.db.Exec(s.q(`INSERT INTO hints (name, gain, start, fade) VALUES (?, ?, ?, ?)
+		ON CONFLICT (name) DO UPDATE SET gain = excluded.gain, start = excluded.start, fade = excluded.fade`),
+		name, h.Gain, h.Start, h.Fade)
+	return err
+}
+
+func (s *sqlStore) RecordVote(session, room string, song Song, delta int, weight float64, time int) error {
+	_, err := s.db.Exec(s.q(`INSERT INTO votes (session, song, track, room, delta, weight, time) VALUES (?, ?, ?, ?, ?, ?, ?)`),
+		session, song.Name, song.Track, room, delta, weight, time)
+	return err
+}
+
+func (s *sqlStore) CountVotes(session string, since int) (int, error) {
+	var n int
+	err := s.db.QueryRow(s.q(`SELECT COUNT(*) FROM votes WHERE session = ? AND time > ?`), session, since).Scan(&n)
+	return n, err
+}
+
+func (s *sqlStore) Profile(session string, limit int) (*Profile, error) {
+	p := &Profile{Artists: []ProfileArtist{}, Recent: []ProfileVote{}}
+	err := s.db.QueryRow(s.q(`SELECT COUNT(*), COALESCE(SUM(CASE WHEN delta > 0 THEN 1 ELSE 0 END), 0),
+		COALESCE(MIN(time), 0), COALESCE(MAX(time), 0), COUNT(DISTINCT time / 86400000)
+		FROM votes WHERE session = ?`), session).Scan(&p.Votes, &p.Up, &p.First, &p.Last, &p.Days)
+	if err != nil {
+		return nil, err
+	}
+	p.Down = p.Votes - p.Up
+
+	rows, err := s.db.Query(s.q(`SELECT tracks.artist, COUNT(*) FROM votes
+		JOIN tracks ON tracks.name = votes.song
+		WHERE votes.session = ? AND votes.delta > 0 AND tracks.artist != ''
+		GROUP BY tracks.artist ORDER BY 2 DESC, 1 LIMIT ?`), session, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var a ProfileArtist
+		if err := rows.Scan(&a.Artist, &a.Votes); err != nil {
+			return nil, err
+		}
+		p.Artists = append(p.Artists, a)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = s.db.Query(s.q(`SELECT song, room, delta, time FROM votes
+		WHERE session = ? ORDER BY time DESC LIMIT ?`), session, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var v ProfileVote
+		if err := rows.Scan(&v.Song, &v.Room, &v.Delta, &v.Time); err != nil {
+			return nil, err
+		}
+		p.Recent = append(p.Recent, v)
+	}
+	return p, rows.Err()
+}
+
+func (s *sqlStore) RecordPlay(p Play) error {
+	_, err := s.db.Exec(s.q(`INSERT INTO plays (song, track, room, time) VALUES (?, ?, ?, ?)`),
+		p.Song, p.Track, p.Room, p.Time)
+	return err
+}
+
+func (s *sqlStore) History(room string, limit int) ([]Play, error) {
+	rows, err := s.db.Query(s.q(`SELECT song, track, room, time FROM plays
+		WHERE room = ? OR ? = '' ORDER BY time DESC LIMIT ?`), room, room, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	plays := []Play{}
+	for rows.Next() {
+		var p Play
+		if err := rows.Scan(&p.Song, &p.Track, &p.Room, &p.Time); err != nil {
+			return nil, err
+		}
+		plays = append(plays, p)
+	}
+	return plays, rows.Err()
+}
+
+func (s *sqlStore) AppendEvent(room string, e core.Event) error {
+	_, err := s.db.Exec(s.q(`INSERT INTO events (room, type, time, song, weight, note) VALUES (?, ?, ?, ?, ?, ?)`),
+		room, e.Type, e.Time, e.Song, e.Weight, e.Note)
+	return err
+}
+
+func (s *sqlStore) Events(room string, after int64, fn func(core.Event) error) error {
+	rows, err := s.db.Query(s.q(`SELECT seq, type, time, song, weight, note FROM events
+		WHERE room = ? AND seq > ? ORDER BY seq`), room, after)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var e core.Event
+		if err := rows.Scan(&e.Seq, &e.Type, &e.Time, &e.Song, &e.Weight, &e.Note); err != nil {
+			return err
+		}
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (s *sqlStore) Plays(room string, since, until int) ([]Play, error) {
+	rows, err := s.db.Query(s.q(`SELECT song, track, room, time FROM plays
+		WHERE room = ? AND time >= ? AND time < ? ORDER BY time`), room, since, until)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	plays := []Play{}
+	for rows.Next() {
+		var p Play
+		if err := rows.Scan(&p.Song, &p.Track, &p.Room, &p.Time); err != nil {
+			return nil, err
+		}
+		plays = append(plays, p)
+	}
+	return plays, rows.Err()
+}
+
+func (s *sqlStore) VoteTotals(room string, since, until, limit int) ([]RecapSong, []RecapVoter, error) {
+	rows, err := s.db.Query(s.q(`SELECT song, SUM(delta * weight), COUNT(*) FROM votes
+		WHERE room = ? AND time >= ? AND time < ?
+		GROUP BY song ORDER BY 2 DESC, 3 DESC LIMIT ?`), room, since, until, limit)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+	songs := []RecapSong{}
+	for rows.Next() {
+		var r RecapSong
+		if err := rows.Scan(&r.Name, &r.Score, &r.Votes); err != nil {
+			return nil, nil, err
+		}
+		songs = append(songs, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	rows, err = s.db.Query(s.q(`SELECT COALESCE(MAX(sessions.name), ''), COUNT(*) FROM votes
+		LEFT JOIN sessions ON sessions.id = votes.session
+		WHERE votes.room = ? AND votes.time >= ? AND votes.time < ?
+		GROUP BY votes.session ORDER BY 2 DESC LIMIT ?`), room, since, until, limit)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+	voters := []RecapVoter{}
+	for rows.Next() {
+		var r RecapVoter
+		if err := rows.Scan(&r.Name, &r.Votes); err != nil {
+			return nil, nil, err
+		}
+		if r.Name == "" {
+			r.Name = "Anonymous"
+		}
+		voters = append(voters, r)
+	}
+	return songs, voters, rows.Err()
+}
+
+func (s *sqlStore) SaveRecap(r *Recap) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(s.q(`INSERT INTO recaps (id, room, time, data) VALUES (?, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET data = excluded.data`), r.ID, r.Room, r.End, string(data))
+	return err
+}
+
+func (s *sqlStore) Recap(id string) (*Recap, error) {
+	var data string
+	err := s.db.QueryRow(s.q(`SELECT data FROM recaps WHERE id = ?`), id).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	r := &Recap{}
+	return r, json.Unmarshal([]byte(data), r)
+}
+
+func (s *sqlStore) Track(id string) (*Track, error) {
+	t := &Track{ID: id}
+	rows, err := s.db.Query(s.q(`SELECT name, title, artist, album FROM tracks WHERE track = ? ORDER BY name`), id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name, &t.Title, &t.Artist, &t.Album); err != nil {
+			return nil, err
+		}
+		t.Names = append(t.Names, name)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(t.Names) == 0 {
+		return nil, nil
+	}
+
+	var last sql.NullInt64
+	if err := s.db.QueryRow(s.q(`SELECT COUNT(*), MAX(time) FROM plays WHERE track = ?`), id).Scan(&t.Plays, &last); err != nil {
+		return nil, err
+	}
+	t.LastPlayed = int(last.Int64)
+
+	rows, err = s.db.Query(s.q(`SELECT room, score FROM scores WHERE track = ?`), id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	t.Scores = make(map[string]float64)
+	for rows.Next() {
+		var room string
+		var score float64
+		if err := rows.Scan(&room, &score); err != nil {
+			return nil, err
+		}
+		t.Scores[room] = score
+	}
+	return t, rows.Err()
+}
+
+func (s *sqlStore) Scores(room string) (map[string]float64, error) {
+	rows, err := s.db.Query(s.q(`SELECT track, score FROM scores WHERE room = ?`), room)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	scores := make(map[string]float64)
+	for rows.Next() {
+		var track string
+		var score float64
+		if err := rows.Scan(&track, &score); err != nil {
+			return nil, err
+		}
+		scores[track] = score
+	}
+	return scores, rows.Err()
+}
+
+func (s *sqlStore) SetScore(room, track string, score float64) error {
+	_, err := s.db.Exec(s.q(`INSERT INTO scores (room, track, score) VALUES (?, ?, ?)
+		ON CONFLICT (room, track) DO UPDATE SET score = excluded.score`), room, track, score)
+	return err
+}
+
+func (s *sqlStore) Setting(name string) (string, error) {
+	var value string
+	err := s.db.QueryRow(s.q(`SELECT value FROM settings WHERE name = ?`), name).Scan(&value)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return value, err
+}
+
+func (s *sqlStore) SetSetting(name, value string) error {
+	_, err := s.db.Exec(s.q(`INSERT INTO settings (name, value) VALUES (?, ?)
+		ON CONFLICT (name) DO UPDATE SET value = excluded.value`), name, value)
+	return err
+}
+
+func (s *sqlStore) Session(id string) (*Session, error) {
+	return s.session(`id = ?`, id)
+}
+
+func (s *sqlStore) ProfileSession(profile string) (*Session, error) {
+	return s.session(`profile = ?`, profile)
+}
+
+func (s *sqlStore) session(where, arg string) (*Session, error) {
+	sess := &Session{}
+	var created, expires, scopeExpires int64
+	err := s.db.QueryRow(s.q(`SELECT id, name, admin, created, expires, scope, scope_expires, profile FROM sessions WHERE `+where), arg).Scan(
+		&sess.ID, &sess.Name, &sess.Admin, &created, &expires, &sess.Scope, &scopeExpires, &sess.Profile)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	sess.Created = time.Unix(created, 0)
+	sess.Expires = time.Unix(expires, 0)
+	if scopeExpires > 0 {
+		sess.ScopeExpires = time.Unix(scopeExpires, 0)
+	}
+	return sess, nil
+}
+
+func (s *sqlStore) SaveSession(sess *Session) error {
+	var scopeExpires int64
+	if !sess.ScopeExpires.IsZero() {
+		scopeExpires = sess.ScopeExpires.Unix()
+	}
+	_, err := s.db.Exec(s.q(`INSERT INTO sessions (id, name, admin, created, expires, scope, scope_expires, profile) VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET name = excluded.name, admin = excluded.admin, expires = excluded.expires,
+			scope = excluded.scope, scope_expires = excluded.scope_expires, profile = excluded.profile`),
+		sess.ID, sess.Name, sess.Admin, time.Now().Unix(), sess.Expires.Unix(), sess.Scope, scopeExpires, sess.Profile)
+	return err
+}
+
+func (s *sqlStore) PruneSessions(before time.Time) error {
+	_, err := s.db.Exec(s.q(`DELETE FROM sessions WHERE expires < ?`), before.Unix())
+	return err
+}
+
+func (s *sqlStore) SaveSubscription(sub *PushSubscription) error {
+	_, err := s.db.Exec(s.q(`INSERT INTO push_subscriptions (endpoint, session, p256dh, auth, events, created, expires) VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (endpoint) DO UPDATE SET session = excluded.session, p256dh = excluded.p256dh, auth = excluded.auth,
+			events = excluded.events, expires = excluded.expires`),
+		sub.Endpoint, sub.Session, sub.Keys.P256dh, sub.Keys.Auth, strings.Join(sub.Events, ","), makeTimestamp(), sub.ExpirationTime)
+	return err
+}
+
+func (s *sqlStore) DeleteSubscription(endpoint string) error {
+	_, err := s.db.Exec(s.q(`DELETE FROM push_subscriptions WHERE endpoint = ?`), endpoint)
+	return err
+}
+
+func (s *sqlStore) Subscriptions() ([]PushSubscription, error) {
+	rows, err := s.db.Query(`SELECT endpoint, session, p256dh, auth, events, expires FROM push_subscriptions`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var subs []PushSubscription
+	for rows.Next() {
+		var sub PushSubscription
+		var events string
+		if err := rows.Scan(&sub.Endpoint, &sub.Session, &sub.Keys.P256dh, &sub.Keys.Auth, &events, &sub.ExpirationTime); err != nil {
+			return nil, err
+		}
+		if events != "" {
+			sub.Events = strings.Split(events, ",")
+		}
+		subs = append(subs, sub)
+	}
+	return subs, rows.Err()
+}
+
+func (s *sqlStore) PruneSubscriptions(before int) error {
+	_, err := s.db.Exec(s.q(`DELETE FROM push_subscriptions WHERE expires > 0 AND expires < ?`), before)
+	return err
+}
+
+func (s *sqlStore) SaveBan(b *Ban) error {
+	_, err := s.db.Exec(s.q(`INSERT INTO bans (id, target, reason, level, time, expires, lifted) VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET expires = excluded.expires, lifted = excluded.lifted`),
+		b.ID, b.Target, b.Reason, b.Level, b.Time, b.Expires, b.Lifted)
+	return err
+}
+
+func (s *sqlStore) Bans(since int) ([]Ban, error) {
+	rows, err := s.db.Query(s.q(`SELECT id, target, reason, level, time, expires, lifted FROM bans WHERE time >= ? ORDER BY time DESC`), since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var bans []Ban
+	for rows.Next() {
+		var b Ban
+		if err := rows.Scan(&b.ID, &b.Target, &b.Reason, &b.Level, &b.Time, &b.Expires, &b.Lifted); err != nil {
+			return nil, err
+		}
+		bans = append(bans, b)
+	}
+	return bans, rows.Err()
+}
+
+func (s *sqlStore) Voters(room, track string) ([]string, error) {
+	rows, err := s.db.Query(s.q(`SELECT DISTINCT session FROM votes
+		WHERE room = ? AND track = ? AND delta > 0
+			AND time > (SELECT COALESCE(MAX(time), 0) FROM plays WHERE room = ? AND track = ?)`),
+		room, track, room, track)
+	if err != nil {
+		return nil, err
+	}
+	return scanStrings(rows)
+}
+
+func (s *sqlStore) Playlists() ([]string, error) {
+	rows, err := s.db.Query(`SELECT DISTINCT name FROM playlists ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	return scanStrings(rows)
+}
+
+func (s *sqlStore) Playlist(name string) ([]string, error) {
+	rows, err := s.db.Query(s.q(`SELECT song FROM playlists WHERE name = ? ORDER BY position`), name)
+	if err != nil {
+		return nil, err
+	}
+	return scanStrings(rows)
+}
+
+func (s *sqlStore) SavePlaylist(name string, songs []string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(s.q(`DELETE FROM playlists WHERE name = ?`), name); err != nil {
+		return err
+	}
+	for i, song := range songs {
+		if _, err := tx.Exec(s.q(`INSERT INTO playlists (name, position, song) VALUES (?, ?, ?)`), name, i, song); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *sqlStore) DeletePlaylist(name string) error {
+	_, err := s.db.Exec(s.q(`DELETE FROM playlists WHERE name = ?`), name)
+	return err
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	"github.com/emcfarlane/jukebox/core"
+)
+
+// What an indexed file was like when it was hashed, ModTime in ns
+type Stamp struct {
+	Size    int64
+	ModTime int64
+	Track   string
+	Probed  bool
+}
+
+// Persistent state. SQLite is the default, Postgres lets several
+// instances share one database.
+type Store interface {
+	// Library metadata and search
+	Index(metas []Meta) error
+	Prune(names []string) error
+	Search(query string, limit int) ([]string, error)
+	Explicit() ([]string, error)
+	Meta(name string) (*Meta, error) // Nil if not found
+	Stamps() (map[string]Stamp, error)
+	Hints() (map[string]*Hints, error)
+	SetHints(name string, h *Hints) error
+
+	// Files kept out of the pool
+	Quarantine(q Quarantined) error
+	Quarantined() ([]Quarantined, error)
+	Release(name string) error
+
+	// Canonical tracks shared by every name and room, Track returns
+	// nil if not found. Scores are each room's overlay, by track.
+	Track(id string) (*Track, error)
+	Scores(room string) (map[string]float64, error)
+	SetScore(room, track string, score float64) error
+
+	// Votes, times in ms, weight is what the vote counted for
+	RecordVote(session, room string, song Song, delta int, weight float64, time int) error
+	CountVotes(session string, since int) (int, error)
+
+	// A session's voting stats, with its limit latest votes and top
+	// artists
+	Profile(session string, limit int) (*Profile, error)
+
+	// Play history, most recent first, all rooms if room is ""
+	RecordPlay(p Play) error
+	History(room string, limit int) ([]Play, error)
+
+	// Append only log of each room's pool changes, Events calls fn
+	// with those after seq in order. fn must not use the store.
+	AppendEvent(room string, e core.Event) error
+	Events(room string, after int64, fn func(core.Event) error) error
+
+	// Night recaps, Plays are oldest first and Recap returns nil if
+	// not found
+	Plays(room string, since, until int) ([]Play, error)
+	VoteTotals(room string, since, until, limit int) ([]RecapSong, []RecapVoter, error)
+	SaveRecap(r *Recap) error
+	Recap(id string) (*Recap, error)
+
+	// Sessions and settings, Session returns nil if not found
+	Setting(name string) (string, error)
+	SetSetting(name, value string) error
+	Session(id string) (*Session, error)
+	ProfileSession(profile string) (*Session, error)
+	SaveSession(sess *Session) error
+	PruneSessions(before time.Time) error
+
+	// Web Push subscriptions, by endpoint. Expired ones are dropped by
+	// PruneSubscriptions, times in ms.
+	SaveSubscription(sub *PushSubscription) error
+	DeleteSubscription(endpoint string) error
+	Subscriptions() ([]PushSubscription, error)
+	PruneSubscriptions(before int) error
+
+	// Temporary bans, kept after they expire as a record of abuse.
+	// Bans returns those since a time in ms, newest first.
+	SaveBan(b *Ban) error
+	Bans(since int) ([]Ban, error)
+
+	// Sessions that upvoted a track since it last played in room
+	Voters(room, track string) ([]string, error)
+
+	// Playlists of song names
+	Playlists() ([]string, error)
+	Playlist(name string) ([]string, error)
+	SavePlaylist(name string, songs []string) error
+	DeletePlaylist(name string) error
+
+	Close() error
+}
+
+// A song that was played
+type Play struct {
+	Song  string
+	Track string
+	Room  string
+	Time  int
+}
+
+// One piece of audio, files with the same content are aliases of it
+type Track struct {
+	ID         string // Content hash
+	Names      []string
+	Title      string
+	Artist     string
+	Album      string
+	Plays      int
+	LastPlayed int
+	Scores     map[string]float64 // By room
+}
+
+// Open the store for a -db value, a postgres:// URL or a SQLite path
+func openStore(dsn string) (Store, error) {
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		return openSQLStore("postgres", dsn)
+	}
+	return openSQLStore("sqlite", dsn)
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Subsonic API version implemented, with OpenSubsonic extensions
+const subsonicVersion = "1.16.1"
+
+// Subsonic error codes
+const (
+	subsonicMissing  = 10
+	subsonicAuth     = 40
+	subsonicNotFound = 70
+)
+
+// Folder images used when a song has no embedded art
+var coverFiles = []string{"cover.jpg", "folder.jpg", "front.jpg", "cover.png", "folder.png"}
+
+// Response in XML or, with f=json, JSON
+type subsonicResponse struct {
+	XMLName      xml.Name `xml:"subsonic-response" json:"-"`
+	Xmlns        string   `xml:"xmlns,attr" json:"-"`
+	Status       string   `xml:"status,attr" json:"status"`
+	Version      string   `xml:"version,attr" json:"version"`
+	Type         string   `xml:"type,attr" json:"type"`
+	OpenSubsonic bool     `xml:"openSubsonic,attr" json:"openSubsonic"`
+
+	Error         *subsonicError      `xml:"error,omitempty" json:"error,omitempty"`
+	License       *subsonicLicense    `xml:"license,omitempty" json:"license,omitempty"`
+	Extensions    *[]struct{}         `xml:"-" json:"openSubsonicExtensions,omitempty"`
+	MusicFolders  *subsonicFolders    `xml:"musicFolders,omitempty" json:"musicFolders,omitempty"`
+	SearchResult3 *subsonicSearchList `xml:"searchResult3,omitempty" json:"searchResult3,omitempty"`
+}
+
+type subsonicError struct {
+	Code    int    `xml:"code,attr" json:"code"`
+	Message string `xml:"message,attr" json:"message"`
+}
+
+type subsonicLicense struct {
+	Valid bool `xml:"valid,attr" json:"valid"`
+}
+
+type subsonicFolders struct {
+	Folders []subsonicFolder `xml:"musicFolder" json:"musicFolder"`
+}
+
+type subsonicFolder struct {
+	ID   int    `xml:"id,attr" json:"id"`
+	Name string `xml:"name,attr" json:"name"`
+}
+
+// Only songs are searched, the library has no artist or album index
+type subsonicSearchList struct {
+	Songs []subsonicSong `xml:"song" json:"song"`
+}
+
+type subsonicSong struct {
+	ID          string `xml:"id,attr" json:"id"`
+	IsDir       bool   `xml:"isDir,attr" json:"isDir"`
+	Title       string `xml:"title,attr" json:"title"`
+	Album       string `xml:"album,attr,omitempty" json:"album,omitempty"`
+	Artist      string `xml:"artist,attr,omitempty" json:"artist,omitempty"`
+	Genre       string `xml:"genre,attr,omitempty" json:"genre,omitempty"`
+	CoverArt    string `xml:"coverArt,attr" json:"coverArt"`
+	Size        int64  `xml:"size,attr" json:"size"`
+	Duration    int    `xml:"duration,attr,omitempty" json:"duration,omitempty"` // Seconds
+	BitRate     int    `xml:"bitRate,attr,omitempty" json:"bitRate,omitempty"`
+	SampleRate  int    `xml:"samplingRate,attr,omitempty" json:"samplingRate,omitempty"`
+	ContentType string `xml:"contentType,attr" json:"contentType"`
+	Suffix      string `xml:"suffix,attr" json:"suffix"`
+	Path        string `xml:"path,attr" json:"path"`
+	Type        string `xml:"type,attr" json:"type"`
+}
+
+// Song IDs are hex names, so they round trip through any client
+func subsonicID(name string) string {
+	return hex.EncodeToString([]byte(name))
+}
+
+// Song for an ID, "" unless it's a visible song in the library
+func (s *Server) subsonicSong(id string) string {
+	b, err := hex.DecodeString(id)
+	if err != nil {
+		return ""
+	}
+	name := string(b)
+	s.songLock.Lock()
+	defer s.songLock.Unlock()
+	if !s.pool.Visible(s.canonical(name)) {
+		return ""
+	}
+	return name
+}
+
+// Password check, plain, hex encoded, salted token or API key
+func subsonicAllowed(r *http.Request) bool {
+	password := []byte(*subsonicPassword)
+	if key := r.FormValue("apiKey"); key != "" {
+		return subtle.ConstantTimeCompare([]byte(key), password) == 1
+	}
+	if t, salt := r.FormValue("t"), r.FormValue("s"); t != "" && salt != "" {
+		sum := md5.Sum(append(password, salt...))
+		return subtle.ConstantTimeCompare([]byte(strings.ToLower(t)), []byte(hex.EncodeToString(sum[:]))) == 1
+	}
+	p := r.FormValue("p")
+	if strings.HasPrefix(p, "enc:") {
+		b, err := hex.DecodeString(p[4:])
+		if err != nil {
+			return false
+		}
+		p = string(b)
+	}
+	return p != "" && subtle.ConstantTimeCompare([]byte(p), password) == 1
+}
+
+func subsonicWrite(w http.ResponseWriter, r *http.Request, resp *subsonicResponse) error {
+	resp.Xmlns = "http://subsonic.org/restapi"
+	resp.Version = subsonicVersion
+	resp.Type = "jukebox"
+	resp.OpenSubsonic = true
+	if resp.Status == "" {
+		resp.Status = "ok"
+	}
+	if r.FormValue("f") == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		return json.NewEncoder(w).Encode(map[string]interface{}{"subsonic-response": resp})
+	}
+	w.Header().Set("Content-Type", "text/xml; charset=utf-8")
+	if _, err := w.Write([]byte(xml.Header)); err != nil {
+		return err
+	}
+	return xml.NewEncoder(w).Encode(resp)
+}
+
+// Errors are sent with a 200, as clients expect
+func subsonicFail(w http.ResponseWriter, r *http.Request, code int, message string) error {
+	return subsonicWrite(w, r, &subsonicResponse{
+		Status: "failed",
+		Error:  &subsonicError{Code: code, Message: message},
+	})
+}
+
+// Subsonic handle, /rest/{method} with an optional .view suffix
+func (s *Server) subsonic(w http.ResponseWriter, r *http.Request) error {
+	method := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/rest/"), ".view")
+	if !subsonicAllowed(r) {
+		return subsonicFail(w, r, subsonicAuth, "Wrong username or password")
+	}
+
+	if (method == "stream" || method == "download" || method == "getCoverArt") && r.FormValue("id") == "" {
+		return subsonicFail(w, r, subsonicMissing, "Required parameter is missing: id")
+	}
+
+	switch method {
+	case "ping":
+		return subsonicWrite(w, r, &subsonicResponse{})
+	case "getLicense":
+		return subsonicWrite(w, r, &subsonicResponse{License: &subsonicLicense{Valid: true}})
+	case "getOpenSubsonicExtensions":
+		return subsonicWrite(w, r, &subsonicResponse{Extensions: &[]struct{}{}})
+	case "getMusicFolders":
+		return subsonicWrite(w, r, &subsonicResponse{
+			MusicFolders: &subsonicFolders{Folders: []subsonicFolder{{ID: 1, Name: "Music"}}},
+		})
+	case "search3":
+		return s.subsonicSearch(w, r)
+	case "stream", "download":
+		name := s.subsonicSong(r.FormValue("id"))
+		if name == "" {
+			return subsonicFail(w, r, subsonicNotFound, "Song not found")
+		}
+		format := r.FormValue("format")
+		if method == "download" || format == "raw" {
+			format = ""
+		}
+		return s.subsonicStream(w, r, name, format)
+	case "getCoverArt":
+		return s.subsonicCover(w, r)
+	}
+	return subsonicFail(w, r, subsonicNotFound, "Unknown method "+method)
+}
+
+// Song search, an empty query lists the library a page at a time
+func (s *Server) subsonicSearch(w http.ResponseWriter, r *http.Request) error {
+	count, err := strconv.Atoi(r.FormValue("songCount"))
+	if err != nil || count < 0 || count > 500 {
+		count = 20
+	}
+	offset, err := strconv.Atoi(r.FormValue("songOffset"))
+	if err != nil || offset < 0 {
+		offset = 0
+	}
+
+	var names []string
+	q := strings.Trim(r.FormValue("query"), "\" ")
+	if q == "" {
+		s.songLock.Lock()
+		for _, song := range s.pool.Songs() {
+			names = append(names, song.Name)
+		}
+		s.songLock.Unlock()
+	} else {
+		songs, err := s.search(q, offset+count)
+		if err != nil {
+			return err
+		}
+		for _, song := range songs {
+			names = append(names, song.Name)
+		}
+	}
+	if offset > len(names) {
+		offset = len(names)
+	}
+	names = names[offset:]
+	if len(names) > count {
+		names = names[:count]
+	}
+
+	list := &subsonicSearchList{Songs: []subsonicSong{}}
+	for _, name := range names {
+		ext := strings.ToLower(path.Ext(name))
+		song := subsonicSong{
+			ID:          subsonicID(name),
+			Title:       strings.TrimSuffix(path.Base(name), path.Ext(name)),
+			CoverArt:    subsonicID(name),
+			ContentType: containerTypes[audioExts[ext]],
+			Suffix:      strings.TrimPrefix(ext, "."),
+			Path:        name,
+			Type:        "music",
+		}
+		if m, err := s.store.Meta(name); err == nil && m != nil {
+			song.Title, song.Artist, song.Album, song.Genre = m.Title, m.Artist, m.Album, m.Genre
+			song.Duration, song.BitRate, song.SampleRate = m.Duration/1000, m.Bitrate, m.SampleRate
+			if t := containerTypes[m.Container]; t != "" {
+				song.ContentType = t
+			}
+		}
+		if fi, err := os.Stat(musicPath(name)); err == nil {
+			song.Size = fi.Size()
+		}
+		list.Songs = append(list.Songs, song)
+	}
+	return subsonicWrite(w, r, &subsonicResponse{SearchResult3: list})
+}
+
+// Stream a song, transcoding if a format is asked for
+func (s *Server) subsonicStream(w http.ResponseWriter, r *http.Request, name, format string) error {
+	w = s.throttle(w, r)
+	src := musicPath(name)
+	fm := s.songFormat(name)
+	if _, ok := transcodeArgs[format]; ok {
+		return s.audioTranscoded(w, r, src, format, fm, s.songHintsFor(r, name))
+	}
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if t := containerTypes[fm.Container]; t != "" {
+		w.Header().Set("Content-Type", t)
+	}
+	http.ServeContent(w, r, "", time.Time{}, f)
+	return nil
+}
+
+// Cover art embedded in the song, or an image in its folder
+func (s *Server) subsonicCover(w http.ResponseWriter, r *http.Request) error {
+	name := s.subsonicSong(r.FormValue("id"))
+	if name == "" {
+		return subsonicFail(w, r, subsonicNotFound, "Cover art not found")
+	}
+	src := musicPath(name)
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	data, mime, err := readCover(f)
+	f.Close()
+	if err != nil && err != errNoTags {
+		log.Println("subsonic: cover ", name, err)
+	}
+	if data == nil {
+		for _, c := range coverFiles {
+			if data, err = ioutil.ReadFile(filepath.Join(filepath.Dir(src), c)); err == nil {
+				mime = "image/jpeg"
+				if strings.HasSuffix(c, ".png") {
+					mime = "image/png"
+				}
+				break
+			}
+		}
+	}
+	if data == nil {
+		return subsonicFail(w, r, subsonicNotFound, "Cover art not found")
+	}
+	w.Header().Set("Content-Type", mime)
+	w.Header().Set("Cache-Control", "max-age=86400")
+	_, err = w.Write(data)
+	return err
+}
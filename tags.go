@@ -0,0 +1,394 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf16"
+)
+
+var errNoTags = errors.New("no tags found")
+
+// ID3v2 frames we keep
+var id3Frames = map[string]string{
+	"TIT2": "title", "TT2": "title",
+	"TPE1": "artist", "TP1": "artist",
+	"TALB": "album", "TAL": "album",
+	"TCON": "genre", "TCO": "genre",
+}
+
+// Read tags from a file, keys are lower case
+func readTags(f io.ReadSeeker) (map[string]string, error) {
+	head := make([]byte, 4)
+	if _, err := io.ReadFull(f, head); err != nil {
+		return nil, err
+	}
+	if _, err := f.Seek(0, 0); err != nil {
+		return nil, err
+	}
+
+	switch {
+	case bytes.HasPrefix(head, []byte("ID3")):
+		return readID3v2(f)
+	case bytes.Equal(head, []byte("OggS")):
+		return readVorbis(f)
+	case bytes.Equal(head, []byte("fLaC")):
+		return readFlacTags(f)
+	}
+	return readID3v1(f)
+}
+
+func syncsafe(b []byte) int {
+	n := 0
+	for _, v := range b {
+		n = n<<7 | int(v&0x7f)
+	}
+	return n
+}
+
+// Call fn with each ID3v2 frame until it returns false
+func id3v2Frames(f io.Reader, fn func(id string, body []byte) bool) error {
+	h := make([]byte, 10)
+	if _, err := io.ReadFull(f, h); err != nil {
+		return err
+	}
+	version := h[3]
+	size := syncsafe(h[6:10])
+	data := make([]byte, size)
+	if _, err := io.ReadFull(f, data); err != nil {
+		return err
+	}
+
+	// Skip extended header
+	if h[5]&0x40 != 0 && version >= 3 && len(data) >= 4 {
+		n := int(binary.BigEndian.Uint32(data))
+		if version == 4 {
+			n = syncsafe(data[:4])
+		} else {
+			n += 4
+		}
+		if n > len(data) {
+			return errNoTags
+		}
+		data = data[n:]
+	}
+
+	idLen, headLen := 4, 10
+	if version == 2 {
+		idLen, headLen = 3, 6
+	}
+
+	for len(data) >= headLen && data[0] != 0 {
+		id := string(data[:idLen])
+		var n int
+		switch version {
+		case 2:
+			n = int(data[3])<<16 | int(data[4])<<8 | int(data[5])
+		case 3:
+			n = int(binary.BigEndian.Uint32(data[4:8]))
+		default:
+			n = syncsafe(data[4:8])
+		}
+		if n > len(data)-headLen {
+			break
+		}
+		body := data[headLen : headLen+n]
+		data = data[headLen+n:]
+
+		if len(body) < 1 {
+			continue
+		}
+		if !fn(id, body) {
+			break
+		}
+	}
+	return nil
+}
+
+func readID3v2(f io.Reader) (map[string]string, error) {
+	tags := make(map[string]string)
+	err := id3v2Frames(f, func(id string, body []byte) bool {
+		if key, ok := id3Frames[id]; ok {
+			tags[key] = id3Text(body[0], body[1:])
+		} else if id == "TXXX" || id == "TXX" {
+			// User text, description then value
+			parts := strings.SplitN(id3Text(body[0], body[1:]), "\x00", 2)
+			if len(parts) == 2 {
+				tags[strings.ToLower(parts[0])] = parts[1]
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(tags) == 0 {
+		return nil, errNoTags
+	}
+	return tags, nil
+}
+
+// Embedded cover art from an ID3v2 APIC or PIC frame, with its MIME type
+func readCover(f io.ReadSeeker) ([]byte, string, error) {
+	head := make([]byte, 3)
+	if _, err := io.ReadFull(f, head); err != nil {
+		return nil, "", err
+	}
+	if !bytes.Equal(head, []byte("ID3")) {
+		return nil, "", errNoTags
+	}
+	if _, err := f.Seek(0, 0); err != nil {
+		return nil, "", err
+	}
+
+	var data []byte
+	var mime string
+	err := id3v2Frames(f, func(id string, body []byte) bool {
+		enc, b := body[0], body[1:]
+		switch id {
+		case "APIC": // MIME type, NUL ended
+			i := bytes.IndexByte(b, 0)
+			if i < 0 {
+				return true
+			}
+			mime, b = string(b[:i]), b[i+1:]
+		case "PIC": // Three letter format
+			if len(b) < 3 {
+				return true
+			}
+			mime, b = "image/"+strings.ToLower(string(b[:3])), b[3:]
+		default:
+			return true
+		}
+		if len(b) < 1 {
+			return true
+		}
+		b = b[1:] // Picture type
+
+		// Description, NUL ended, two NULs for UTF-16
+		end := []byte{0}
+		if enc == 1 || enc == 2 {
+			end = []byte{0, 0}
+		}
+		for i := 0; i+len(end) <= len(b); i += len(end) {
+			if bytes.Equal(b[i:i+len(end)], end) {
+				data = b[i+len(end):]
+				break
+			}
+		}
+		return data == nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	if data == nil {
+		return nil, "", errNoTags
+	}
+	if mime == "image/jpg" {
+		mime = "image/jpeg"
+	}
+	return data, mime, nil
+}
+
+// Decode an ID3v2 text frame, keeping NUL separators
+func id3Text(enc byte, b []byte) string {
+	var s string
+	switch enc {
+	case 0: // ISO-8859-1
+		r := make([]rune, len(b))
+		for i, c := range b {
+			r[i] = rune(c)
+		}
+		s = string(r)
+	case 1, 2: // UTF-16
+		bigEndian := enc == 2
+		if len(b) >= 2 && b[0] == 0xfe && b[1] == 0xff {
+			bigEndian, b = true, b[2:]
+		} else if len(b) >= 2 && b[0] == 0xff && b[1] == 0xfe {
+			bigEndian, b = false, b[2:]
+		}
+		u := make([]uint16, len(b)/2)
+		for i := range u {
+			if bigEndian {
+				u[i] = binary.BigEndian.Uint16(b[2*i:])
+			} else {
+				u[i] = binary.LittleEndian.Uint16(b[2*i:])
+			}
+		}
+		s = string(utf16.Decode(u))
+		// Second string in TXXX has its own BOM
+		s = strings.Replace(s, "\x00\ufeff", "\x00", 1)
+	default: // UTF-8
+		s = string(b)
+	}
+	return strings.TrimRight(s, "\x00")
+}
+
+func readID3v1(f io.ReadSeeker) (map[string]string, error) {
+	if _, err := f.Seek(-128, 2); err != nil {
+		return nil, errNoTags
+	}
+	b := make([]byte, 128)
+	if _, err := io.ReadFull(f, b); err != nil {
+		return nil, err
+	}
+	if !bytes.HasPrefix(b, []byte("TAG")) {
+		return nil, errNoTags
+	}
+	field := func(b []byte) string {
+		return strings.TrimSpace(string(bytes.TrimRight(b, "\x00")))
+	}
+	return map[string]string{
+		"title":  field(b[3:33]),
+		"artist": field(b[33:63]),
+		"album":  field(b[63:93]),
+	}, nil
+}
+
+// Vorbis comments from the second Ogg packet
+func readVorbis(f io.Reader) (map[string]string, error) {
+	b := make([]byte, 64*1024)
+	n, err := io.ReadFull(f, b)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	b = b[:n]
+
+	i := bytes.Index(b, []byte("\x03vorbis"))
+	if i < 0 {
+		return nil, errNoTags
+	}
+	return vorbisComments(b[i+7:])
+}
+
+// Vorbis comments from a FLAC metadata block
+func readFlacTags(f io.Reader) (map[string]string, error) {
+	if _, err := io.CopyN(ioutil.Discard, f, 4); err != nil {
+		return nil, err
+	}
+	h := make([]byte, 4)
+	for {
+		if _, err := io.ReadFull(f, h); err != nil {
+			return nil, errNoTags
+		}
+		n := int64(h[1])<<16 | int64(h[2])<<8 | int64(h[3])
+		if h[0]&0x7f == 4 {
+			b := make([]byte, n)
+			if _, err := io.ReadFull(f, b); err != nil {
+				return nil, err
+			}
+			return vorbisComments(b)
+		}
+		if h[0]&0x80 != 0 {
+			return nil, errNoTags // Last block
+		}
+		if _, err := io.CopyN(ioutil.Discard, f, n); err != nil {
+			return nil, errNoTags
+		}
+	}
+}
+
+func vorbisComments(b []byte) (map[string]string, error) {
+	next := func() ([]byte, bool) {
+		if len(b) < 4 {
+			return nil, false
+		}
+		n := int(binary.LittleEndian.Uint32(b))
+		if n > len(b)-4 {
+			return nil, false
+		}
+		v := b[4 : 4+n]
+		b = b[4+n:]
+		return v, true
+	}
+
+	// Vendor string
+	if _, ok := next(); !ok || len(b) < 4 {
+		return nil, errNoTags
+	}
+	count := int(binary.LittleEndian.Uint32(b))
+	b = b[4:]
+
+	tags := make(map[string]string)
+	for i := 0; i < count; i++ {
+		c, ok := next()
+		if !ok {
+			break
+		}
+		parts := strings.SplitN(string(c), "=", 2)
+		if len(parts) == 2 {
+			tags[strings.ToLower(parts[0])] = parts[1]
+		}
+	}
+	return tags, nil
+}
+
+// Song metadata from tags
+type Meta struct {
+	Name     string
+	Title    string
+	Artist   string
+	Album    string
+	Genre    string
+	Explicit bool
+	Karaoke  bool   // A backing track to sing over
+	Track    string // Content hash
+	Format
+
+	// The file Track was hashed from, so it isn't hashed or probed
+	// again until it changes. ModTime in ns.
+	Size    int64
+	ModTime int64
+	Probed  bool // Decoded cleanly
+}
+
+// Read a song's metadata, falling back to the filename
+func readMeta(name string) (Meta, error) {
+	f, err := os.Open(musicPath(name))
+	if err != nil {
+		return Meta{Name: name, Title: strings.TrimSuffix(name, filepath.Ext(name))}, err
+	}
+	defer f.Close()
+	return metaOf(name, f)
+}
+
+// Metadata of a song's content, named name
+func metaOf(name string, f io.ReadSeeker) (Meta, error) {
+	m := Meta{
+		Name:  name,
+		Title: strings.TrimSuffix(name, filepath.Ext(name)),
+	}
+	var err error
+
+	// Unknown content falls back to the extension, and a zero
+	// duration leaves it to clients to say when a song ends
+	if m.Format, err = readFormat(f); err != nil {
+		m.Format = Format{Container: audioExts[strings.ToLower(filepath.Ext(name))]}
+	}
+	if _, err := f.Seek(0, 0); err != nil {
+		return m, err
+	}
+
+	tags, err := readTags(f)
+	if err == errNoTags {
+		m.Explicit = explicitTags(nil, m.Title)
+		m.Karaoke = karaokeTags(nil, m.Title, name)
+		return m, nil
+	} else if err != nil {
+		return m, err
+	}
+	if tags["title"] != "" {
+		m.Title = tags["title"]
+	}
+	m.Artist = tags["artist"]
+	m.Album = tags["album"]
+	m.Genre = tags["genre"]
+	m.Explicit = explicitTags(tags, m.Title)
+	m.Karaoke = karaokeTags(tags, m.Title, name)
+	return m, nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Token bucket, bytes per second with a one second burst
+type limiter struct {
+	lock   *sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newLimiter(kbps int) *limiter {
+	if kbps <= 0 {
+		return nil
+	}
+	rate := float64(kbps) * 1024
+	return &limiter{
+		lock:   &sync.Mutex{},
+		rate:   rate,
+		tokens: rate,
+		last:   time.Now(),
+	}
+}
+
+// Change the rate in KB/s, 0 for none
+func (l *limiter) set(kbps int) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.rate = float64(kbps) * 1024
+	l.tokens = l.rate
+	l.last = time.Now()
+}
+
+// Whether a limiter never waits
+func (l *limiter) off() bool {
+	if l == nil {
+		return true
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.rate <= 0
+}
+
+// Block until n bytes may be sent or the context is done
+func (l *limiter) wait(ctx context.Context, n int) error {
+	if l == nil {
+		return nil
+	}
+	l.lock.Lock()
+	if l.rate <= 0 {
+		l.lock.Unlock()
+		return nil
+	}
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	debt, rate := l.tokens, l.rate
+	l.lock.Unlock()
+
+	if debt < 0 {
+		t := time.NewTimer(time.Duration(-debt / rate * float64(time.Second)))
+		defer t.Stop()
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// Response writer limited per connection and by the shared limit
+type throttledWriter struct {
+	http.ResponseWriter
+	ctx    context.Context // Request context, done when the client goes
+	conn   *limiter
+	global *limiter
+}
+
+const throttleChunk = 16 * 1024
+
+func (w *throttledWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := len(p)
+		if n > throttleChunk {
+			n = throttleChunk
+		}
+		if err := w.global.wait(w.ctx, n); err != nil {
+			return written, err
+		}
+		if err := w.conn.wait(w.ctx, n); err != nil {
+			return written, err
+		}
+		m, err := w.ResponseWriter.Write(p[:n])
+		written += m
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// Apply the bandwidth caps to an audio response
+func (s *Server) throttle(w http.ResponseWriter, r *http.Request) http.ResponseWriter {
+	conn := newLimiter(s.settings().RateConn)
+	if conn == nil && s.bandwidth.off() {
+		return w
+	}
+	return &throttledWriter{ResponseWriter: w, ctx: r.Context(), conn: conn, global: s.bandwidth}
+}
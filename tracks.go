@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/emcfarlane/jukebox/core"
+)
+
+// Load this room's scores, by track
+func (s *Server) scoresLoad() error {
+	scores, err := s.store.Scores(*roomName)
+	if err != nil {
+		return err
+	}
+	s.songLock.Lock()
+	defer s.songLock.Unlock()
+	s.trackScores = scores
+	return nil
+}
+
+// Add a scanned song to the pool, files with the same audio as one
+// already there become aliases of it. songLock must be held.
+func (s *Server) songAdd(m Meta) {
+	s.songTrack[m.Name] = m.Track
+	s.songDuration[m.Name] = m.Duration
+	if m.Track != "" {
+		if name, ok := s.trackSong[m.Track]; ok && name != m.Name {
+			log.Println("Alias: ", m.Name, name)
+			return
+		}
+		s.trackSong[m.Track] = m.Name
+	}
+	if key := titleKey(m); key != "" {
+		if _, ok := s.titleSong[key]; !ok {
+			s.titleSong[key] = m.Name
+		}
+	}
+	if score := s.trackScores[m.Track]; s.pool.Add(m.Name, score) {
+		s.record(core.EventAdd, m.Name, score, int(makeTimestamp()))
+	}
+	s.songExplicit[m.Name] = m.Explicit
+	s.songKaraoke[m.Name] = m.Karaoke
+}
+
+// Name in the pool for a song or any of its aliases, songLock must be held
+func (s *Server) canonical(name string) string {
+	if track := s.songTrack[name]; track != "" {
+		if pool, ok := s.trackSong[track]; ok {
+			return pool
+		}
+	}
+	return name
+}
+
+// Save a song's score to this room's overlay, songLock must be held
+func (s *Server) scoreSave(name string, score float64) {
+	track := s.songTrack[name]
+	if track == "" {
+		return
+	}
+	s.trackScores[track] = score
+	if err := s.store.SetScore(*roomName, track, score); err != nil {
+		log.Println("scoreSave: ", err)
+	}
+}
+
+// Track handle, a track's names, plays and scores in every room
+func (s *Server) trackAPI(w http.ResponseWriter, r *http.Request) error {
+	id := strings.TrimPrefix(r.URL.Path, "/api/v1/tracks/")
+	t, err := s.store.Track(id)
+	if err != nil {
+		return err
+	}
+	if t == nil {
+		http.NotFound(w, r)
+		return nil
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(t)
+}
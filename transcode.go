@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Formats audio can be transcoded to, with ffmpeg arguments
+var transcodeArgs = map[string][]string{
+	"mp3": {"-codec:a", "libmp3lame", "-b:a", "192k", "-f", "mp3"},
+	"ogg": {"-codec:a", "libvorbis", "-q:a", "5", "-f", "ogg"},
+}
+
+// Codec each format is transcoded to
+var transcodeCodecs = map[string]string{
+	"mp3": "mp3",
+	"ogg": "vorbis",
+}
+
+// Format of a song from the index, or the file if it isn't scanned yet
+func (s *Server) songFormat(name string) Format {
+	if m, err := s.store.Meta(name); err == nil && m != nil && m.Container != "" {
+		return m.Format
+	}
+	return fileFormat(name)
+}
+
+// Seconds a hinted fade out takes, as in the player
+const hintFade = 5
+
+// A song's hints, nil if it has none. Players that apply hints
+// themselves ask for ?hints=0.
+func (s *Server) songHintsFor(r *http.Request, name string) *Hints {
+	if r.FormValue("hints") == "0" {
+		return nil
+	}
+	s.songLock.Lock()
+	defer s.songLock.Unlock()
+	h := s.songHints[name]
+	if h == nil || *h == (Hints{}) {
+		return nil
+	}
+	return h
+}
+
+// ffmpeg arguments that apply hints, before and after the input
+func hintArgs(h *Hints) ([]string, []string) {
+	if h == nil {
+		return nil, nil
+	}
+	var in, filters, out []string
+	if h.Start > 0 {
+		in = []string{"-ss", fmt.Sprint(h.Start)}
+	}
+	if h.Gain != 0 {
+		filters = append(filters, fmt.Sprintf("volume=%gdB", h.Gain))
+	}
+	if h.Fade > 0 {
+		// Times are from the skipped intro's end
+		at := math.Max(h.Fade-h.Start, 0)
+		filters = append(filters, fmt.Sprintf("afade=t=out:st=%g:d=%d", at, hintFade))
+		out = []string{"-t", fmt.Sprint(at + hintFade)}
+	}
+	if len(filters) > 0 {
+		out = append(out, "-af", strings.Join(filters, ","))
+	}
+	return in, out
+}
+
+// Transcode with ffmpeg, applying hints if there are any, killed if
+// the context is done first
+func transcode(ctx context.Context, src, format string, h *Hints, w io.Writer) error {
+	in, out := hintArgs(h)
+	args := append([]string{"-v", "error"}, in...)
+	args = append(append(args, "-i", src, "-vn"), out...)
+	args = append(args, transcodeArgs[format]...)
+	cmd := exec.CommandContext(ctx, *ffmpeg, append(args, "-")...)
+	cmd.Stdout = w
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+// Serve a song in another format, transcoding through the cache with
+// its hints applied
+func (s *Server) audioTranscoded(w http.ResponseWriter, r *http.Request, src, format string, fm Format, h *Hints) error {
+	if _, ok := transcodeArgs[format]; !ok {
+		http.Error(w, "unknown format", http.StatusBadRequest)
+		return nil
+	}
+	// Already in the codec asked for
+	if h == nil && (fm.Codec == transcodeCodecs[format] || fm.Codec == "" && strings.TrimPrefix(strings.ToLower(filepath.Ext(src)), ".") == format) {
+		http.ServeFile(w, r, src)
+		return nil
+	}
+
+	params := []string{"transcode", format}
+	if h != nil {
+		params = append(params, fmt.Sprintf("hints %g %g %g", h.Gain, h.Start, h.Fade))
+	}
+	key, err := s.cache.Key(src, params...)
+	if err != nil {
+		return err
+	}
+	// Abandoned requests stop ffmpeg, the partial file is dropped
+	f, err := s.cache.Open(r.Context(), key, func(w io.Writer) error {
+		return transcode(r.Context(), src, format, h, w)
+	})
+	if err != nil && r.Context().Err() != nil {
+		return nil // Client went away
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	http.ServeContent(w, r, "."+format, time.Now(), f)
+	return nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// How long a tunnel has to come up
+const tunnelTimeout = 30 * time.Second
+
+// Public URL for the jukebox, so remote friends can join without port
+// forwarding
+type Tunnel interface {
+	URL() string
+	Close() error
+}
+
+// Start a tunnel to a local port, kind is "tailscale" or "ngrok"
+func openTunnel(kind, port string) (Tunnel, error) {
+	switch kind {
+	case "tailscale":
+		return tailscaleTunnel(port)
+	case "ngrok":
+		return ngrokTunnel(port)
+	}
+	return nil, fmt.Errorf("unknown tunnel %q", kind)
+}
+
+// Tunnel run by a helper command, closed by stopping it
+type cmdTunnel struct {
+	cmd *exec.Cmd
+	url string
+}
+
+func (t *cmdTunnel) URL() string { return t.url }
+
+func (t *cmdTunnel) Close() error {
+	if err := t.cmd.Process.Signal(os.Interrupt); err != nil {
+		return t.cmd.Process.Kill()
+	}
+	return t.cmd.Wait()
+}
+
+// Tailscale Funnel, the URL is this machine's tailnet name
+func tailscaleTunnel(port string) (Tunnel, error) {
+	out, err := exec.Command("tailscale", "status", "--json").Output()
+	if err != nil {
+		return nil, fmt.Errorf("tailscale status: %v", err)
+	}
+	var status struct {
+		Self struct {
+			DNSName string
+		}
+	}
+	if err := json.Unmarshal(out, &status); err != nil {
+		return nil, err
+	}
+	host := strings.TrimSuffix(status.Self.DNSName, ".")
+	if host == "" {
+		return nil, errors.New("tailscale: not logged in")
+	}
+
+	cmd := exec.Command("tailscale", "funnel", port)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return &cmdTunnel{cmd: cmd, url: "https://" + host}, nil
+}
+
+// ngrok, the URL is read from its JSON log
+func ngrokTunnel(port string) (Tunnel, error) {
+	cmd := exec.Command("ngrok", "http", port, "--log", "stdout", "--log-format", "json")
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	t := &cmdTunnel{cmd: cmd}
+
+	found := make(chan string, 1)
+	go func() {
+		sc := bufio.NewScanner(stdout)
+		for sc.Scan() {
+			var line struct {
+				Lvl string
+				Msg string
+				Err string
+				URL string
+			}
+			if json.Unmarshal(sc.Bytes(), &line) != nil {
+				continue
+			}
+			if line.URL != "" {
+				select {
+				case found <- line.URL:
+				default:
+				}
+			} else if line.Lvl == "eror" || line.Lvl == "crit" {
+				log.Println("ngrok: ", line.Msg, line.Err)
+			}
+		}
+		io.Copy(ioutil.Discard, stdout)
+		close(found)
+	}()
+
+	select {
+	case url, ok := <-found:
+		if !ok {
+			t.Close()
+			return nil, errors.New("ngrok: exited before the tunnel started")
+		}
+		t.url = url
+		return t, nil
+	case <-time.After(tunnelTimeout):
+		t.Close()
+		return nil, errors.New("ngrok: timed out starting the tunnel")
+	}
+}
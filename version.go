@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Version bumps are gathered and announced at most this often
+const versionAnnounce = time.Second
+
+// Note the library listings changed: songs added, removed, rescanned,
+// hidden or rescored. songLock must be held.
+func (s *Server) libraryChanged() {
+	s.versionDirty = true
+	if s.versionTimer == nil {
+		s.versionTimer = time.AfterFunc(versionAnnounce, s.versionSend)
+	}
+}
+
+// The library version, it only goes up. Versions are times in ms, so
+// they keep going up across restarts, and a change only takes a new
+// one when it's next read so a scan is a single bump. songLock must be
+// held.
+func (s *Server) libraryVersion() int {
+	if s.versionDirty || s.version == 0 {
+		s.version = max(s.version+1, int(makeTimestamp()))
+		s.versionDirty = false
+	}
+	return s.version
+}
+
+// Tell clients the version they have is stale
+func (s *Server) versionSend() {
+	s.songLock.Lock()
+	defer s.songLock.Unlock()
+	s.versionTimer = nil
+	s.sockWriteLoop(&Message{Command: "version", Version: s.libraryVersion()})
+}
+
+// Write a listing as JSON tagged with the library version it's from.
+// Clients can skip unchanged ones with If-None-Match on the ETag or
+// ?version= of the last they saw, both get a 304.
+func writeListing(w http.ResponseWriter, r *http.Request, version int, v interface{}) error {
+	w.Header().Set("X-Library-Version", strconv.Itoa(version))
+	w.Header().Set("ETag", fmt.Sprintf(`W/"%d"`, version))
+	w.Header().Set("Cache-Control", "no-cache")
+	if r.FormValue("version") == strconv.Itoa(version) {
+		w.WriteHeader(http.StatusNotModified)
+		return nil
+	}
+
+	b := new(bytes.Buffer)
+	if err := json.NewEncoder(b).Encode(v); err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/json")
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(b.Bytes()))
+	return nil
+}
+
+// Library version handle, for clients polling without a socket
+func (s *Server) versionAPI(w http.ResponseWriter, r *http.Request) error {
+	s.songLock.Lock()
+	v := LibraryVersion{Version: s.libraryVersion()}
+	s.songLock.Unlock()
+	return writeListing(w, r, v.Version, &v)
+}
+
+type LibraryVersion struct {
+	Version int
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Posts events as JSON to a URL
+type webhook struct {
+	url    string
+	client *http.Client
+}
+
+func (w *webhook) Name() string { return "webhook" }
+
+func (w *webhook) Init(s *Server) error {
+	w.client = &http.Client{Timeout: 5 * time.Second}
+	return nil
+}
+
+func (w *webhook) Start() error { return nil }
+func (w *webhook) Stop() error  { return nil }
+
+func (w *webhook) HandleEvent(e Event) {
+	b, err := json.Marshal(&e)
+	if err != nil {
+		log.Println("webhook: ", err)
+		return
+	}
+	resp, err := w.client.Post(w.url, "application/json", bytes.NewReader(b))
+	if err != nil {
+		log.Println("webhook: ", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		log.Println("webhook: ", fmt.Sprintf("%s: %s", e.Type, resp.Status))
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Vote weights by role, roles are "admin", the invite scopes and "guest".
+// Sessions younger than NewFor seconds have their weight scaled by New.
+type Weights struct {
+	Roles  map[string]float64
+	New    float64
+	NewFor int
+}
+
+// Everyone counts the same. A new value each time, so decoding into
+// it never touches a map in use.
+func defaultWeights() Weights {
+	return Weights{Roles: map[string]float64{}, New: 1}
+}
+
+func (w *Weights) valid() error {
+	for role, v := range w.Roles {
+		if role != "guest" && scopes[role] == 0 {
+			return fmt.Errorf("unknown role %q", role)
+		}
+		if v < 0 || v > 100 {
+			return fmt.Errorf("weight %v out of range", v)
+		}
+	}
+	if w.New <= 0 || w.New > 100 || w.NewFor < 0 {
+		return fmt.Errorf("new guest weight %v for %ds out of range", w.New, w.NewFor)
+	}
+	return nil
+}
+
+func (s *Server) weightsLoad() error {
+	v, err := s.store.Setting("vote_weights")
+	if err != nil || v == "" {
+		return err
+	}
+	w := defaultWeights()
+	if err := json.Unmarshal([]byte(v), &w); err != nil {
+		return err
+	}
+	s.weightLock.Lock()
+	defer s.weightLock.Unlock()
+	s.weights = w
+	return nil
+}
+
+func role(sess *Session) string {
+	if sess.Admin {
+		return "admin"
+	}
+	if sess.Scope != "" && sess.ScopeExpires.After(time.Now()) {
+		return sess.Scope
+	}
+	return "guest"
+}
+
+// How much a session's vote counts, now in ms
+func (s *Server) weight(sess *Session, now int) float64 {
+	s.weightLock.Lock()
+	w := s.weights
+	s.weightLock.Unlock()
+
+	weight := 1.0
+	if v, ok := w.Roles[role(sess)]; ok {
+		weight = v
+	}
+	age := time.Unix(0, int64(now)*int64(time.Millisecond)).Sub(sess.Created)
+	if w.NewFor > 0 && age < time.Duration(w.NewFor)*time.Second {
+		weight *= w.New
+	}
+	return weight
+}
+
+// Vote weights handle, anyone can see them but only admins can PUT them
+func (s *Server) weightsAPI(w http.ResponseWriter, r *http.Request) error {
+	switch r.Method {
+	case "GET":
+	case "PUT", "POST":
+		if !s.isAdmin(r) {
+			http.Error(w, "admin only", http.StatusForbidden)
+			return nil
+		}
+		v := defaultWeights()
+		if err := json.NewDecoder(r.Body).Decode(&v); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return nil
+		}
+		if err := v.valid(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return nil
+		}
+		b, err := json.Marshal(&v)
+		if err != nil {
+			return err
+		}
+		if err := s.store.SetSetting("vote_weights", string(b)); err != nil {
+			return err
+		}
+		s.weightLock.Lock()
+		s.weights = v
+		s.weightLock.Unlock()
+		log.Println("Vote weights: ", string(b))
+		s.publish(&Message{Command: "weights"})
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return nil
+	}
+
+	s.weightLock.Lock()
+	v := s.weights
+	s.weightLock.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(&v)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	widgetWidth  = 320
+	widgetHeight = 240
+)
+
+// Compact now playing and voting page for iframes
+func (s *Server) widget(w http.ResponseWriter, r *http.Request) error {
+	s.songLock.Lock()
+	data := &State{
+		Address: s.addrs,
+		Playing: s.songPlaying.Song.Name,
+		URL:     s.baseURL(),
+	}
+	for _, song := range s.pool.Songs() {
+		data.Songs = append(data.Songs, Song{Name: song.Name, Score: song.Score})
+	}
+	s.songLock.Unlock()
+
+	w.Header().Set("Content-Security-Policy", "frame-ancestors "+*frameAncestors)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	return s.tmpl.ExecuteTemplate(w, "widget.html", data)
+}
+
+type OEmbed struct {
+	Version      string `json:"version"`
+	Type         string `json:"type"`
+	Title        string `json:"title"`
+	ProviderName string `json:"provider_name"`
+	ProviderURL  string `json:"provider_url"`
+	HTML         string `json:"html"`
+	Width        int    `json:"width"`
+	Height       int    `json:"height"`
+}
+
+// oEmbed descriptor for the widget, for our own pages only
+func (s *Server) oembed(w http.ResponseWriter, r *http.Request) error {
+	url := s.baseURL()
+	if !strings.HasPrefix(r.FormValue("url"), url+"/") {
+		http.NotFound(w, r)
+		return nil
+	}
+	if f := r.FormValue("format"); f != "" && f != "json" {
+		http.Error(w, "format not supported", http.StatusNotImplemented)
+		return nil
+	}
+
+	width, height := widgetWidth, widgetHeight
+	if v, err := strconv.Atoi(r.FormValue("maxwidth")); err == nil && v > 0 && v < width {
+		width = v
+	}
+	if v, err := strconv.Atoi(r.FormValue("maxheight")); err == nil && v > 0 && v < height {
+		height = v
+	}
+
+	html := fmt.Sprintf(`<iframe src="%s/widget" width="%d" height="%d" frameborder="0"></iframe>`,
+		template.HTMLEscapeString(url), width, height)
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(&OEmbed{
+		Version:      "1.0",
+		Type:         "rich",
+		Title:        "Jukebox",
+		ProviderName: "Jukebox",
+		ProviderURL:  url + "/",
+		HTML:         html,
+		Width:        width,
+		Height:       height,
+	})
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"unicode"
+)
+
+// Longest file name in an export, in runes
+const maxZipName = 100
+
+// Name safe on any file system, "" if nothing is left
+func zipName(s string) string {
+	s = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || strings.ContainsRune(`/\:*?"<>|`, r) {
+			return '_'
+		}
+		return r
+	}, s)
+	if r := []rune(s); len(r) > maxZipName {
+		s = string(r[:maxZipName])
+	}
+	return strings.Trim(s, " .")
+}
+
+// Stream a playlist's songs as a ZIP, numbered in order with an M3U of
+// them. Audio is stored as it is, it doesn't compress.
+func (s *Server) playlistZip(w http.ResponseWriter, r *http.Request, name string, songs []string) error {
+	if !s.isAdmin(r) {
+		http.Error(w, "admin only", http.StatusForbidden)
+		return nil
+	}
+
+	// Check the size before sending anything
+	var total int64
+	infos := make([]os.FileInfo, len(songs))
+	for i, song := range songs {
+		if !s.librarySong(song) {
+			continue // Saved before names were checked, or since removed
+		}
+		fi, err := os.Stat(musicPath(song))
+		if err != nil {
+			log.Println("zip: ", err)
+			continue // Deleted since, left out
+		}
+		infos[i] = fi
+		total += fi.Size()
+	}
+	if max := int64(*zipMax) << 20; max > 0 && total > max {
+		http.Error(w, fmt.Sprintf("playlist is %d MB, over the %d MB limit", total>>20, *zipMax), http.StatusRequestEntityTooLarge)
+		return nil
+	}
+
+	base := zipName(name)
+	if base == "" {
+		base = "playlist"
+	}
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", base+".zip"))
+	w = s.throttle(w, r)
+
+	digits := len(fmt.Sprint(len(songs)))
+	if digits < 2 {
+		digits = 2
+	}
+	zw := zip.NewWriter(w)
+	var list strings.Builder
+	list.WriteString("#EXTM3U\n")
+	for i, song := range songs {
+		if infos[i] == nil {
+			continue
+		}
+		ext := path.Ext(song)
+		title, _ := s.songTitle(song)
+		if title == song {
+			title = strings.TrimSuffix(path.Base(song), ext) // Not scanned
+		}
+		entry := fmt.Sprintf("%0*d %s%s", digits, i+1, zipName(title), strings.ToLower(ext))
+		if err := zipFile(zw, entry, musicPath(song), infos[i]); err != nil {
+			if r.Context().Err() != nil {
+				return nil // Client went away
+			}
+			return err
+		}
+		fmt.Fprintf(&list, "#EXTINF:-1,%s\n%s\n", m3uText(title), entry)
+	}
+
+	fw, err := zw.Create(base + ".m3u8")
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(fw, list.String()); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+func zipFile(zw *zip.Writer, entry, src string, fi os.FileInfo) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fw, err := zw.CreateHeader(&zip.FileHeader{
+		Name:     entry,
+		Method:   zip.Store,
+		Modified: fi.ModTime(),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(fw, f)
+	return err
+}